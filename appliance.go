@@ -0,0 +1,375 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NIC is the appliance virtual machine network adapter type.
+type NIC string
+
+const (
+	NICE1000   NIC = "e1000"
+	NICE1000e  NIC = "e1000e"
+	NICVmxnet3 NIC = "vmxnet3"
+	NICVirtio  NIC = "virtio"
+)
+
+func (n NIC) String() string {
+	return string(n)
+}
+
+func (n NIC) IsSupported() bool {
+	switch n {
+	case NICE1000, NICE1000e, NICVmxnet3, NICVirtio:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n NIC) Validate() error {
+	if !n.IsSupported() {
+		return fmt.Errorf("invalid nic: %s valid nics are: e1000, e1000e, vmxnet3, virtio", n)
+	}
+	return nil
+}
+
+// resourceSubType returns the OVF ethernet adapter sub type.
+func (n NIC) resourceSubType() string {
+	switch n {
+	case NICE1000e:
+		return "E1000e"
+	case NICVmxnet3:
+		return "VmxNet3"
+	case NICVirtio:
+		return "virtio"
+	default:
+		return "E1000"
+	}
+}
+
+// ApplianceOptions are the virtual machine settings written in the ova and ovf appliances descriptor,
+// and in the Vagrant box.
+type ApplianceOptions struct {
+	// CPUs is the number of virtual CPUs, defaults to 1.
+	CPUs uint
+	// Memory is the memory size in MiB, defaults to 1024.
+	Memory uint64
+	// NIC is the network adapter type, defaults to e1000.
+	NIC NIC
+	// VagrantProvider is the provider of the Vagrant box, defaults to libvirt.
+	VagrantProvider VagrantProvider
+}
+
+func (o ApplianceOptions) Validate() error {
+	if o.NIC != "" {
+		if err := o.NIC.Validate(); err != nil {
+			return err
+		}
+	}
+	if o.VagrantProvider != "" {
+		return o.VagrantProvider.Validate()
+	}
+	return nil
+}
+
+func (o ApplianceOptions) withDefaults() ApplianceOptions {
+	if o.CPUs == 0 {
+		o.CPUs = 1
+	}
+	if o.Memory == 0 {
+		o.Memory = 1024
+	}
+	if o.NIC == "" {
+		o.NIC = NICE1000
+	}
+	if o.VagrantProvider == "" {
+		o.VagrantProvider = VagrantProviderLibvirt
+	}
+	return o
+}
+
+// applianceFiles returns the files of the ovf appliance described by the descriptor path:
+// the descriptor, its manifest and the disk.
+func applianceFiles(descriptor string) []string {
+	base := strings.TrimSuffix(descriptor, filepath.Ext(descriptor))
+	return []string{descriptor, base + ".mf", base + "-disk1.vmdk"}
+}
+
+// ovfOS returns the CIM operating system id and the VMware guest type of the release.
+func ovfOS(r OSRelease, arch string) (int, string) {
+	if arch == archARM64 {
+		return 101, "arm-other5xlinux-64"
+	}
+	switch r.ID {
+	case ReleaseUbuntu:
+		return 94, "ubuntu64Guest"
+	case ReleaseDebian, ReleaseKali:
+		return 96, "debian10_64Guest"
+	case ReleaseCentOS:
+		return 107, "centos64Guest"
+	case ReleaseRHEL, ReleaseRocky, ReleaseAlmaLinux:
+		return 80, "rhel8_64Guest"
+	default:
+		return 101, "other3xLinux64Guest"
+	}
+}
+
+type ovfDescriptor struct {
+	Name     string
+	Disk     string
+	DiskSize int64
+	Capacity uint64
+	ApplianceOptions
+	NICType     string
+	EFI         bool
+	OSID        int
+	OSType      string
+	Description string
+}
+
+var ovfTemplate = template.Must(template.New("ovf").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var b strings.Builder
+		err := xml.EscapeText(&b, []byte(s))
+		return b.String(), err
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="{{ xml .Disk }}" ovf:id="file1" ovf:size="{{ .DiskSize }}"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="{{ .Capacity }}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="NAT">
+      <Description>The NAT network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{ xml .Name }}">
+    <Info>A virtual machine</Info>
+    <Name>{{ xml .Name }}</Name>
+    <OperatingSystemSection ovf:id="{{ .OSID }}" vmw:osType="{{ .OSType }}">
+      <Info>The kind of installed guest operating system</Info>
+      <Description>{{ xml .Description }}</Description>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{ xml .Name }}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-10</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{ .CPUs }} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{ .CPUs }}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{ .Memory }}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{ .Memory }}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>IDE Controller</rasd:Description>
+        <rasd:ElementName>ideController0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>PIIX4</rasd:ResourceSubType>
+        <rasd:ResourceType>5</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>disk1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>NAT</rasd:Connection>
+        <rasd:Description>{{ .NICType }} ethernet adapter on "NAT"</rasd:Description>
+        <rasd:ElementName>ethernet0</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>{{ .NICType }}</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="{{ if .EFI }}efi{{ else }}bios{{ end }}"/>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+func (d ovfDescriptor) Render(w io.Writer) error {
+	return ovfTemplate.Execute(w, d)
+}
+
+// writeManifest writes the ovf manifest holding the files SHA256 checksums.
+func writeManifest(path string, files ...string) error {
+	var b bytes.Buffer
+	for _, v := range files {
+		f, err := os.Open(v)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "SHA256(%s)= %s\n", filepath.Base(v), hex.EncodeToString(h.Sum(nil)))
+	}
+	return os.WriteFile(path, b.Bytes(), perm)
+}
+
+// efiFirmware reports whether the image needs an efi firmware to boot.
+func (b *builder) efiFirmware() bool {
+	_, efi := b.bootloader.(grubEFI)
+	return efi || b.arch == archARM64
+}
+
+// ovfDescriptor describes the appliance built around the disk of the given size.
+func (b *builder) ovfDescriptor(disk string, size int64) ovfDescriptor {
+	id, typ := ovfOS(b.osRelease, b.arch)
+	d := ovfDescriptor{
+		Name:             filepath.Base(b.diskOut),
+		Disk:             filepath.Base(disk),
+		DiskSize:         size,
+		Capacity:         b.size,
+		ApplianceOptions: b.appliance.withDefaults(),
+		EFI:              b.efiFirmware(),
+		OSID:             id,
+		OSType:           typ,
+		Description:      strings.TrimSpace(b.osRelease.Name + " " + b.osRelease.Version),
+	}
+	d.NICType = d.NIC.resourceSubType()
+	return d
+}
+
+// makeOVF writes the ovf appliance described by the descriptor path:
+// the disk is converted to a stream optimized vmdk, and the manifest holds the files checksums.
+func (b *builder) makeOVF(ctx context.Context, progress ProgressFunc, descriptor string) error {
+	files := applianceFiles(descriptor)
+	mf, disk := files[1], files[2]
+	if err := qemuImgConvert(ctx, progress, "-O", "vmdk", "-o", "subformat=streamOptimized", b.diskRaw, disk); err != nil {
+		return err
+	}
+	i, err := os.Stat(disk)
+	if err != nil {
+		return err
+	}
+	d := b.ovfDescriptor(disk, i.Size())
+	f, err := os.Create(descriptor)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := d.Render(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return writeManifest(mf, descriptor, disk)
+}
+
+// makeOVA writes the ova appliance: the ovf appliance files in a tar archive, starting with the descriptor.
+func (b *builder) makeOVA(ctx context.Context, progress ProgressFunc, path string) error {
+	dir := path + ".d"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	files := applianceFiles(filepath.Join(dir, filepath.Base(b.diskOut)+".ovf"))
+	if err := b.makeOVF(ctx, progress, files[0]); err != nil {
+		return err
+	}
+	mtime := time.Now()
+	if b.reproducible.IsEnabled() {
+		mtime = b.reproducible.Epoch
+	}
+	logger(ctx).Infof("archiving ova appliance")
+	return tarFiles(path, mtime, files...)
+}
+
+// tarFiles writes the files in a tar archive, in the given order.
+func tarFiles(path string, mtime time.Time, files ...string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	for _, v := range files {
+		if err := tarFile(tw, v, mtime); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func tarFile(tw *tar.Writer, path string, mtime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	i, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.Base(path),
+		Size:     i.Size(),
+		Mode:     0644,
+		ModTime:  mtime.UTC().Truncate(time.Second),
+		Format:   tar.FormatUSTAR,
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplianceOVFDescriptor(t *testing.T) {
+	tests := []struct {
+		name       string
+		release    OSRelease
+		arch       string
+		bootloader BootloaderProvider
+		opts       ApplianceOptions
+		osType     string
+		nic        string
+		cpus       string
+		memory     string
+		firmware   string
+	}{
+		{name: "defaults", release: OSRelease{ID: ReleaseUbuntu, Name: "Ubuntu"}, arch: archAMD64, bootloader: grubProvider{}, osType: "ubuntu64Guest", nic: "E1000", cpus: "1", memory: "1024", firmware: "bios"},
+		{name: "efi", release: OSRelease{ID: ReleaseDebian, Name: "Debian & co"}, arch: archAMD64, bootloader: grubEFIProvider{}, opts: ApplianceOptions{CPUs: 4, Memory: 4096, NIC: NICVmxnet3}, osType: "debian10_64Guest", nic: "VmxNet3", cpus: "4", memory: "4096", firmware: "efi"},
+		{name: "arm64", release: OSRelease{ID: ReleaseDebian, Name: "Debian"}, arch: archARM64, bootloader: grubEFIProvider{}, osType: "arm-other5xlinux-64", nic: "E1000", cpus: "1", memory: "1024", firmware: "efi"},
+		{name: "alpine", release: OSRelease{ID: ReleaseAlpine}, arch: archAMD64, bootloader: grubBiosProvider{}, opts: ApplianceOptions{NIC: NICVirtio}, osType: "other3xLinux64Guest", nic: "virtio", cpus: "1", memory: "1024", firmware: "bios"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bl, err := tt.bootloader.New(Config{}, tt.release, tt.arch)
+			require.NoError(t, err)
+			bu := &builder{osRelease: tt.release, arch: tt.arch, bootloader: bl, appliance: tt.opts, diskOut: "vm", size: 1 << 30}
+			d := bu.ovfDescriptor("vm-disk1.vmdk", 42)
+			var b bytes.Buffer
+			require.NoError(t, d.Render(&b))
+			var env struct {
+				File struct {
+					Href string `xml:"href,attr"`
+					Size string `xml:"size,attr"`
+				} `xml:"References>File"`
+				System struct {
+					OS struct {
+						Type        string `xml:"osType,attr"`
+						Description string `xml:"Description"`
+					} `xml:"OperatingSystemSection"`
+					Items []struct {
+						ResourceType    int    `xml:"ResourceType"`
+						ResourceSubType string `xml:"ResourceSubType"`
+						VirtualQuantity string `xml:"VirtualQuantity"`
+					} `xml:"VirtualHardwareSection>Item"`
+					Config struct {
+						Value string `xml:"value,attr"`
+					} `xml:"VirtualHardwareSection>Config"`
+				} `xml:"VirtualSystem"`
+			}
+			require.NoError(t, xml.Unmarshal(b.Bytes(), &env))
+			assert.Equal(t, "vm-disk1.vmdk", env.File.Href)
+			assert.Equal(t, "42", env.File.Size)
+			assert.Equal(t, tt.osType, env.System.OS.Type)
+			assert.Equal(t, tt.release.Name, env.System.OS.Description)
+			assert.Equal(t, tt.firmware, env.System.Config.Value)
+			for _, v := range env.System.Items {
+				switch v.ResourceType {
+				case 3:
+					assert.Equal(t, tt.cpus, v.VirtualQuantity)
+				case 4:
+					assert.Equal(t, tt.memory, v.VirtualQuantity)
+				case 10:
+					assert.Equal(t, tt.nic, v.ResourceSubType)
+				}
+			}
+		})
+	}
+}
+
+func TestApplianceManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := applianceFiles(filepath.Join(dir, "vm.ovf"))
+	require.NoError(t, os.WriteFile(files[0], []byte("ovf"), 0644))
+	require.NoError(t, os.WriteFile(files[2], nil, 0644))
+	require.NoError(t, writeManifest(files[1], files[0], files[2]))
+	b, err := os.ReadFile(files[1])
+	require.NoError(t, err)
+	assert.Equal(t, "SHA256(vm.ovf)= 7612125ffe9b1e2ac937436c4f3377a5192770bb02fb404c1cefdbcad4934352\n"+
+		"SHA256(vm-disk1.vmdk)= e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n", string(b))
+}
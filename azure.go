@@ -0,0 +1,47 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// azureFormat is the Azure fixed VHD format, uploaded as is as a page blob.
+const azureFormat = "azure.vhd"
+
+// azureAlignment is the alignment of the Azure disks virtual size.
+const azureAlignment = uint64(datasize.MB)
+
+// azureSize returns the size rounded up to the Azure disks virtual size alignment.
+func azureSize(size uint64) uint64 {
+	return (size + azureAlignment - 1) / azureAlignment * azureAlignment
+}
+
+// alignAzureSize rounds up the disk size when it is converted to an Azure fixed VHD: all the formats share the same disk.
+func (b *builder) alignAzureSize(ctx context.Context) {
+	if !b.hasFormat(azureFormat) || azureSize(b.size) == b.size {
+		return
+	}
+	logger(ctx).Infof("rounding disk size up to %s for azure", datasize.ByteSize(azureSize(b.size)).HR())
+	b.size = azureSize(b.size)
+}
+
+// azureQemuImgArgs returns the qemu-img convert arguments writing a fixed VHD, whose virtual size is exactly the disk size:
+// qemu-img would otherwise round it to the VHD geometry.
+func azureQemuImgArgs() []string {
+	return []string{"-O", "vpc", "-o", "subformat=fixed,force_size=on"}
+}
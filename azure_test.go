@@ -0,0 +1,73 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureSize(t *testing.T) {
+	mb := uint64(datasize.MB)
+	tests := []struct {
+		name string
+		size uint64
+		want uint64
+	}{
+		{name: "aligned", size: 10 * uint64(datasize.GB), want: 10 * uint64(datasize.GB)},
+		{name: "one byte over", size: 100*mb + 1, want: 101 * mb},
+		{name: "sector aligned", size: 100*mb + 512, want: 101 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, azureSize(tt.size))
+		})
+	}
+	b := &builder{formats: []string{"qcow2"}, size: 100*mb + 1}
+	b.alignAzureSize(context.Background())
+	assert.Equal(t, 100*mb+1, b.size)
+	b.formats = append(b.formats, azureFormat)
+	b.alignAzureSize(context.Background())
+	assert.Equal(t, 101*mb, b.size)
+}
+
+func TestAzureDockerfile(t *testing.T) {
+	for r, agent := range map[OSRelease]string{
+		{ID: ReleaseUbuntu, VersionID: "22.04"}: "walinuxagent",
+		{ID: ReleaseDebian, VersionID: "12"}:    "waagent",
+		{ID: ReleaseAlpine, VersionID: "3.18"}:  "cloud-init",
+		{ID: ReleaseCentOS, VersionID: "8"}:     "WALinuxAgent",
+	} {
+		t.Run(string(r.ID), func(t *testing.T) {
+			for _, azure := range []bool{false, true} {
+				var opts []ConvertOption
+				if azure {
+					opts = append(opts, WithFormats(azureFormat))
+				}
+				d, err := NewDockerfile(r, "img", "", NetworkManagerNone, false, false, false, opts...)
+				require.NoError(t, err)
+				var b strings.Builder
+				require.NoError(t, d.Render(&b))
+				assert.Equal(t, azure, strings.Contains(b.String(), agent))
+				assert.Equal(t, azure, strings.Contains(b.String(), "hv_storvsc"))
+			}
+		})
+	}
+}
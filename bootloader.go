@@ -41,3 +41,9 @@ type Bootloader interface {
 	Validate(fs BootFS) error
 	Setup(ctx context.Context, dev, root, cmdline string) error
 }
+
+// RootlessBootloader is implemented by the bootloaders that can be installed directly
+// in a raw disk image file, without loop devices nor mounted filesystems.
+type RootlessBootloader interface {
+	SetupImage(ctx context.Context, img string, bootOffset uint64, cmdline string) error
+}
@@ -20,13 +20,16 @@ import (
 	"os"
 	exec2 "os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
+	"golang.org/x/sync/errgroup"
 
+	"go.linka.cloud/d2vm/pkg/compress"
 	"go.linka.cloud/d2vm/pkg/exec"
 )
 
@@ -44,7 +47,13 @@ ff02::3 ip6-allhosts
 	perm os.FileMode = 0644
 )
 
-var formats = []string{"qcow2", "qed", "raw", "vdi", "vhd", "vhd", "vhdx", "vmdk"}
+const (
+	// archAMD64 and archARM64 are the builder architectures, named after the kernel ones
+	archAMD64 = "x86_64"
+	archARM64 = "arm64"
+)
+
+var formats = []string{"azure.vhd", "box", "iso", "qcow2", "qed", "ova", "ovf", "raw", "raw.gz", "raw.xz", "raw.zst", "vdi", "vhd", "vhd", "vhdx", "vmdk"}
 
 type Builder interface {
 	Build(ctx context.Context) (err error)
@@ -59,15 +68,52 @@ type builder struct {
 	src     string
 	img     *image
 	diskRaw string
+	// diskOut is the converted disk images path, without the format extension
 	diskOut string
-	format  string
+	formats []string
+	// qcow2Compression compresses the qcow2 image clusters
+	qcow2Compression QCOW2Compression
+	// appliance is the ova and ovf appliances virtual machine settings
+	appliance ApplianceOptions
+	// outputKind is the kind of artifacts written in place of the disk images, the disk images if not set
+	outputKind OutputKind
+	netboot    NetbootOptions
 
 	size     uint64
 	mntPoint string
 
-	splitBoot bool
-	bootSize  uint64
-	bootFS    BootFS
+	splitBoot      bool
+	bootSize       uint64
+	bootFS         BootFS
+	partitionTable PartitionTable
+
+	rootFS     RootFS
+	rootFSOpts RootFSOptions
+
+	layout      Layout
+	layoutParts []*layoutPart
+
+	readOnly     ReadOnlyRoot
+	overlayPart  string
+	overlayUUID  string
+	rootPartUUID string
+	squashFSSize uint64
+
+	verity           Verity
+	verityStart      uint64
+	verityEnd        uint64
+	verityPart       string
+	verityPartUUID   string
+	verityRootHash   string
+	verityHashOffset uint64
+	rootPartSize     uint64
+
+	swapType     SwapType
+	swapSize     uint64
+	swapPart     string
+	swapUUID     string
+	swapPartUUID string
+	resumeOffset uint64
 
 	loDevice        string
 	bootPart        string
@@ -80,6 +126,13 @@ type builder struct {
 	cryptUUID       string
 
 	luksPassword string
+	luksOpts     LuksOptions
+
+	rootless   bool
+	bootFATID  string
+	bootOffset uint64
+
+	reproducible Reproducible
 
 	cmdLineExtra string
 	arch         string
@@ -88,50 +141,104 @@ type builder struct {
 	dns       []string
 	dnsSearch []string
 	hosts     string
+
+	hooks    Hooks
+	progress ProgressFunc
 }
 
-func NewBuilder(ctx context.Context, workdir, imgTag, disk string, size uint64, osRelease OSRelease, format string, cmdLineExtra string, splitBoot bool, bootFS BootFS, bootSize uint64, luksPassword string, bootLoader string, platform, hostname string, dns, dnsSearch []string, extraHosts map[string]string) (Builder, error) {
+// NewBuilder returns the builder of the disk image of the imgTag docker image. The conversion options set the other
+// disk image settings, and override the arguments ones.
+func NewBuilder(ctx context.Context, workdir, imgTag, disk string, size uint64, osRelease OSRelease, format string, cmdLineExtra string, splitBoot bool, bootFS BootFS, bootSize uint64, luksPassword string, bootLoader string, platform, hostname string, dns, dnsSearch []string, extraHosts map[string]string, opts ...ConvertOption) (Builder, error) {
+	o := &convertOptions{
+		size:         Size{Bytes: size},
+		cmdLineExtra: cmdLineExtra,
+		splitBoot:    splitBoot,
+		bootFS:       bootFS,
+		bootSize:     bootSize,
+		luksPassword: luksPassword,
+		bootLoader:   bootLoader,
+		platform:     platform,
+		hostname:     hostname,
+		dns:          dns,
+		dnsSearch:    dnsSearch,
+		hosts:        extraHosts,
+	}
+	if format != "" {
+		o.formats = []string{format}
+	}
+	for _, v := range opts {
+		v(o)
+	}
+	o.netboot = o.netbootOptions()
 	var arch string
-	switch platform {
+	switch o.platform {
 	case "linux/amd64":
-		arch = "x86_64"
+		arch = archAMD64
 	case "linux/arm64", "linux/aarch64":
-		arch = "arm64"
+		arch = archARM64
 	default:
-		return nil, fmt.Errorf("unexpected platform: %s, supported platforms: linux/amd64, linux/arm64", platform)
+		return nil, fmt.Errorf("unexpected platform: %s, supported platforms: linux/amd64, linux/arm64", o.platform)
 	}
-	if luksPassword != "" {
-		if !splitBoot {
+	if err := o.layout.Validate(); err != nil {
+		return nil, err
+	}
+	// the layout boot and root partitions take precedence over the options
+	if p, ok := o.layout.partition("/boot"); ok {
+		o.splitBoot = true
+		if p.FS != "" {
+			o.bootFS = BootFS(p.FS)
+		}
+		if p.Size != 0 {
+			o.bootSize = roundUp(uint64(p.Size), mib) / mib
+		}
+	}
+	if p, ok := o.layout.partition("/"); ok {
+		if p.FS != "" {
+			o.rootFS = RootFS(p.FS)
+		}
+		if p.Label != "" {
+			o.rootFSOpts.Label = p.Label
+		}
+	}
+	if o.luksPassword != "" {
+		if !o.splitBoot {
 			return nil, fmt.Errorf("luks encryption requires split boot")
 		}
-		if !osRelease.SupportsLUKS() {
+		if !osRelease.SupportsLUKSContext(ctx) {
 			return nil, fmt.Errorf("luks encryption not supported on %s %s", osRelease.ID, osRelease.VersionID)
 		}
 	}
-	f := strings.ToLower(format)
-	valid := false
-	for _, v := range formats {
-		if valid = v == f; valid {
-			break
+	if len(o.formats) == 0 {
+		o.formats = []string{"raw"}
+	}
+	for _, f := range o.formats {
+		if err := validateFormat(f); err != nil {
+			return nil, err
 		}
 	}
-	if !valid {
-		return nil, fmt.Errorf("invalid format: %s valid formats are: %s", f, strings.Join(formats, " "))
+	if o.qcow2Compression != "" {
+		if err := o.qcow2Compression.Validate(); err != nil {
+			return nil, err
+		}
 	}
-	if f == "vhd" {
-		f = "vpc"
+	if err := o.appliance.Validate(); err != nil {
+		return nil, err
 	}
 
-	if splitBoot && bootSize < 50 {
+	if o.splitBoot && o.bootSize < 50 {
 		return nil, fmt.Errorf("boot partition size must be at least 50MiB")
 	}
 
-	if splitBoot && bootSize >= size {
-		return nil, fmt.Errorf("boot partition size must be less than the disk size")
+	if o.bootLoader == "" {
+		o.bootLoader = "syslinux"
 	}
 
-	if bootLoader == "" {
-		bootLoader = "syslinux"
+	if err := o.hooks.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := o.readOnly.Validate(); err != nil {
+		return nil, err
 	}
 
 	config, err := osRelease.Config()
@@ -139,20 +246,64 @@ func NewBuilder(ctx context.Context, workdir, imgTag, disk string, size uint64,
 		return nil, err
 	}
 
-	if splitBoot {
+	if o.splitBoot {
 		config.Kernel = strings.TrimPrefix(config.Kernel, "/boot")
 		config.Initrd = strings.TrimPrefix(config.Initrd, "/boot")
 	}
 
-	if bootFS == "" {
-		bootFS = BootFSExt4
+	if o.bootFS == "" {
+		o.bootFS = BootFSExt4
+	}
+
+	if err := o.bootFS.Validate(); err != nil {
+		return nil, err
+	}
+
+	if o.partitionTable == "" {
+		o.partitionTable = PartitionTableMSDOS
 	}
 
-	if err := bootFS.Validate(); err != nil {
+	if err := o.partitionTable.Validate(); err != nil {
 		return nil, err
 	}
 
-	blp, err := BootloaderByName(bootLoader)
+	if o.rootFS == "" {
+		o.rootFS = RootFSExt4
+	}
+
+	if err := o.rootFS.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := o.rootFSOpts.Validate(o.rootFS); err != nil {
+		return nil, err
+	}
+
+	if o.rootFS.IsBtrfs() && (osRelease.ID == ReleaseCentOS || osRelease.ID == ReleaseRocky || osRelease.ID == ReleaseAlmaLinux) {
+		return nil, fmt.Errorf("btrfs root filesystem is not supported on %s", osRelease.ID)
+	}
+
+	config.RootFS = ifElse(o.readOnly.SquashFS, rootFSSquashFS, o.rootFS)
+
+	if o.swapSize != 0 {
+		if o.swapType == "" {
+			o.swapType = SwapPartition
+		}
+		if err := o.swapType.Validate(); err != nil {
+			return nil, err
+		}
+		if o.swapSize < swapMinSize {
+			return nil, fmt.Errorf("swap size must be at least 40KiB")
+		}
+		if o.rootless && o.swapType.IsFile() {
+			return nil, fmt.Errorf("swap file is not supported in rootless build, use a swap partition")
+		}
+		if o.luksPassword != "" && o.swapType.IsPartition() && osRelease.ID == ReleaseAlpine {
+			return nil, fmt.Errorf("encrypted swap partition is not supported on %s, use a swap file", osRelease.ID)
+		}
+	}
+
+	blp, err := BootloaderByName(o.bootLoader)
 	if err != nil {
 		return nil, err
 	}
@@ -161,12 +312,31 @@ func NewBuilder(ctx context.Context, workdir, imgTag, disk string, size uint64,
 		return nil, err
 	}
 
-	if err := bl.Validate(bootFS); err != nil {
+	if err := bl.Validate(o.bootFS); err != nil {
 		return nil, err
 	}
 
-	if size == 0 {
-		size = 10 * uint64(datasize.GB)
+	if _, ok := bl.(*syslinux); ok && !o.splitBoot && !o.rootFS.IsExt() {
+		return nil, fmt.Errorf("syslinux cannot boot from a %s root filesystem, use split boot", o.rootFS)
+	}
+
+	if o.rootless {
+		if !o.rootFS.IsExt() {
+			return nil, fmt.Errorf("rootless build only supports ext4 root filesystem")
+		}
+		if !o.splitBoot || !o.bootFS.IsFat() {
+			return nil, fmt.Errorf("rootless build requires split boot with a fat32 boot partition")
+		}
+		if o.luksPassword != "" {
+			return nil, fmt.Errorf("luks encryption is not supported in rootless build")
+		}
+		if _, ok := bl.(RootlessBootloader); !ok {
+			return nil, fmt.Errorf("%s bootloader is not supported in rootless build", o.bootLoader)
+		}
+	}
+
+	if !o.size.Auto && o.size.Bytes == 0 {
+		o.size.Bytes = 10 * uint64(datasize.GB)
 	}
 	if disk == "" {
 		disk = "disk0"
@@ -175,49 +345,96 @@ func NewBuilder(ctx context.Context, workdir, imgTag, disk string, size uint64,
 	if err != nil {
 		return nil, err
 	}
-	// i, err := os.Stat(imgTar)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// if i.Size() > size {
-	// 	s := datasize.ByteSize(math.Ceil(datasize.ByteSize(i.Size()).GBytes())) * datasize.GB
-	// 	logrus.Warnf("%s is smaller than rootfs size, using %s", datasize.ByteSize(size), s)
-	// 	size = int64(s)
-	// }
-	if hostname == "" {
-		hostname = "localhost"
-	}
-	if len(dns) == 0 {
-		dns = []string{"8.8.8.8"}
+	if o.hostname == "" {
+		o.hostname = "localhost"
+	}
+	if len(o.dns) == 0 {
+		o.dns = []string{"8.8.8.8"}
 	}
 	hosts := hosts
-	for k, v := range extraHosts {
-		hosts += fmt.Sprintf("%s %s\n", v, k)
+	// the extra hosts are sorted so that the generated file does not depend on the map order
+	names := make([]string, 0, len(o.hosts))
+	for k := range o.hosts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		hosts += fmt.Sprintf("%s %s\n", o.hosts[k], k)
 	}
 	b := &builder{
-		osRelease:    osRelease,
-		config:       config,
-		bootloader:   bl,
-		img:          img,
-		diskRaw:      filepath.Join(workdir, disk+".d2vm.raw"),
-		diskOut:      filepath.Join(workdir, disk+"."+format),
-		format:       f,
-		size:         size,
-		mntPoint:     filepath.Join(workdir, "/mnt"),
-		cmdLineExtra: cmdLineExtra,
-		splitBoot:    splitBoot,
-		bootSize:     bootSize,
-		bootFS:       bootFS,
-		luksPassword: luksPassword,
-		arch:         arch,
-		hostname:     hostname,
-		dns:          dns,
-		dnsSearch:    dnsSearch,
-		hosts:        hosts,
+		osRelease:        osRelease,
+		config:           config,
+		bootloader:       bl,
+		img:              img,
+		diskRaw:          filepath.Join(workdir, disk+".d2vm.raw"),
+		diskOut:          filepath.Join(workdir, disk),
+		formats:          o.formats,
+		qcow2Compression: o.qcow2Compression,
+		appliance:        o.appliance,
+		outputKind:       o.outputKind,
+		netboot:          o.netboot,
+		mntPoint:         filepath.Join(workdir, "/mnt"),
+		cmdLineExtra:     o.cmdLineExtra,
+		splitBoot:        o.splitBoot,
+		bootSize:         o.bootSize,
+		bootFS:           o.bootFS,
+		partitionTable:   o.partitionTable,
+		rootFS:           o.rootFS,
+		rootFSOpts:       o.rootFSOpts,
+		swapType:         o.swapType,
+		swapSize:         o.swapSize,
+		layout:           o.layout,
+		readOnly:         o.readOnly,
+		verity:           o.verity,
+		luksPassword:     o.luksPassword,
+		luksOpts:         o.luksOpts,
+		rootless:         o.rootless,
+		reproducible:     o.buildReproducible,
+		arch:             arch,
+		hostname:         o.hostname,
+		dns:              o.dns,
+		dnsSearch:        o.dnsSearch,
+		hosts:            hosts,
+		hooks:            o.hooks,
+		progress:         o.progress,
+	}
+	if err := b.validateLayout(); err != nil {
+		return nil, err
+	}
+	if err := b.validateLuks(); err != nil {
+		return nil, err
+	}
+	if err := b.validateReadOnly(); err != nil {
+		return nil, err
+	}
+	if err := b.validateVerity(); err != nil {
+		return nil, err
+	}
+	if err := b.validateReproducible(); err != nil {
+		return nil, err
+	}
+	if err := b.validateLive(); err != nil {
+		return nil, err
+	}
+	if err := b.validateNetboot(); err != nil {
+		return nil, err
+	}
+	if err := b.validateMicroVM(); err != nil {
+		return nil, err
 	}
 	if err := b.checkDependencies(); err != nil {
 		return nil, err
 	}
+	if err := o.progress.phase(PhaseMeasure, func() (err error) {
+		b.size, err = b.diskSize(ctx, o.size)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	b.alignAzureSize(ctx)
+	if err := b.setupLayout(); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(b.mntPoint, os.ModePerm); err != nil {
 		return nil, err
 	}
@@ -229,37 +446,68 @@ func (b *builder) Build(ctx context.Context) (err error) {
 		if err == nil {
 			return
 		}
-		logrus.WithError(err).Error("Build failed")
-		if err := b.unmountImg(context.Background()); err != nil {
-			logrus.WithError(err).Error("failed to unmount")
+		logger(ctx).WithError(err).Error("Build failed")
+		// the clean up runs even if the build was canceled, with the build logger and environment
+		ctx := context.WithoutCancel(ctx)
+		if err := b.unmountImg(ctx); err != nil {
+			logger(ctx).WithError(err).Error("failed to unmount")
 		}
-		if err := b.cleanUp(context.Background()); err != nil {
-			logrus.WithError(err).Error("failed to cleanup")
+		if err := b.cleanUp(ctx); err != nil {
+			logger(ctx).WithError(err).Error("failed to cleanup")
 		}
 	}()
 	if err = b.cleanUp(ctx); err != nil {
 		return err
 	}
-	if err = b.makeImg(ctx); err != nil {
-		return err
-	}
-	if err = b.mountImg(ctx); err != nil {
-		return err
-	}
-	if err = b.copyRootFS(ctx); err != nil {
-		return err
-	}
-	if err = b.setupRootFS(ctx); err != nil {
-		return err
-	}
-	if err = b.installBootloader(ctx); err != nil {
-		return err
-	}
-	if err = b.unmountImg(ctx); err != nil {
-		return err
-	}
-	if err = b.convert2Img(ctx); err != nil {
-		return err
+	if b.reproducible.IsEnabled() {
+		ctx = exec.WithEnv(ctx, b.reproducible.env()...)
+	}
+	for _, v := range []struct {
+		phase Phase
+		fn    func(ctx context.Context) error
+	}{
+		{phase: PhaseMakeImg, fn: b.makeImg},
+		{phase: PhaseMount, fn: b.mountImg},
+		{phase: PhaseCopyRootFS, fn: b.copyRootFS},
+		{phase: PhaseSetupRootFS, fn: b.setupRootFS},
+		{phase: PhaseInstallBootloader, fn: func(ctx context.Context) error {
+			if err := b.clampTimestamps(ctx, b.mntPoint); err != nil {
+				return err
+			}
+			if err := b.populateImg(ctx); err != nil {
+				return err
+			}
+			// the root hash is part of the kernel command line
+			if err := b.makeVerity(ctx); err != nil {
+				return err
+			}
+			if err := b.installBootloader(ctx); err != nil {
+				return err
+			}
+			// the mounted bootloader installation writes its files in the boot directory
+			if !b.rootless {
+				if err := b.clampTimestamps(ctx, b.chPath("/boot")); err != nil {
+					return err
+				}
+			}
+			// the live system, the network booted system and the microVM root filesystems are the staged one
+			if err := b.makeLiveRootFS(ctx); err != nil {
+				return err
+			}
+			if err := b.makeNetbootRootFS(ctx); err != nil {
+				return err
+			}
+			return b.makeMicroVMRootFS(ctx)
+		}},
+		{phase: PhaseUnmount, fn: b.unmountImg},
+		{phase: PhaseConvert, fn: b.convert2Img},
+	} {
+		if err = b.progress.phase(v.phase, func() error { return v.fn(ctx) }); err != nil {
+			return err
+		}
+		if err = b.runHooks(ctx, v.phase); err != nil {
+			return err
+		}
 	}
 	if err = b.cleanUp(ctx); err != nil {
 		return err
@@ -275,43 +523,129 @@ func (b *builder) makeImg(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	logrus.Infof("creating raw image")
+	logger(ctx).Infof("creating raw image")
 	if err := block(b.diskRaw, b.size); err != nil {
 		return err
 	}
 
-	var args []string
+	args := []string{"-s", b.diskRaw, "mklabel", b.partitionTable.String()}
+	start := "1Mib"
+	if b.hasBIOSBootPart() {
+		// grub-bios needs a dedicated partition to embed its core image on gpt disks
+		args = append(args, "mkpart", "bios", "1Mib", "2Mib", "set", "1", "bios_grub", "on")
+		start = "2Mib"
+	}
+	end := "100%"
+	if e := b.rootEndMiB(); e != 0 {
+		end = fmt.Sprintf("%dMib", e)
+	}
 	if b.splitBoot {
-		args = []string{"-s", b.diskRaw,
-			"mklabel", "msdos", "mkpart", "primary", "1Mib", fmt.Sprintf("%dMib", b.bootSize),
-			"mkpart", "primary", fmt.Sprintf("%dMib", b.bootSize), "100%",
-			"set", "1", "boot", "on",
-		}
+		args = append(args,
+			"mkpart", b.partName("boot"), start, fmt.Sprintf("%dMib", b.bootSize),
+			"mkpart", b.partName("root"), fmt.Sprintf("%dMib", b.bootSize), end,
+		)
 	} else {
-		args = []string{"-s", b.diskRaw, "mklabel", "msdos", "mkpart", "primary", "1Mib", "100%", "set", "1", "boot", "on"}
+		args = append(args, "mkpart", b.partName("root"), start, end)
+	}
+	for _, v := range b.layoutParts {
+		args = append(args, "mkpart", b.partName(strings.ReplaceAll(strings.TrimPrefix(v.Mount, "/"), "/", "-")), fmt.Sprintf("%dMib", v.start), fmt.Sprintf("%dMib", v.end))
+	}
+	if b.hasVerityPart() {
+		args = append(args, "mkpart", b.partName("verity"), fmt.Sprintf("%dMib", b.verityStart), fmt.Sprintf("%dMib", b.verityEnd))
+	}
+	if b.hasOverlayPart() {
+		args = append(args, "mkpart", b.partName("overlay"), fmt.Sprintf("%dMib", b.overlayStartMiB()), fmt.Sprintf("%dMib", b.overlayStartMiB()+b.overlaySizeMiB()))
+	}
+	if b.hasSwapPart() {
+		args = append(args, "mkpart", b.partName("swap"), "linux-swap", fmt.Sprintf("%dMib", b.swapStartMiB()), "100%")
+	}
+	if b.partitionTable.IsMSDOS() {
+		args = append(args, "set", "1", "boot", "on")
 	}
 
 	if err := exec.Run(ctx, "parted", args...); err != nil {
 		return err
 	}
+	if err := b.seedPartitionTable(ctx); err != nil {
+		return err
+	}
 
-	return nil
+	if !b.partitionTable.IsGPT() {
+		return nil
+	}
+	bootType := gptRootType(b.arch)
+	if b.splitBoot {
+		bootType = ifElse(b.bootFS.IsFat(), gptTypeESP, gptTypeXBOOTLDR)
+	}
+	args = []string{
+		fmt.Sprintf("--typecode=%d:%s", b.bootPartNum(), bootType),
+		// legacy BIOS bootable attribute, required by syslinux's gptmbr.bin to find the boot partition
+		fmt.Sprintf("--attributes=%d:set:2", b.bootPartNum()),
+	}
+	if b.splitBoot {
+		args = append(args, fmt.Sprintf("--typecode=%d:%s", b.rootPartNum(), gptRootType(b.arch)))
+	}
+	if b.hasSwapPart() {
+		args = append(args, fmt.Sprintf("--typecode=%d:%s", b.swapPartNum(), gptTypeSwap))
+	}
+	return exec.Run(ctx, "sgdisk", append(args, b.diskRaw)...)
+}
+
+func (b *builder) hasBIOSBootPart() bool {
+	if !b.partitionTable.IsGPT() {
+		return false
+	}
+	switch b.bootloader.(type) {
+	case grub, grubBios:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *builder) partName(name string) string {
+	if b.partitionTable.IsGPT() {
+		return name
+	}
+	return "primary"
+}
+
+func (b *builder) bootPartNum() int {
+	if b.hasBIOSBootPart() {
+		return 2
+	}
+	return 1
+}
+
+func (b *builder) rootPartNum() int {
+	if b.splitBoot {
+		return b.bootPartNum() + 1
+	}
+	return b.bootPartNum()
+}
+
+func (b *builder) partPath(n int) string {
+	return fmt.Sprintf("/dev/mapper/%sp%d", filepath.Base(b.loDevice), n)
 }
 
 func (b *builder) mountImg(ctx context.Context) error {
-	logrus.Infof("mounting raw image")
-	o, _, err := exec.RunOut(ctx, "losetup", "--show", "-f", b.diskRaw)
-	if err != nil {
+	if b.rootless {
+		return b.prepareRootless(ctx)
+	}
+	logger(ctx).Infof("mounting raw image")
+	if err := b.attachLoopDevice(ctx); err != nil {
 		return err
 	}
-	b.loDevice = strings.TrimSuffix(o, "\n")
-	if err := exec.Run(ctx, "kpartx", "-a", b.loDevice); err != nil {
+	b.bootPart = b.partPath(b.bootPartNum())
+	b.rootPart = b.partPath(b.rootPartNum())
+	if b.hasVerityPart() {
+		b.verityPart = b.partPath(b.verityPartNum())
+	}
+	if err := b.prepareVerity(ctx); err != nil {
 		return err
 	}
-	b.bootPart = fmt.Sprintf("/dev/mapper/%sp1", filepath.Base(b.loDevice))
-	b.rootPart = ifElse(b.splitBoot, fmt.Sprintf("/dev/mapper/%sp2", filepath.Base(b.loDevice)), b.bootPart)
 	if b.isLuksEnabled() {
-		logrus.Infof("encrypting root partition")
+		logger(ctx).Infof("encrypting root partition")
 		f, err := os.CreateTemp("", "key")
 		if err != nil {
 			return err
@@ -322,33 +656,65 @@ func (b *builder) mountImg(ctx context.Context) error {
 			return err
 		}
 		// cryptsetup luksFormat --batch-mode --verify-passphrase --type luks2 $ROOT_DEVICE $KEY_FILE
-		if err := exec.Run(ctx, "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", b.rootPart, f.Name()); err != nil {
+		args := append([]string{"luksFormat", "--batch-mode", "--type", "luks2"}, b.luksOpts.formatArgs()...)
+		if err := exec.Run(ctx, "cryptsetup", append(args, b.rootPart, f.Name())...); err != nil {
 			return err
 		}
-		b.cryptRoot = fmt.Sprintf("d2vm-%s-root", uuid.New().String())
-		// cryptsetup open -d $KEY_FILE $ROOT_DEVICE $ROOT_LABEL
-		if err := exec.Run(ctx, "cryptsetup", "open", "--key-file", f.Name(), b.rootPart, b.cryptRoot); err != nil {
+		b.cryptPart = b.rootPart
+		if err := b.addLuksKeys(ctx, f.Name()); err != nil {
 			return err
 		}
-		b.cryptPart = b.rootPart
-		b.rootPart = "/dev/mapper/root"
-		b.mappedCryptRoot = filepath.Join("/dev/mapper", b.cryptRoot)
-		logrus.Infof("creating raw image file system")
-		if err := exec.Run(ctx, "mkfs.ext4", b.mappedCryptRoot); err != nil {
+		// the mapping name is unique, so that the concurrent builds mappings do not collide
+		b.cryptRoot = fmt.Sprintf("%s%s-root", cryptPrefix, uuid.New().String())
+		if err := b.updateState(func(s *buildState) { s.CryptDevice = b.cryptRoot }); err != nil {
 			return err
 		}
-		if err := exec.Run(ctx, "mount", b.mappedCryptRoot, b.mntPoint); err != nil {
+		// cryptsetup open -d $KEY_FILE $ROOT_DEVICE $ROOT_LABEL
+		if err := exec.Run(ctx, "cryptsetup", "open", "--key-file", f.Name(), b.rootPart, b.cryptRoot); err != nil {
 			return err
 		}
-	} else {
-		logrus.Infof("creating raw image file system")
-		if err := exec.Run(ctx, "mkfs.ext4", b.rootPart); err != nil {
+		b.mappedCryptRoot = filepath.Join("/dev/mapper", b.cryptRoot)
+		if err := b.makeRootFS(ctx, b.mappedCryptRoot); err != nil {
 			return err
 		}
-		if err := exec.Run(ctx, "mount", b.rootPart, b.mntPoint); err != nil {
+	} else if !b.readOnly.SquashFS {
+		if err := b.makeRootFS(ctx, b.rootPart); err != nil {
 			return err
 		}
 	}
+	if err := b.makeOverlay(ctx); err != nil {
+		return err
+	}
+	if err := b.makeSwap(ctx); err != nil {
+		return err
+	}
+	if err := b.mountBoot(ctx); err != nil {
+		return err
+	}
+	// the layout partitions may be mounted in the boot partition
+	return b.mountLayout(ctx)
+}
+
+// loopMu serializes the loop devices allocation of the concurrent builds: two losetup commands may find the same free device.
+var loopMu sync.Mutex
+
+// attachLoopDevice attaches the raw image to a loop device and maps its partitions.
+// The partitions mappings are named after the loop device, e.g. loop0p1, and are unique to the build.
+func (b *builder) attachLoopDevice(ctx context.Context) error {
+	loopMu.Lock()
+	defer loopMu.Unlock()
+	o, _, err := exec.RunOut(ctx, "losetup", "--show", "-f", b.diskRaw)
+	if err != nil {
+		return err
+	}
+	b.loDevice = strings.TrimSuffix(o, "\n")
+	if err := b.updateState(func(s *buildState) { s.LoopDevice = b.loDevice }); err != nil {
+		return err
+	}
+	return exec.Run(ctx, "kpartx", "-a", b.loDevice)
+}
+
+func (b *builder) mountBoot(ctx context.Context) (err error) {
 	if !b.splitBoot {
 		return nil
 	}
@@ -356,39 +722,101 @@ func (b *builder) mountImg(ctx context.Context) error {
 		return err
 	}
 	if b.bootFS.IsFat() {
-		err = exec.Run(ctx, "mkfs.fat", "-F32", b.bootPart)
+		err = exec.Run(ctx, "mkfs.fat", append(append([]string{"-F32"}, b.mkfsIDArgs(BootFSFat32.String(), "boot")...), b.bootPart)...)
 	} else {
-		err = exec.Run(ctx, "mkfs.ext4", b.bootPart)
+		err = exec.Run(ctx, "mkfs.ext4", append(b.mkfsIDArgs(RootFSExt4.String(), "boot"), b.bootPart)...)
 	}
 	if err != nil {
 		return err
 	}
-	if err := exec.Run(ctx, "mount", b.bootPart, filepath.Join(b.mntPoint, "boot")); err != nil {
+	return exec.Run(ctx, "mount", b.bootPart, filepath.Join(b.mntPoint, "boot"))
+}
+
+func (b *builder) makeRootFS(ctx context.Context, dev string) error {
+	logger(ctx).Infof("creating raw image file system")
+	args := append(b.rootFSOpts.args(b.rootFS), b.mkfsIDArgs(b.rootFS.String(), "root")...)
+	args = append(args, dev)
+	if b.verity.IsAppended() {
+		// the end of the root partition is kept for the hash tree
+		args = append(args, fmt.Sprintf("%dk", verityDataSize(b.rootPartSize)/1024))
+	}
+	if err := exec.Run(ctx, b.rootFS.mkfs(), args...); err != nil {
+		return err
+	}
+	if err := exec.Run(ctx, "mount", dev, b.mntPoint); err != nil {
 		return err
 	}
+	if !b.rootFS.IsBtrfs() {
+		return nil
+	}
+	logger(ctx).Infof("creating btrfs subvolumes")
+	for _, v := range btrfsSubvolumes {
+		if err := exec.Run(ctx, "btrfs", "subvolume", "create", filepath.Join(b.mntPoint, v.name)); err != nil {
+			return err
+		}
+	}
+	if err := exec.Run(ctx, "umount", b.mntPoint); err != nil {
+		return err
+	}
+	for _, v := range btrfsSubvolumes {
+		p := filepath.Join(b.mntPoint, v.path)
+		if err := os.MkdirAll(p, os.ModePerm); err != nil {
+			return err
+		}
+		if err := exec.Run(ctx, "mount", "-o", "subvol="+v.name, dev, p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (b *builder) unmountImg(ctx context.Context) error {
-	logrus.Infof("unmounting raw image")
-	var merr error
+	if b.rootless {
+		return b.cleanUpRootless(ctx)
+	}
+	logger(ctx).Infof("unmounting raw image")
+	merr := b.unmountLayout(ctx)
 	if b.splitBoot {
 		merr = multierr.Append(merr, exec.Run(ctx, "umount", filepath.Join(b.mntPoint, "boot")))
 	}
-	merr = multierr.Append(merr, exec.Run(ctx, "umount", b.mntPoint))
+	if b.rootFS.IsBtrfs() {
+		// the root subvolume is unmounted last
+		for i := len(btrfsSubvolumes) - 1; i > 0; i-- {
+			merr = multierr.Append(merr, exec.Run(ctx, "umount", filepath.Join(b.mntPoint, btrfsSubvolumes[i].path)))
+		}
+	}
+	if !b.readOnly.SquashFS {
+		merr = multierr.Append(merr, exec.Run(ctx, "umount", b.mntPoint))
+	} else if merr == nil {
+		// the squashfs root is staged in the mount point directory, which is emptied once nothing is mounted in it
+		merr = multierr.Combine(os.RemoveAll(b.mntPoint), os.MkdirAll(b.mntPoint, os.ModePerm))
+	}
 	if b.isLuksEnabled() {
 		merr = multierr.Append(merr, exec.Run(ctx, "cryptsetup", "close", b.mappedCryptRoot))
 	}
-	return multierr.Combine(
+	merr = multierr.Combine(
 		merr,
 		exec.Run(ctx, "kpartx", "-d", b.loDevice),
 		exec.Run(ctx, "losetup", "-d", b.loDevice),
 	)
+	if merr != nil {
+		return merr
+	}
+	// the released devices may be reused by other builds
+	return b.updateState(func(s *buildState) { s.LoopDevice, s.CryptDevice = "", "" })
+}
+
+// updateState updates the build state record, written in the work directory.
+func (b *builder) updateState(fn func(s *buildState)) error {
+	return updateBuildState(filepath.Dir(b.mntPoint), fn)
 }
 
 func (b *builder) copyRootFS(ctx context.Context) error {
-	logrus.Infof("copying rootfs to raw image")
-	if err := b.img.Flatten(ctx, b.mntPoint); err != nil {
+	if b.rootless {
+		return b.copyRootFSRootless(ctx)
+	}
+	logger(ctx).Infof("copying rootfs to raw image")
+	if err := b.img.Flatten(ctx, b.mntPoint, b.progress); err != nil {
 		return err
 	}
 	return nil
@@ -403,31 +831,43 @@ func diskUUID(ctx context.Context, disk string) (string, error) {
 }
 
 func (b *builder) setupRootFS(ctx context.Context) (err error) {
-	logrus.Infof("setting up rootfs")
-	b.rootUUID, err = diskUUID(ctx, ifElse(b.isLuksEnabled(), b.mappedCryptRoot, b.rootPart))
-	if err != nil {
+	logger(ctx).Infof("setting up rootfs")
+	if err := b.resolveUUIDs(ctx); err != nil {
 		return err
 	}
-	var fstab string
+	fstab := b.rootFstab()
 	if b.splitBoot {
-		b.bootUUID, err = diskUUID(ctx, b.bootPart)
-		if err != nil {
-			return err
-		}
-		if b.isLuksEnabled() {
-			b.cryptUUID, err = diskUUID(ctx, b.cryptPart)
-			if err != nil {
-				return err
-			}
-		}
-		fstab = fmt.Sprintf("UUID=%s / ext4 errors=remount-ro 0 1\nUUID=%s /boot %s errors=remount-ro 0 2\n", b.rootUUID, b.bootUUID, b.bootFS.linux())
+		fstab += fmt.Sprintf("UUID=%s /boot %s errors=remount-ro 0 2\n", b.bootUUID, b.bootFS.linux())
 	} else {
 		b.bootUUID = b.rootUUID
-		fstab = fmt.Sprintf("UUID=%s / ext4 errors=remount-ro 0 1\n", b.bootUUID)
 	}
+	if err := b.makeSwapFile(ctx); err != nil {
+		return err
+	}
+	fstab += b.layoutFstab()
+	fstab += b.swapFstab()
 	if err := b.chWriteFile("/etc/fstab", fstab, perm); err != nil {
 		return err
 	}
+	if b.isLuksEnabled() {
+		crypttab, err := os.ReadFile(b.chPath("/etc/crypttab"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// alpine does not use the crypttab: the root partition is only opened by the initramfs
+		if b.osRelease.ID != ReleaseAlpine {
+			crypttab = append(crypttab, b.luksCrypttab()...)
+		}
+		if b.hasSwapPart() {
+			crypttab = append(crypttab, b.swapCrypttab()...)
+		}
+		if err := b.chWriteFile("/etc/crypttab", string(crypttab), 0600); err != nil {
+			return err
+		}
+		if err := b.installLuksKey(); err != nil {
+			return err
+		}
+	}
 	if err := b.chWriteFile("/etc/resolv.conf", b.resolvConf(), 0644); err != nil {
 		return err
 	}
@@ -464,34 +904,220 @@ func (b *builder) setupRootFS(ctx context.Context) (err error) {
 	}
 }
 
+func (b *builder) rootFstab() string {
+	// the read-only root is mounted by the initramfs as the overlay lower layer: it has no fstab entry
+	ro := b.readOnly.IsEnabled()
+	switch {
+	case b.rootFS.IsBtrfs():
+		var sb strings.Builder
+		for _, v := range btrfsSubvolumes {
+			if ro && v.path == "/" {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("UUID=%s %s btrfs %s 0 0\n", b.rootUUID, v.path, strings.TrimSuffix("subvol="+v.name+","+b.rootMountOptions(""), ",")))
+		}
+		return sb.String()
+	case ro:
+		return ""
+	case b.rootFS.IsXFS():
+		return fmt.Sprintf("UUID=%s / xfs %s 0 0\n", b.rootUUID, b.rootMountOptions("defaults"))
+	default:
+		return fmt.Sprintf("UUID=%s / ext4 %s 0 1\n", b.rootUUID, b.rootMountOptions("errors=remount-ro"))
+	}
+}
+
+// rootMountOptions returns the root filesystem mount options set in the layout, or def.
+func (b *builder) rootMountOptions(def string) string {
+	if p, ok := b.layout.partition("/"); ok && p.Options != "" {
+		return p.Options
+	}
+	return def
+}
+
+func (b *builder) resolveUUIDs(ctx context.Context) (err error) {
+	// the rootless build chooses the filesystems UUIDs before creating them
+	if b.rootless {
+		return nil
+	}
+	if b.readOnly.SquashFS {
+		// the squashfs image is only written to the root partition once the rootfs is set up
+		b.rootPartUUID, err = b.partUUID(ctx, b.rootPartNum())
+	} else {
+		b.rootUUID, err = diskUUID(ctx, b.rootDev())
+	}
+	if err != nil {
+		return err
+	}
+	if b.hasOverlayPart() {
+		b.overlayUUID, err = diskUUID(ctx, b.overlayPart)
+		if err != nil {
+			return err
+		}
+	}
+	if b.hasSwapPart() && !b.isLuksEnabled() {
+		b.swapUUID, err = diskUUID(ctx, b.swapPart)
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.resolveLayoutUUIDs(ctx); err != nil {
+		return err
+	}
+	if !b.splitBoot {
+		return nil
+	}
+	b.bootUUID, err = diskUUID(ctx, b.bootPart)
+	if err != nil {
+		return err
+	}
+	if b.isLuksEnabled() {
+		b.cryptUUID, err = diskUUID(ctx, b.cryptPart)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builder) populateImg(ctx context.Context) error {
+	// the mounted build writes the rootfs directly to the partitions, but the squashfs root
+	if !b.rootless {
+		return b.makeSquashFS(ctx)
+	}
+	return b.populateImgRootless(ctx)
+}
+
 func (b *builder) cmdline(_ context.Context) string {
+	extra := b.cmdLineExtra
+	if b.rootFS.IsBtrfs() {
+		extra = strings.TrimSpace("rootflags=subvol=" + btrfsSubvolumes[0].name + " " + extra)
+	}
+	if r := b.resumeCmdline(); r != "" {
+		extra = strings.TrimSpace(r + " " + extra)
+	}
+	if o := b.overlayCmdline(); o != "" {
+		extra = strings.TrimSpace(o + " " + extra)
+	}
+	if b.verity.IsEnabled() {
+		return b.config.Cmdline(RootPath("/dev/mapper/"+verityName), b.verityCmdline(), extra)
+	}
+	if b.readOnly.SquashFS {
+		return b.config.Cmdline(RootPartUUID(b.rootPartUUID), extra)
+	}
 	if !b.isLuksEnabled() {
-		return b.config.Cmdline(RootUUID(b.rootUUID), b.cmdLineExtra)
+		return b.config.Cmdline(RootUUID(b.rootUUID), extra)
 	}
 	switch b.osRelease.ID {
 	case ReleaseAlpine:
-		return b.config.Cmdline(RootUUID(b.rootUUID), "root=/dev/mapper/root", "cryptdm=root", "cryptroot=UUID="+b.cryptUUID, b.cmdLineExtra)
+		return b.config.Cmdline(RootUUID(b.rootUUID), "root=/dev/mapper/root", "cryptdm=root", "cryptroot=UUID="+b.cryptUUID, ifElse(b.luksOpts.Unlock.IsInitramfs(), "cryptkey", ""), extra)
 	case ReleaseCentOS, ReleaseRocky, ReleaseAlmaLinux:
-		return b.config.Cmdline(RootUUID(b.rootUUID), "rd.luks.name=UUID="+b.rootUUID+" rd.luks.uuid="+b.cryptUUID+" rd.luks.crypttab=0", b.cmdLineExtra)
+		return b.config.Cmdline(RootUUID(b.rootUUID), "rd.luks.name=UUID="+b.rootUUID+" rd.luks.uuid="+b.cryptUUID+" rd.luks.crypttab=0", b.luksKeyCmdline(), extra)
 	default:
 		// for some versions of debian, the cryptopts parameter MUST contain all the following: target,source,key,opts...
 		// see https://salsa.debian.org/cryptsetup-team/cryptsetup/-/blob/debian/buster/debian/functions
 		// and https://cryptsetup-team.pages.debian.net/cryptsetup/README.initramfs.html
-		return b.config.Cmdline(nil, "root=/dev/mapper/root", "cryptopts=target=root,source=UUID="+b.cryptUUID+",key=none,luks", b.cmdLineExtra)
+		return b.config.Cmdline(nil, "root=/dev/mapper/root", "cryptopts=target=root,source=UUID="+b.cryptUUID+","+b.luksCryptopts()+",luks", extra)
 	}
 }
 
 func (b *builder) installBootloader(ctx context.Context) error {
-	logrus.Infof("installing bootloader")
-	return b.bootloader.Setup(ctx, b.loDevice, b.mntPoint, b.cmdline(ctx))
+	if b.rootless {
+		return b.installBootloaderRootless(ctx)
+	}
+	logger(ctx).Infof("installing bootloader")
+	clean, err := b.mountVerityBootloaderConfig(ctx)
+	if err != nil {
+		return err
+	}
+	return multierr.Combine(b.bootloader.Setup(ctx, b.loDevice, b.mntPoint, b.cmdline(ctx)), clean())
 }
 
 func (b *builder) convert2Img(ctx context.Context) error {
-	logrus.Infof("converting to %s", b.format)
-	if b.format == "raw" {
-		return MoveFile(b.diskRaw, b.diskOut)
+	switch {
+	case b.outputKind.IsNetboot():
+		return b.makeNetboot(ctx)
+	case b.outputKind.IsMicroVM():
+		return b.makeMicroVM(ctx)
+	}
+	// the conversions run in parallel: their progress events must not be emitted concurrently
+	progress := b.progress.synchronized()
+	g, gctx := errgroup.WithContext(ctx)
+	raw := false
+	for _, f := range b.formats {
+		if f == "raw" {
+			raw = true
+			continue
+		}
+		f := f
+		g.Go(func() error {
+			if c, ok := compressedRaw(f); ok {
+				logger(ctx).Infof("compressing raw image with %s", c.Command())
+				return compress.Compress(gctx, c, b.diskRaw, b.outPath(f))
+			}
+			switch f {
+			case "ova":
+				logger(ctx).Infof("creating ova appliance")
+				return b.makeOVA(gctx, progress.withFormat(f), b.outPath(f))
+			case "ovf":
+				logger(ctx).Infof("creating ovf appliance")
+				return b.makeOVF(gctx, progress.withFormat(f), b.outPath(f))
+			case "box":
+				logger(ctx).Infof("creating vagrant box")
+				return b.makeBox(gctx, progress.withFormat(f), b.outPath(f))
+			case isoFormat:
+				return b.makeISO(gctx, b.outPath(f))
+			case azureFormat:
+				logger(ctx).Infof("converting to azure fixed vhd")
+				return qemuImgConvert(gctx, progress.withFormat(f), append(azureQemuImgArgs(), b.diskRaw, b.outPath(f))...)
+			}
+			logger(ctx).Infof("converting to %s", f)
+			args := []string{"-O", qemuImgFormat(f)}
+			if f == "qcow2" {
+				args = append(args, b.qcow2Compression.qemuImgArgs()...)
+			}
+			return qemuImgConvert(gctx, progress.withFormat(f), append(args, b.diskRaw, b.outPath(f))...)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	// the raw disk image is only moved once converted to the other formats
+	if !raw {
+		return nil
 	}
-	return exec.Run(ctx, "qemu-img", "convert", b.diskRaw, "-O", b.format, b.diskOut)
+	logger(ctx).Infof("converting to raw")
+	return MoveFile(b.diskRaw, b.outPath("raw"))
+}
+
+// outPath returns the path of the disk image converted to format.
+func (b *builder) outPath(format string) string {
+	return b.diskOut + "." + format
+}
+
+func (b *builder) hasFormat(format string) bool {
+	for _, v := range b.formats {
+		if v == format {
+			return true
+		}
+	}
+	return false
+}
+
+func validateFormat(format string) error {
+	for _, v := range formats {
+		if v == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid format: %s valid formats are: %s", format, strings.Join(formats, " "))
+}
+
+// qemuImgFormat returns the qemu-img name of the disk image format.
+func qemuImgFormat(format string) string {
+	if format == "vhd" {
+		return "vpc"
+	}
+	return format
 }
 
 func (b *builder) chWriteFile(path string, content string, perm os.FileMode) error {
@@ -509,6 +1135,14 @@ func (b *builder) chPath(path string) string {
 	return fmt.Sprintf("%s%s", b.mntPoint, path)
 }
 
+// rootDev returns the host device holding the root filesystem: the opened encrypted root partition, or the root partition.
+func (b *builder) rootDev() string {
+	if b.isLuksEnabled() {
+		return b.mappedCryptRoot
+	}
+	return b.rootPart
+}
+
 func (b *builder) isLuksEnabled() bool {
 	return b.luksPassword != ""
 }
@@ -543,9 +1177,62 @@ func block(path string, size uint64) error {
 
 func (b *builder) checkDependencies() error {
 	var merr error
-	deps := []string{"mount", "blkid", "tar", "losetup", "parted", "kpartx", "qemu-img", "dd", "mkfs.ext4", "cryptsetup"}
-	if _, ok := b.bootloader.(*syslinux); ok {
-		deps = append(deps, "extlinux")
+	var deps []string
+	if b.rootless {
+		deps = []string{"fakeroot", "blkid", "tar", "chmod", "parted", "qemu-img", "dd", "mkfs.ext4", "mkfs.fat", "mcopy"}
+		if _, ok := b.bootloader.(*syslinux); ok {
+			deps = append(deps, "syslinux")
+		}
+	} else {
+		deps = []string{"mount", "blkid", "losetup", "parted", "kpartx", "qemu-img", "dd", "mkfs.ext4", "cryptsetup"}
+		if _, ok := b.bootloader.(*syslinux); ok {
+			deps = append(deps, "extlinux")
+		}
+	}
+	if b.partitionTable.IsGPT() {
+		deps = append(deps, "sgdisk")
+	}
+	if !b.rootFS.IsExt() {
+		deps = append(deps, b.rootFS.mkfs())
+	}
+	if b.rootFS.IsBtrfs() {
+		deps = append(deps, "btrfs")
+	}
+	for _, v := range b.layout.mounts() {
+		p, _ := b.layout.partition(v)
+		deps = append(deps, ifElse(p.isFat(), "mkfs.fat", RootFS(p.fs()).mkfs()))
+	}
+	if b.hasSwap() {
+		deps = append(deps, "mkswap")
+	}
+	if b.hasSwapFile() {
+		deps = append(deps, ifElse(b.rootFS.IsBtrfs(), "chattr", "filefrag"))
+	}
+	if b.readOnly.SquashFS {
+		deps = append(deps, "mksquashfs")
+	}
+	if b.hasFormat(isoFormat) {
+		deps = append(deps, "mksquashfs", "xorriso", "grub-mkstandalone", "mkfs.fat", "mmd", "mcopy")
+	}
+	if b.outputKind.IsNetboot() {
+		deps = append(deps, ifElse(b.netboot.Root.IsNFS(), "tar", "mksquashfs"))
+	}
+	if b.outputKind.IsMicroVM() {
+		deps = append(deps, "mkfs.ext4")
+	}
+	if b.verity.IsEnabled() {
+		deps = append(deps, "veritysetup")
+	}
+	for _, v := range b.formats {
+		if c, ok := compressedRaw(v); ok {
+			deps = append(deps, c.Command())
+		}
+	}
+	if b.reproducible.IsEnabled() {
+		deps = append(deps, "find", "touch")
+		if b.partitionTable.IsMSDOS() {
+			deps = append(deps, "sfdisk")
+		}
 	}
 	for _, v := range deps {
 		if _, err := exec2.LookPath(v); err != nil {
@@ -559,7 +1246,7 @@ func OutputFormats() []string {
 	return formats[:]
 }
 
-func ifElse(v bool, t string, f string) string {
+func ifElse[T any](v bool, t T, f T) T {
 	if v {
 		return t
 	}
@@ -21,8 +21,6 @@ import (
 	"runtime"
 	"strings"
 
-	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"go.linka.cloud/d2vm"
@@ -31,15 +29,20 @@ import (
 
 var (
 	file      = "Dockerfile"
-	tag       = "d2vm-" + uuid.New().String()
 	buildArgs []string
 	buildCmd  = &cobra.Command{
 		Use:   "build [context directory]",
 		Short: "Build a vm image from Dockerfile",
-		Args:  cobra.ExactArgs(1),
+		Args:  configArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if configFile != "" {
+				return runConfig(cmd, args)
+			}
 			// TODO(adphi): resolve context path
-			if runtime.GOOS != "linux" || !isRoot() {
+			if runtime.GOOS != "linux" || (!isRoot() && !rootless) {
+				if isBlockDevice(output) {
+					return errBlockDeviceOutput
+				}
 				ctxAbsPath, err := filepath.Abs(args[0])
 				if err != nil {
 					return err
@@ -77,52 +80,26 @@ var (
 						dargs[i] = "/in"
 					}
 				}
+				if err := inlineLayout(dargs); err != nil {
+					return err
+				}
+				if err := mountLuksKeyFile(dargs, out); err != nil {
+					return err
+				}
 				return docker.RunD2VM(cmd.Context(), d2vm.Image, d2vm.Version, in, out, cmd.Name(), os.Args[2:]...)
 			}
-			if err := validateFlags(); err != nil {
+			if err := validateFlags(cmd.Context()); err != nil {
 				return err
 			}
-			size, err := parseSize(size)
+			t, err := flagsTarget(cmd.Flags())
 			if err != nil {
 				return err
 			}
-			if file == "" {
-				file = filepath.Join(args[0], "Dockerfile")
-			}
-			logrus.Infof("building docker image from %s", file)
-			if err := docker.Build(cmd.Context(), pull, tag, file, args[0], platform, buildArgs...); err != nil {
-				return err
-			}
-			if err := d2vm.Convert(
-				cmd.Context(),
-				tag,
-				d2vm.WithSize(size),
-				d2vm.WithPassword(password),
-				d2vm.WithOutput(output),
-				d2vm.WithCmdLineExtra(cmdLineExtra),
-				d2vm.WithNetworkManager(d2vm.NetworkManager(networkManager)),
-				d2vm.WithBootLoader(bootloader),
-				d2vm.WithRaw(raw),
-				d2vm.WithSplitBoot(splitBoot),
-				d2vm.WithBootSize(bootSize),
-				d2vm.WithBootFS(d2vm.BootFS(bootFS)),
-				d2vm.WithLuksPassword(luksPassword),
-				d2vm.WithKeepCache(keepCache),
-				d2vm.WithPlatform(platform),
-				d2vm.WithPull(false),
-				d2vm.WithHostname(hostname),
-				d2vm.WithDNS(dns),
-				d2vm.WithDNSSearch(dnsSearch),
-				d2vm.WithExtraHosts(extraHosts),
-			); err != nil {
+			t.Context = args[0]
+			if err := convertTarget(cmd, t); err != nil {
 				return err
 			}
-			if uid, ok := sudoUser(); ok {
-				if err := os.Chown(output, uid, uid); err != nil {
-					return err
-				}
-			}
-			return maybeMakeContainerDisk(cmd.Context())
+			return maybeFlash(cmd.Context())
 		},
 	}
 )
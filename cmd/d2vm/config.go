@@ -0,0 +1,228 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"go.linka.cloud/d2vm"
+	"go.linka.cloud/d2vm/pkg/docker"
+)
+
+var (
+	configFile string
+
+	schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the " + d2vm.BuildFileName + " build file JSON schema",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(d2vm.BuildFileSchema())
+		},
+	}
+)
+
+// configArgs accepts the targets names when a build file is used, and exactly n arguments otherwise.
+func configArgs(n int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if configFile != "" {
+			return nil
+		}
+		return cobra.ExactArgs(n)(cmd, args)
+	}
+}
+
+// runConfig converts the build file targets, all of them if none is given.
+// The command line flags take precedence over the build file settings.
+func runConfig(cmd *cobra.Command, names []string) error {
+	f, err := d2vm.LoadBuildFile(configFile)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		names = f.TargetNames()
+	}
+	targets := make([]d2vm.Target, len(names))
+	privileged := false
+	for i, name := range names {
+		t, err := f.Resolve(name)
+		if err != nil {
+			return err
+		}
+		if err := mergeFlags(cmd.Flags(), &t); err != nil {
+			return fmt.Errorf("%s: %s: %w", configFile, targetName(name), err)
+		}
+		if cmd.Name() == "convert" && t.Image == "" {
+			return fmt.Errorf("%s: %s: image is required", configFile, targetName(name))
+		}
+		targets[i] = t
+		privileged = privileged || !t.Rootless
+	}
+	if runtime.GOOS != "linux" || (!isRoot() && privileged) {
+		return runConfigD2VM(cmd, f.Dir())
+	}
+	for i, name := range names {
+		if name != "" {
+			logrus.Infof("converting target %s", name)
+		}
+		if err := convertTarget(cmd, targets[i]); err != nil {
+			return fmt.Errorf("%s: %w", targetName(name), err)
+		}
+	}
+	return nil
+}
+
+func targetName(name string) string {
+	if name == "" {
+		return "default target"
+	}
+	return fmt.Sprintf("target %q", name)
+}
+
+// convertTarget builds the target docker image with the build command, pulls it with the convert command,
+// and converts it with the options built from the target spec.
+func convertTarget(cmd *cobra.Command, t d2vm.Target) error {
+	opts, err := t.Options()
+	if err != nil {
+		return err
+	}
+	if t.Output == "" {
+		t.Output = output
+		opts = append(opts, d2vm.WithOutput(output))
+	}
+	if isBlockDevice(t.Output) {
+		return fmt.Errorf("block device output is not supported with a build file, write the image with d2vm flash")
+	}
+	paths := specOutputPaths(t.ConvertSpec)
+	if err := validateOutputs(paths); err != nil {
+		return err
+	}
+	if err := validateContainerDisk(t.OutputKind, paths[0]); err != nil {
+		return err
+	}
+	if err := validateProgress(); err != nil {
+		return err
+	}
+	platform := t.WithDefaults().Platform
+	img := t.Image
+	if cmd.Name() == "build" {
+		img = "d2vm-" + uuid.New().String()
+		file := t.File
+		if file == "" {
+			file = filepath.Join(t.Context, "Dockerfile")
+		}
+		logrus.Infof("building docker image from %s", file)
+		if err := docker.Build(cmd.Context(), t.Pull, img, file, t.Context, platform, t.BuildArgs...); err != nil {
+			return err
+		}
+		opts = append(opts, d2vm.WithPull(false))
+	} else if err := pullImage(cmd.Context(), img, platform, t.Pull); err != nil {
+		return err
+	}
+	if err := d2vm.Convert(cmd.Context(), img, append(opts, progressOption())...); err != nil {
+		return err
+	}
+	if err := chownOutputs(paths); err != nil {
+		return err
+	}
+	return maybeMakeContainerDisk(cmd.Context(), paths[0], platform)
+}
+
+// mergeFlags overrides the target settings with the flags set on the command line.
+// The flags are decoded as the build file keys they are named after, the other ones are ignored.
+func mergeFlags(flags *pflag.FlagSet, t *d2vm.Target) error {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	var err error
+	flags.Visit(func(f *pflag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		var v *yaml.Node
+		if v, err = flagNode(f); err != nil {
+			err = fmt.Errorf("--%s: %w", f.Name, err)
+			return
+		}
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, v)
+	})
+	if err != nil {
+		return err
+	}
+	return n.Decode(t)
+}
+
+// flagNode returns the flag value as its build file key value.
+func flagNode(f *pflag.Flag) (*yaml.Node, error) {
+	switch f.Name {
+	case "add-host":
+		hosts, err := validateHosts(f.Value.(pflag.SliceValue).GetSlice()...)
+		if err != nil {
+			return nil, err
+		}
+		n := &yaml.Node{}
+		return n, n.Encode(hosts)
+	case "layout":
+		l, err := parseLayout(f.Value.String())
+		if err != nil {
+			return nil, err
+		}
+		n := &yaml.Node{}
+		return n, n.Encode(l)
+	}
+	// the strings are tagged so that their values are never decoded as other types
+	if s, ok := f.Value.(pflag.SliceValue); ok {
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, v := range s.GetSlice() {
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v})
+		}
+		return n, nil
+	}
+	n := &yaml.Node{Kind: yaml.ScalarNode, Value: f.Value.String()}
+	if f.Value.Type() == "string" {
+		n.Tag = "!!str"
+	}
+	return n, nil
+}
+
+// runConfigD2VM runs the command with the build file in the d2vm container, with the build file directory
+// mounted as the input and output directories: the build file paths must be relative to its directory.
+func runConfigD2VM(cmd *cobra.Command, dir string) error {
+	p := filepath.Join("/in", filepath.Base(configFile))
+	args := os.Args[2:]
+	for i, v := range args {
+		switch {
+		case v == "--config="+configFile || v == "-c="+configFile:
+			args[i] = "--config=" + p
+		case v == configFile && i > 0 && (args[i-1] == "--config" || args[i-1] == "-c"):
+			args[i] = p
+		}
+	}
+	return docker.RunD2VM(cmd.Context(), d2vm.Image, d2vm.Version, dir, dir, cmd.Name(), args...)
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
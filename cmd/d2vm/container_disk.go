@@ -17,19 +17,40 @@ package main
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 
 	"go.linka.cloud/d2vm"
+	"go.linka.cloud/d2vm/pkg/compress"
 	"go.linka.cloud/d2vm/pkg/docker"
 )
 
-func maybeMakeContainerDisk(ctx context.Context) error {
+// validateContainerDisk checks the container disk image can be made from the conversion first output path.
+func validateContainerDisk(kind d2vm.OutputKind, path string) error {
+	if containerDiskTag == "" {
+		return nil
+	}
+	if !kind.IsDisk() {
+		return fmt.Errorf("container disk image requires a disk image, not %s artifacts", kind)
+	}
+	if _, ok := compress.FromPath(path); ok {
+		return fmt.Errorf("container disk image requires an uncompressed image: set it first in --formats")
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".ova" || ext == ".ovf" || ext == ".box" {
+		return fmt.Errorf("container disk image requires a disk image, not an appliance: set it first in --formats")
+	}
+	return nil
+}
+
+// maybeMakeContainerDisk makes the container disk image holding the disk image path, the first output format image.
+func maybeMakeContainerDisk(ctx context.Context, path, platform string) error {
 	if containerDiskTag == "" {
 		return nil
 	}
 	logrus.Infof("creating container disk image %s", containerDiskTag)
-	if err := d2vm.MakeContainerDisk(ctx, output, containerDiskTag, platform); err != nil {
+	if err := d2vm.MakeContainerDisk(ctx, path, containerDiskTag, platform); err != nil {
 		return err
 	}
 	if !push {
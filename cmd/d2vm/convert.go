@@ -15,11 +15,11 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"runtime"
 
-	"github.com/c2h5oh/datasize"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
@@ -31,10 +31,16 @@ var (
 	convertCmd = &cobra.Command{
 		Use:          "convert [docker image]",
 		Short:        "Convert Docker image to vm image",
-		Args:         cobra.ExactArgs(1),
+		Args:         configArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if runtime.GOOS != "linux" || !isRoot() {
+			if configFile != "" {
+				return runConfig(cmd, args)
+			}
+			if runtime.GOOS != "linux" || (!isRoot() && !rootless) {
+				if isBlockDevice(output) {
+					return errBlockDeviceOutput
+				}
 				abs, err := filepath.Abs(output)
 				if err != nil {
 					return err
@@ -47,74 +53,44 @@ var (
 						break
 					}
 				}
+				if err := inlineLayout(dargs); err != nil {
+					return err
+				}
+				if err := mountLuksKeyFile(dargs, out); err != nil {
+					return err
+				}
 				return docker.RunD2VM(cmd.Context(), d2vm.Image, d2vm.Version, out, out, cmd.Name(), dargs...)
 			}
-			if err := validateFlags(); err != nil {
+			if err := validateFlags(cmd.Context()); err != nil {
 				return err
 			}
-			size, err := parseSize(size)
+			t, err := flagsTarget(cmd.Flags())
 			if err != nil {
 				return err
 			}
-			img := args[0]
-			found := false
-			if !pull {
-				imgs, err := docker.ImageList(cmd.Context(), img)
-				if err != nil {
-					return err
-				}
-				found = len(imgs) == 1 && imgs[0] == img
-				if found {
-					logrus.Infof("using local image %s", img)
-				}
-			}
-			if pull || !found {
-				logrus.Infof("pulling image %s", img)
-				if err := docker.Pull(cmd.Context(), platform, img); err != nil {
-					return err
-				}
-			}
-			if err := d2vm.Convert(
-				cmd.Context(),
-				img,
-				d2vm.WithSize(size),
-				d2vm.WithPassword(password),
-				d2vm.WithOutput(output),
-				d2vm.WithCmdLineExtra(cmdLineExtra),
-				d2vm.WithNetworkManager(d2vm.NetworkManager(networkManager)),
-				d2vm.WithBootLoader(bootloader),
-				d2vm.WithRaw(raw),
-				d2vm.WithSplitBoot(splitBoot),
-				d2vm.WithBootSize(bootSize),
-				d2vm.WithBootFS(d2vm.BootFS(bootFS)),
-				d2vm.WithLuksPassword(luksPassword),
-				d2vm.WithKeepCache(keepCache),
-				d2vm.WithPlatform(platform),
-				d2vm.WithPull(pull),
-				d2vm.WithHostname(hostname),
-				d2vm.WithDNS(dns),
-				d2vm.WithDNSSearch(dnsSearch),
-				d2vm.WithExtraHosts(extraHosts),
-			); err != nil {
+			t.Image = args[0]
+			if err := convertTarget(cmd, t); err != nil {
 				return err
 			}
-			// set user permissions on the output file if the command was run with sudo
-			if uid, ok := sudoUser(); ok {
-				if err := os.Chown(output, uid, uid); err != nil {
-					return err
-				}
-			}
-			return maybeMakeContainerDisk(cmd.Context())
+			return maybeFlash(cmd.Context())
 		},
 	}
 )
 
-func parseSize(s string) (uint64, error) {
-	var v datasize.ByteSize
-	if err := v.UnmarshalText([]byte(s)); err != nil {
-		return 0, err
+// pullImage pulls the image if it is not available locally, or always with pull.
+func pullImage(ctx context.Context, img, platform string, pull bool) error {
+	if !pull {
+		imgs, err := docker.ImageList(ctx, img)
+		if err != nil {
+			return err
+		}
+		if len(imgs) == 1 && imgs[0] == img {
+			logrus.Infof("using local image %s", img)
+			return nil
+		}
 	}
-	return uint64(v), nil
+	logrus.Infof("pulling image %s", img)
+	return docker.Pull(ctx, platform, img)
 }
 
 func init() {
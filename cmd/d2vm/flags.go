@@ -15,11 +15,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 
 	"go.linka.cloud/d2vm"
@@ -30,6 +32,15 @@ var (
 	size             = "1G"
 	password         = ""
 	force            = false
+	formats          []string
+	outputKind       string
+	netbootRoot      string
+	netbootURL       string
+	qcow2Compression string
+	applianceCPUs    uint
+	applianceMemory  uint64
+	applianceNIC     string
+	vagrantProvider  string
 	raw              bool
 	pull             = false
 	cmdLineExtra     = ""
@@ -40,80 +51,78 @@ var (
 	splitBoot        bool
 	bootSize         uint64
 	bootFS           string
+	partitionTable   string
+	rootFS           string
+	rootFSLabel      string
+	rootFSInodeRatio uint64
+	rootFSReserved   float64
+	rootFSFeatures   []string
+	swapSize         string
+	swapType         string
+	layout           string
+	readOnly         bool
+	overlay          string
+	overlaySize      string
+	squashFS         bool
+	verity           string
 	luksPassword     string
+	luksRecovery     string
+	luksKeyFile      string
+	luksUnlock       string
+	luksCipher       string
+	luksKeySize      int
+	luksPBKDF        string
+	luksPBKDFMemory  uint64
+	luksIterTime     uint64
+	rootless         bool
+	reproducible     bool
 
 	keepCache bool
 	platform  string
+	progress  string
 
 	hostname  string
 	dns       []string
 	dnsSearch []string
 	hosts     []string
-
-	extraHosts map[string]string
 )
 
-func validateFlags() (err error) {
-	switch platform {
-	case "linux/amd64":
-		if bootloader == "" {
-			bootloader = "syslinux"
-		}
-	case "linux/arm64", "linux/aarch64":
-		platform = "linux/arm64"
-		if bootloader == "" {
-			bootloader = "grub-efi"
-		}
-		if bootloader != "grub-efi" {
-			return fmt.Errorf("unsupported bootloader for platform %s: %s, only grub-efi is supported", platform, bootloader)
-		}
-	default:
-		return fmt.Errorf("unexpected platform: %s, supported platforms: linux/amd64, linux/arm64", platform)
-	}
-	if luksPassword != "" && !splitBoot {
-		logrus.Warnf("luks password is set: enabling split boot")
-		splitBoot = true
-	}
-	if bootFS := d2vm.BootFS(bootFS); bootFS != "" && !bootFS.IsSupported() {
-		return fmt.Errorf("invalid boot filesystem: %s", bootFS)
-	}
-	if bootFS != "" && !splitBoot {
-		logrus.Warnf("boot filesystem is set: enabling split boot")
-		splitBoot = true
-	}
-	efi := bootloader == "grub-efi" || bootloader == "grub"
-	if efi && !splitBoot {
-		logrus.Warnf("grub-efi bootloader is set: enabling split boot")
-		splitBoot = true
-	}
-	if efi && bootFS != "" && bootFS != "fat32" {
-		return fmt.Errorf("grub-efi bootloader only supports fat32 boot filesystem")
-	}
-	if efi && bootFS == "" {
-		logrus.Warnf("grub-efi bootloader is set: enabling fat32 boot filesystem")
-		bootFS = "fat32"
-	}
-	if push && tag == "" {
+// validateFlags checks the command line only flags, and redirects a block device output to a temporary image.
+// The conversion flags are validated with the target spec.
+func validateFlags(ctx context.Context) error {
+	if push && containerDiskTag == "" {
 		return fmt.Errorf("tag is required when pushing container disk image")
 	}
-	if _, err := os.Stat(output); err == nil || !os.IsNotExist(err) {
-		if !force {
-			return fmt.Errorf("%s already exists", output)
-		}
-	}
-	extraHosts, err = validateHosts(hosts...)
-	if err != nil {
-		return fmt.Errorf("invalid --add-host value: %w", err)
+	return validateFlashOutput(ctx)
+}
+
+// flagsTarget returns the target of the conversion flags, as the build file targets are merged with them.
+func flagsTarget(flags *pflag.FlagSet) (d2vm.Target, error) {
+	var t d2vm.Target
+	if err := mergeFlags(flags, &t); err != nil {
+		return d2vm.Target{}, err
 	}
-	return nil
+	// the output default is not a flag value, and the block device output is redirected to a temporary image
+	t.Output = output
+	return t, nil
 }
 
 func buildFlags() *pflag.FlagSet {
 	flags := pflag.NewFlagSet("build", pflag.ExitOnError)
-	flags.StringVarP(&output, "output", "o", output, "The output image, the extension determine the image format, raw will be used if none. Supported formats: "+strings.Join(d2vm.OutputFormats(), " "))
+	flags.StringVarP(&configFile, "config", "c", "", "Build file path, e.g. "+d2vm.BuildFileName+": the positional arguments are then the names of the targets to build, all of them if none is given")
+	flags.StringVarP(&output, "output", "o", output, "The output image, the extension determine the image format, raw will be used if none, or a block device to write the raw image to, e.g. /dev/sdb. Supported formats: "+strings.Join(d2vm.OutputFormats(), " "))
 	flags.StringVarP(&password, "password", "p", "", "Optional root user password")
-	flags.StringVarP(&size, "size", "s", "10G", "The output image size")
-	flags.BoolVar(&force, "force", false, "Override output qcow2 image")
+	flags.StringVarP(&size, "size", "s", "10G", "The output image size, or auto to use the smallest size able to hold the image, optionally with some free space, e.g. auto+2G")
+	flags.StringSliceVar(&formats, "formats", nil, "Convert the image to each of the formats, written next to the output image with the format extension, e.g. qcow2,vmdk,vhdx. Defaults to the output image extension")
+	flags.StringVar(&outputKind, "output-kind", string(d2vm.OutputKindDisk), "Kind of artifacts to write, named after the output image: disk (the disk images), netboot (the kernel, the initramfs, the root filesystem and an iPXE script) or microvm (the kernel, the initramfs, a partitionless ext4 root filesystem image and a Firecracker configuration)")
+	flags.StringVar(&netbootRoot, "netboot-root", string(d2vm.NetbootRootHTTP), "Root filesystem of the netboot artifacts: http (squashfs image fetched over HTTP) or nfs (archive to extract on the NFS export)")
+	flags.StringVar(&netbootURL, "netboot-url", "", "Base URL the netboot artifacts are served from with the http root, e.g. http://10.0.0.1/d2vm, or NFS export with the nfs root, e.g. 10.0.0.1:/srv/d2vm")
+	flags.StringVar(&qcow2Compression, "qcow2-compression", "", "Compress the qcow2 image clusters: zlib or zstd")
+	flags.UintVar(&applianceCPUs, "appliance-cpus", 1, "Number of virtual CPUs of the ova, ovf and box appliances")
+	flags.Uint64Var(&applianceMemory, "appliance-memory", 1024, "Memory size in MiB of the ova, ovf and box appliances")
+	flags.StringVar(&applianceNIC, "appliance-nic", string(d2vm.NICE1000), "Network adapter of the ova, ovf and box appliances: e1000, e1000e, vmxnet3 or virtio")
+	flags.StringVar(&vagrantProvider, "vagrant-provider", string(d2vm.VagrantProviderLibvirt), "Provider of the .box Vagrant box: libvirt (qcow2 disk) or virtualbox (ovf appliance)")
+	flags.BoolVar(&force, "force", false, "Override the output image, or write to a used or non-removable block device output, the system disk and the mounted disks are always refused")
 	flags.StringVar(&cmdLineExtra, "append-to-cmdline", "", "Extra kernel cmdline arguments to append to the generated one")
 	flags.StringVar(&networkManager, "network-manager", "", "Network manager to use for the image: none, netplan, ifupdown")
 	flags.BoolVar(&raw, "raw", false, "Just convert the container to virtual machine image without installing anything more")
@@ -122,11 +131,37 @@ func buildFlags() *pflag.FlagSet {
 	flags.BoolVar(&splitBoot, "split-boot", false, "Split the boot partition from the root partition")
 	flags.Uint64Var(&bootSize, "boot-size", 100, "Size of the boot partition in MB")
 	flags.StringVar(&bootFS, "boot-fs", "", "Filesystem to use for the boot partition, ext4 or fat32")
+	flags.StringVar(&partitionTable, "partition-table", "", "Partition table to use for the disk image: msdos or gpt, defaults to msdos")
+	flags.StringVar(&rootFS, "root-fs", "", "Filesystem to use for the root partition: ext4, xfs or btrfs, defaults to ext4")
+	flags.StringVar(&rootFSLabel, "root-fs-label", "", "Label of the root filesystem")
+	flags.Uint64Var(&rootFSInodeRatio, "root-fs-inode-ratio", 0, "Bytes-per-inode ratio of the root filesystem (ext4 only)")
+	flags.Float64Var(&rootFSReserved, "root-fs-reserved-blocks", 0, "Percentage of the root filesystem blocks reserved for the super-user (ext4 only), defaults to the mkfs default")
+	flags.StringSliceVar(&rootFSFeatures, "root-fs-features", []string{}, "Root filesystem features to enable, or to disable when prefixed with '^' (ext4 only)")
+	flags.StringVar(&swapSize, "swap-size", "", "Size of the swap to add to the image, e.g. 1G, no swap is added if not set")
+	flags.StringVar(&swapType, "swap-type", "", "Type of swap to add to the image: partition or file, defaults to partition")
+	flags.StringVar(&layout, "layout", "", "Partitions layout specification: a YAML or JSON file path, or inline JSON")
+	flags.BoolVar(&readOnly, "read-only", false, "Mount the root filesystem read-only, under an overlayfs writable layer")
+	flags.StringVar(&overlay, "overlay", "", "Storage of the read-only root filesystem writable layer: tmpfs (discarded on reboot) or partition, defaults to tmpfs")
+	flags.StringVar(&overlaySize, "overlay-size", "", "Size of the overlay partition, or maximum size of the overlay tmpfs, e.g. 1G")
+	flags.BoolVar(&squashFS, "squashfs", false, "Store the read-only root filesystem as a compressed squashfs image (requires split boot)")
+	flags.StringVar(&verity, "verity", "", "Protect the read-only root partition with dm-verity, the hash tree is stored on a dedicated partition or appended to the root partition: partition or appended")
+	flags.Lookup("verity").NoOptDefVal = string(d2vm.VerityPartition)
 	flags.StringVar(&bootloader, "bootloader", "", "Bootloader to use: syslinux, grub, grub-bios, grub-efi, defaults to syslinux on amd64 and grub-efi on arm64")
 	flags.StringVar(&luksPassword, "luks-password", "", "Password to use for the LUKS encrypted root partition. If not set, the root partition will not be encrypted")
+	flags.StringVar(&luksRecovery, "luks-recovery-password", "", "Additional recovery password, stored in its own LUKS key slot")
+	flags.StringVar(&luksKeyFile, "luks-key-file", "", "Key file to add to the LUKS key slots, generated if --luks-unlock is set")
+	flags.StringVar(&luksUnlock, "luks-unlock", "", "Unlock the root partition at boot with the key file, stored in the initramfs or on the boot partition: initramfs or boot")
+	flags.StringVar(&luksCipher, "luks-cipher", "", "LUKS2 encryption cipher, e.g. aes-xts-plain64, defaults to the cryptsetup default")
+	flags.IntVar(&luksKeySize, "luks-key-size", 0, "LUKS2 encryption key size in bits, defaults to the cryptsetup default")
+	flags.StringVar(&luksPBKDF, "luks-pbkdf", "", "LUKS2 key slots key derivation function: pbkdf2, argon2i or argon2id, defaults to the cryptsetup default")
+	flags.Uint64Var(&luksPBKDFMemory, "luks-pbkdf-memory", 0, "LUKS2 argon2 key derivation memory cost in KiB")
+	flags.Uint64Var(&luksIterTime, "luks-iter-time", 0, "LUKS2 key derivation time in milliseconds")
+	flags.BoolVar(&rootless, "rootless", false, "Build the image without root privileges, loop devices nor mounts (requires fakeroot, mtools and syslinux, only supports the syslinux bootloader)")
+	flags.BoolVar(&reproducible, "reproducible", false, "Build a reproducible image: the UUIDs and hash seeds are derived from the source image digest, and the files timestamps are clamped to SOURCE_DATE_EPOCH, or to the source image creation date")
 	flags.BoolVar(&keepCache, "keep-cache", false, "Keep the images after the build")
 	flags.StringVar(&platform, "platform", d2vm.Arch, "Platform to use for the container disk image, linux/arm64 and linux/arm64 are supported")
 	flags.BoolVar(&pull, "pull", false, "Always pull docker image")
+	flags.StringVar(&progress, "progress", progressPlain, "Progress output: plain (logs), tty (progress display) or json (newline-delimited JSON events written to stdout)")
 	flags.StringVar(&hostname, "hostname", "localhost", "Hostname to set in the generated image")
 	flags.StringSliceVar(&dns, "dns", []string{}, "DNS servers to set in the generated image")
 	flags.StringSliceVar(&dnsSearch, "dns-search", []string{}, "DNS search domains to set in the generated image")
@@ -134,6 +169,112 @@ func buildFlags() *pflag.FlagSet {
 	return flags
 }
 
+// outputPaths returns the paths of the disk images, or of the netboot or microvm artifacts, written by the conversion.
+func outputPaths() []string {
+	return specOutputPaths(d2vm.ConvertSpec{Output: output, Formats: formats, OutputKind: d2vm.OutputKind(outputKind), NetbootRoot: d2vm.NetbootRoot(netbootRoot)})
+}
+
+// specOutputPaths returns the paths of the disk images, or of the netboot or microvm artifacts, written by the spec conversion.
+func specOutputPaths(s d2vm.ConvertSpec) []string {
+	switch {
+	case s.OutputKind.IsNetboot():
+		return d2vm.NetbootPaths(s.Output, s.NetbootRoot)
+	case s.OutputKind.IsMicroVM():
+		return d2vm.MicroVMPaths(s.Output)
+	default:
+		return d2vm.OutputPaths(s.Output, s.Formats...)
+	}
+}
+
+// validateOutputs checks the conversion does not override existing files, unless forced.
+func validateOutputs(paths []string) error {
+	for _, v := range paths {
+		if _, err := os.Stat(v); err == nil || !os.IsNotExist(err) {
+			if !force {
+				return fmt.Errorf("%s already exists", v)
+			}
+		}
+	}
+	return nil
+}
+
+// chownOutputs sets the user permissions on the output files if the command was run with sudo.
+func chownOutputs(paths []string) error {
+	uid, ok := sudoUser()
+	if !ok {
+		return nil
+	}
+	for _, v := range paths {
+		if err := os.Chown(v, uid, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isInlineLayout(v string) bool {
+	return strings.HasPrefix(strings.TrimSpace(v), "{")
+}
+
+// parseLayout parses the --layout inline JSON, or loads its file.
+func parseLayout(v string) (d2vm.Layout, error) {
+	if isInlineLayout(v) {
+		return d2vm.ParseLayout([]byte(v))
+	}
+	return d2vm.LoadLayout(v)
+}
+
+// inlineLayout replaces the --layout file path with its content in args,
+// as the file is not available in the d2vm container.
+func inlineLayout(args []string) error {
+	if layout == "" || isInlineLayout(layout) {
+		return nil
+	}
+	l, err := d2vm.LoadLayout(layout)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	for i, v := range args {
+		switch {
+		case v == "--layout="+layout:
+			args[i] = "--layout=" + string(b)
+		case v == layout && i > 0 && args[i-1] == "--layout":
+			args[i] = string(b)
+		}
+	}
+	return nil
+}
+
+// mountLuksKeyFile replaces the --luks-key-file path with its path in the d2vm container,
+// where only the output directory is available.
+func mountLuksKeyFile(args []string, out string) error {
+	if luksKeyFile == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(luksKeyFile)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(out, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("luks key file must be in the output directory: %s", out)
+	}
+	p := filepath.Join("/out", rel)
+	for i, v := range args {
+		switch {
+		case v == "--luks-key-file="+luksKeyFile:
+			args[i] = "--luks-key-file=" + p
+		case v == luksKeyFile && i > 0 && args[i-1] == "--luks-key-file":
+			args[i] = p
+		}
+	}
+	return nil
+}
+
 func validateHosts(vals ...string) (map[string]string, error) {
 	out := make(map[string]string)
 	for _, val := range vals {
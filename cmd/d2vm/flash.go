@@ -0,0 +1,92 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+
+	"go.linka.cloud/d2vm"
+)
+
+var (
+	// flashDevice is the block device the converted image is written to, when the output is a block device
+	flashDevice = ""
+
+	flashCmd = &cobra.Command{
+		Use:   "flash [image] [device]",
+		Short: "Write a vm image to a block device, e.g. a USB stick",
+		Long: `Write a vm image to a block device, e.g. a USB stick.
+
+The image is converted to raw if needed and only its data is written, then its last partition and filesystem are grown to fill the device.
+Used and non-removable disks are refused unless forced, the system disk and the mounted disks are always refused.`,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return d2vm.Flash(cmd.Context(), args[0], args[1], force)
+		},
+	}
+)
+
+// errBlockDeviceOutput is returned when the conversion would run in the d2vm container, where the host devices are not available.
+var errBlockDeviceOutput = errors.New("block device output requires running as root on linux")
+
+func isBlockDevice(path string) bool {
+	i, err := os.Stat(path)
+	return err == nil && i.Mode()&os.ModeDevice != 0 && i.Mode()&os.ModeCharDevice == 0
+}
+
+// validateFlashOutput redirects the conversion to a temporary raw image when the output is a block device:
+// it is written to the device once converted. The device is checked before the conversion starts.
+func validateFlashOutput(ctx context.Context) error {
+	if !isBlockDevice(output) {
+		return nil
+	}
+	if err := d2vm.CheckFlashDevice(ctx, output, force); err != nil {
+		return err
+	}
+	if k := d2vm.OutputKind(outputKind); !k.IsDisk() {
+		return fmt.Errorf("block device output requires a disk image, not %s artifacts", k)
+	}
+	if len(formats) != 0 {
+		return fmt.Errorf("block device output does not support --formats")
+	}
+	if containerDiskTag != "" {
+		return fmt.Errorf("block device output does not support container disk image")
+	}
+	flashDevice = output
+	output = filepath.Join(os.TempDir(), "d2vm-"+uuid.New().String()+".raw")
+	return nil
+}
+
+// maybeFlash writes the converted image to the output block device.
+func maybeFlash(ctx context.Context) error {
+	if flashDevice == "" {
+		return nil
+	}
+	defer os.Remove(output)
+	return d2vm.Flash(ctx, output, flashDevice, force)
+}
+
+func init() {
+	flashCmd.Flags().BoolVar(&force, "force", false, "Write to the device even if it is used or not removable, the system disk and the mounted disks are always refused")
+	rootCmd.AddCommand(flashCmd)
+}
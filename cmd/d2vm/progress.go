@@ -0,0 +1,97 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fatih/color"
+	"github.com/sirupsen/logrus"
+
+	"go.linka.cloud/d2vm"
+)
+
+const (
+	progressPlain = "plain"
+	progressTTY   = "tty"
+	progressJSON  = "json"
+)
+
+func validateProgress() error {
+	switch progress {
+	case progressPlain, progressTTY, progressJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid progress output: %s, valid outputs are: plain, tty, json", progress)
+	}
+}
+
+// progressOption returns the convert option rendering the progress events to the selected output.
+func progressOption() d2vm.ConvertOption {
+	switch progress {
+	case progressJSON:
+		// the events are written to stdout, the logs are still written to stderr
+		enc := json.NewEncoder(os.Stdout)
+		return d2vm.WithProgress(func(e d2vm.Event) {
+			if err := enc.Encode(e); err != nil {
+				logrus.Warnf("failed to write progress event: %v", err)
+			}
+		})
+	case progressTTY:
+		// the progress display replaces the informational logs
+		if !verbose {
+			logrus.SetLevel(logrus.WarnLevel)
+		}
+		return d2vm.WithProgress((&ttyProgress{w: os.Stderr}).render)
+	default:
+		return d2vm.WithProgress(nil)
+	}
+}
+
+type ttyProgress struct {
+	w io.Writer
+}
+
+func (p *ttyProgress) render(e d2vm.Event) {
+	switch e.Type {
+	case d2vm.EventPhaseStart:
+		p.line("%s %s", color.New(blue).Sprint("•"), e.Phase)
+	case d2vm.EventExtract:
+		p.line("%s %s: %s extracted", color.New(blue).Sprint("•"), e.Phase, humanize.Bytes(e.Bytes))
+	case d2vm.EventConvert:
+		p.line("%s %s: %s %.0f%%", color.New(blue).Sprint("•"), e.Phase, e.Format, e.Percent)
+	case d2vm.EventPhaseEnd:
+		if e.Error != "" {
+			p.line("%s %s failed after %s\n", color.New(red).Sprint("✗"), e.Phase, e.Duration.Round(time.Millisecond))
+			return
+		}
+		p.line("%s %s %s\n", color.New(white).Sprint("✓"), e.Phase, color.New(gray).Sprintf("(%s)", e.Duration.Round(time.Millisecond)))
+	case d2vm.EventDone:
+		if e.Error != "" {
+			return
+		}
+		fmt.Fprintf(p.w, "done in %s\n", e.Duration.Round(time.Second))
+	}
+}
+
+// line replaces the current terminal line
+func (p *ttyProgress) line(format string, args ...any) {
+	fmt.Fprintf(p.w, "\r\033[K"+format, args...)
+}
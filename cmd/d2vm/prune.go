@@ -0,0 +1,52 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"go.linka.cloud/d2vm"
+	"go.linka.cloud/d2vm/pkg/docker"
+)
+
+var (
+	pruneDryRun = false
+
+	pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Release the resources left by interrupted conversions",
+		Long: `Release the resources left by interrupted conversions.
+
+A conversion killed before its clean up leaves its mounts, its encrypted root partition and loop devices mappings,
+its Docker image and its work directory behind. The conversions still running are found from their state record and left untouched.
+Conversions running in the d2vm container are not visible outside of it: do not prune while they run.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if runtime.GOOS != "linux" || !isRoot() {
+				return docker.RunD2VM(cmd.Context(), d2vm.Image, d2vm.Version, "", "", cmd.Name(), os.Args[2:]...)
+			}
+			return d2vm.Prune(cmd.Context(), pruneDryRun)
+		},
+	}
+)
+
+func init() {
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Only print the resources that would be released")
+	rootCmd.AddCommand(pruneCmd)
+}
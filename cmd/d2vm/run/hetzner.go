@@ -83,17 +83,23 @@ func Hetzner(cmd *cobra.Command, args []string) {
 }
 
 func runHetzner(ctx context.Context, imgPath string, stdin io.Reader, stderr io.Writer, stdout io.Writer) error {
+	imgPath, cleanup, err := decompress(ctx, imgPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 	i, err := qemu_img.Info(ctx, imgPath)
 	if err != nil {
 		return err
 	}
 	if i.Format != "raw" {
 		logrus.Warnf("image format is %s, expected raw", i.Format)
-		rawPath := filepath.Join(os.TempDir(), "d2vm", "run", filepath.Base(imgPath)+".raw")
-		if err := os.MkdirAll(filepath.Dir(rawPath), 0755); err != nil {
+		dir, err := os.MkdirTemp("", "d2vm-run")
+		if err != nil {
 			return err
 		}
-		defer os.RemoveAll(rawPath)
+		defer os.RemoveAll(dir)
+		rawPath := filepath.Join(dir, filepath.Base(imgPath)+".raw")
 		logrus.Infof("converting image to raw: %s", rawPath)
 		if err := qemu_img.Convert(ctx, "raw", imgPath, rawPath); err != nil {
 			return err
@@ -35,10 +35,11 @@ var (
 	publishFlags MultipleFlag
 
 	QemuCmd = &cobra.Command{
-		Use:   "qemu [options] [image-path]",
-		Short: "Run the virtual machine image with qemu",
-		Args:  cobra.ExactArgs(1),
-		Run:   Qemu,
+		Use:          "qemu [options] [image-path]",
+		Short:        "Run the virtual machine image with qemu",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         Qemu,
 	}
 )
 
@@ -84,17 +85,27 @@ func init() {
 	flags.Var(&publishFlags, "publish", "Publish a vm's port(s) to the host (default [])")
 }
 
-func Qemu(cmd *cobra.Command, args []string) {
+func Qemu(cmd *cobra.Command, args []string) error {
 	path := args[0]
 
 	if _, err := os.Stat(path); err != nil {
-		log.Fatal(err)
+		return err
+	}
+	path, cleanup, err := decompress(cmd.Context(), path)
+	if err != nil {
+		return err
+	}
+	// the detached virtual machine still reads the decompressed image once the command returned
+	if qemuDetached && path != args[0] {
+		log.Infof("keeping the decompressed image %s for the detached virtual machine", path)
+	} else {
+		defer cleanup()
 	}
 	var publishedPorts []PublishedPort
 	for _, publish := range publishFlags {
 		p, err := NewPublishedPort(publish)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		publishedPorts = append(publishedPorts, p)
 	}
@@ -116,9 +127,7 @@ func Qemu(cmd *cobra.Command, args []string) {
 	if qemuDetached {
 		opts = append(opts, qemu.WithDetached())
 	}
-	if err := qemu.Run(cmd.Context(), path, opts...); err != nil {
-		log.Fatal(err)
-	}
+	return qemu.Run(cmd.Context(), path, opts...)
 }
 
 func haveKVM() bool {
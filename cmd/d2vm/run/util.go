@@ -19,17 +19,21 @@ package run
 
 import (
 	"bufio"
+	"context"
 	_ "embed"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 
+	"go.linka.cloud/d2vm/pkg/compress"
 	"go.linka.cloud/d2vm/pkg/qemu"
 )
 
@@ -39,6 +43,26 @@ var sparsecatAmdBinary []byte
 //go:embed sparsecat-linux-arm64
 var sparsecatArmBinary []byte
 
+// decompress decompresses the compressed raw disk image, e.g. disk0.raw.zst, to a sparse file in its own temporary
+// directory, so that concurrent runs never share it. The image path is returned as is if it is not compressed.
+// The returned function removes the temporary directory.
+func decompress(ctx context.Context, path string) (string, func(), error) {
+	if _, ok := compress.FromPath(path); !ok {
+		return path, func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "d2vm-run")
+	if err != nil {
+		return "", nil, err
+	}
+	raw := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	logrus.Infof("decompressing image to %s", raw)
+	if err := compress.Decompress(ctx, path, raw); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return raw, func() { os.RemoveAll(dir) }, nil
+}
+
 func Sparsecat(arch string) ([]byte, error) {
 	switch arch {
 	case "amd64":
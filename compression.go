@@ -0,0 +1,80 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.linka.cloud/d2vm/pkg/compress"
+)
+
+// QCOW2Compression is the qcow2 image clusters compression algorithm.
+type QCOW2Compression string
+
+const (
+	QCOW2CompressionZlib QCOW2Compression = "zlib"
+	QCOW2CompressionZstd QCOW2Compression = "zstd"
+)
+
+func (c QCOW2Compression) String() string {
+	return string(c)
+}
+
+func (c QCOW2Compression) IsZlib() bool {
+	return c == QCOW2CompressionZlib
+}
+
+func (c QCOW2Compression) IsZstd() bool {
+	return c == QCOW2CompressionZstd
+}
+
+func (c QCOW2Compression) IsSupported() bool {
+	return c.IsZlib() || c.IsZstd()
+}
+
+func (c QCOW2Compression) Validate() error {
+	if !c.IsSupported() {
+		return fmt.Errorf("invalid qcow2 compression: %s valid compressions are: zlib, zstd", c)
+	}
+	return nil
+}
+
+// qemuImgArgs returns the qemu-img convert arguments compressing the image.
+func (c QCOW2Compression) qemuImgArgs() []string {
+	if c == "" {
+		return nil
+	}
+	return []string{"-c", "-o", "compression_type=" + c.String()}
+}
+
+// compressedRaw returns the compression of the raw disk image format, e.g. raw.zst.
+func compressedRaw(format string) (compress.Format, bool) {
+	if !strings.HasPrefix(format, "raw.") {
+		return "", false
+	}
+	return compress.FromPath(format)
+}
+
+// formatExt returns the extension of the disk image path, including both extensions of the formats having two of them,
+// e.g. the compressed raw images or the azure fixed vhd.
+func formatExt(path string) string {
+	ext := filepath.Ext(path)
+	if e := filepath.Ext(strings.TrimSuffix(path, ext)) + ext; e != ext && validateFormat(strings.ToLower(strings.TrimPrefix(e, "."))) == nil {
+		return e
+	}
+	return ext
+}
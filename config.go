@@ -48,6 +48,12 @@ func (r RootUUID) String() string {
 	return "UUID=" + string(r)
 }
 
+type RootPartUUID string
+
+func (r RootPartUUID) String() string {
+	return "PARTUUID=" + string(r)
+}
+
 type RootPath string
 
 func (r RootPath) String() string {
@@ -57,6 +63,8 @@ func (r RootPath) String() string {
 type Config struct {
 	Kernel string
 	Initrd string
+	// RootFS is the root filesystem type, defaults to ext4.
+	RootFS RootFS
 }
 
 func (c Config) Cmdline(root Root, args ...string) string {
@@ -64,7 +72,11 @@ func (c Config) Cmdline(root Root, args ...string) string {
 	if root != nil {
 		r = fmt.Sprintf("root=%s", root.String())
 	}
-	return fmt.Sprintf("ro initrd=%s %s net.ifnames=0 rootfstype=ext4 console=tty0 console=ttyS0,115200n8 %s", c.Initrd, r, strings.Join(args, " "))
+	fs := c.RootFS
+	if fs == "" {
+		fs = RootFSExt4
+	}
+	return fmt.Sprintf("ro initrd=%s %s net.ifnames=0 rootfstype=%s console=tty0 console=ttyS0,115200n8 %s", c.Initrd, r, fs, strings.Join(args, " "))
 }
 
 func (r OSRelease) Config() (Config, error) {
@@ -21,7 +21,6 @@ import (
 	"path/filepath"
 
 	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 
 	"go.linka.cloud/d2vm/pkg/docker"
 	"go.linka.cloud/d2vm/pkg/qemu_img"
@@ -43,7 +42,7 @@ func MakeContainerDisk(ctx context.Context, path string, tag string, platform st
 	}
 	defer func() {
 		if err := os.RemoveAll(tmpPath); err != nil {
-			logrus.Errorf("failed to remove tmp dir %s: %v", tmpPath, err)
+			logger(ctx).Errorf("failed to remove tmp dir %s: %v", tmpPath, err)
 		}
 	}()
 	if _, err := os.Stat(path); err != nil {
@@ -20,42 +20,111 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/svenwiltink/sparsecat"
 
 	"go.linka.cloud/d2vm/pkg/docker"
+	"go.linka.cloud/d2vm/pkg/exec"
 )
 
-func Convert(ctx context.Context, img string, opts ...ConvertOption) error {
+func Convert(ctx context.Context, img string, opts ...ConvertOption) (err error) {
 	o := &convertOptions{}
 	for _, opt := range opts {
 		opt(o)
 	}
+	if o.logger != nil {
+		ctx = exec.WithLogger(ctx, o.logger)
+	}
+	start := time.Now()
+	defer func() {
+		e := Event{Type: EventDone, Duration: time.Since(start)}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		o.progress.emit(e)
+	}()
+	if err := o.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer o.limiter.release()
+	// the time spent waiting for the limiter is not part of the conversion duration
+	start = time.Now()
 	imgUUID := uuid.New().String()
 	tmpPath := filepath.Join(os.TempDir(), "d2vm", imgUUID)
 	if err := os.MkdirAll(tmpPath, os.ModePerm); err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmpPath)
+	// the state record lets Prune release the build resources if the process is killed
+	if err := updateBuildState(tmpPath, func(s *buildState) { s.Image = imgUUID }); err != nil {
+		return err
+	}
 
-	logrus.Infof("inspecting image %s", img)
-	r, err := FetchDockerImageOSRelease(ctx, img)
-	if err != nil {
+	logger(ctx).Infof("inspecting image %s", img)
+	var r OSRelease
+	if err := o.progress.phase(PhaseInspect, func() (err error) {
+		r, err = FetchDockerImageOSRelease(ctx, img)
+		return err
+	}); err != nil {
 		return err
 	}
 
-	if o.luksPassword != "" && !r.SupportsLUKS() {
+	if o.luksPassword != "" && !r.SupportsLUKSContext(ctx) {
 		return fmt.Errorf("luks is not supported for %s %s", r.Name, r.Version)
 	}
 
+	// the generated key file is only stored in the image, the passphrase remains the way to recover the data
+	if o.luksPassword != "" && o.luksOpts.Unlock != "" && o.luksOpts.KeyFile == "" {
+		logger(ctx).Infof("generating luks key file")
+		o.luksOpts.KeyFile = filepath.Join(tmpPath, "luks.key")
+		if err := generateLuksKey(o.luksOpts.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	var rep Reproducible
+	var buildArgs []string
+	if o.reproducible {
+		i, err := docker.ImageInspect(ctx, img)
+		if err != nil {
+			return err
+		}
+		rep.Seed = i.ID
+		if rep.Epoch, err = SourceDateEpoch(i.Created); err != nil {
+			return err
+		}
+		buildArgs = append(buildArgs, fmt.Sprintf("%s=%d", SourceDateEpochEnv, rep.Epoch.Unix()))
+		logger(ctx).Infof("reproducible build from %s at %s", rep.Seed, rep.Epoch.UTC().Format(time.RFC3339))
+		if !o.rootless {
+			logger(ctx).Warnf("reproducible build without rootless: the kernel writes its own timestamps and journal entries to the mounted filesystems, the disk image is not bit-for-bit identical")
+		}
+	}
+
+	if err := o.outputKind.Validate(); err != nil {
+		return err
+	}
+	var outputs []output
+	if o.outputKind.IsDisk() {
+		outputs = o.outputs()
+	} else if len(o.formats) != 0 {
+		logger(ctx).Warnf("%s output: ignoring the disk image formats", o.outputKind)
+	}
+	var formats []string
+	for _, v := range outputs {
+		formats = append(formats, v.format)
+	}
+	// the options set by the conversion override the given ones
+	opts = append(opts[:len(opts):len(opts)], WithLuksOptions(o.luksOpts), WithFormats(formats...), WithBuildReproducible(rep))
+
 	if !o.raw {
-		d, err := NewDockerfile(r, img, o.password, o.networkManager, o.luksPassword != "", o.hasGrubBIOS(), o.hasGrubEFI())
+		d, err := NewDockerfile(r, img, o.password, o.networkManager, o.luksPassword != "", o.hasGrubBIOS(), o.hasGrubEFI(), opts...)
 		if err != nil {
 			return err
 		}
-		logrus.Infof("docker image based on %s %s", d.Release.Name, d.Release.Version)
+		logger(ctx).Infof("docker image based on %s %s", d.Release.Name, d.Release.Version)
 		p := filepath.Join(tmpPath, docker.FormatImgName(img))
 		dir := filepath.Dir(p)
 		f, err := os.Create(p)
@@ -66,14 +135,34 @@ func Convert(ctx context.Context, img string, opts ...ConvertOption) error {
 		if err := d.Render(f); err != nil {
 			return err
 		}
-		logrus.Infof("building kernel enabled image")
-		if err := docker.Build(ctx, o.pull, imgUUID, p, dir, o.platform); err != nil {
+		if err := d.WriteFiles(dir); err != nil {
+			return err
+		}
+		logger(ctx).Infof("building kernel enabled image")
+		if err := o.progress.phase(PhaseDockerBuild, func() error {
+			return docker.Build(ctx, o.pull, imgUUID, p, dir, o.platform, buildArgs...)
+		}); err != nil {
 			return err
 		}
 		if !o.keepCache {
 			defer docker.Remove(ctx, imgUUID)
 		}
 	} else {
+		if o.readOnly.IsEnabled() {
+			logger(ctx).Warnf("raw image: its initramfs must set up the read-only root filesystem overlay")
+		}
+		if o.hasFormat("box") {
+			logger(ctx).Warnf("raw image: the vagrant user must already be set up")
+		}
+		if o.hasFormat(azureFormat) {
+			logger(ctx).Warnf("raw image: the hyper-v drivers and the azure agent must already be installed")
+		}
+		if o.hasFormat(isoFormat) {
+			logger(ctx).Warnf("raw image: its initramfs must mount the iso live root filesystem")
+		}
+		if o.outputKind.IsNetboot() {
+			logger(ctx).Warnf("raw image: its initramfs must mount the netboot root filesystem")
+		}
 		// for raw images, we just tag the image with the uuid
 		if err := docker.Tag(ctx, img, imgUUID); err != nil {
 			return err
@@ -83,12 +172,9 @@ func Convert(ctx context.Context, img string, opts ...ConvertOption) error {
 		}
 	}
 
-	logrus.Infof("creating vm image")
-	format := strings.TrimPrefix(filepath.Ext(o.output), ".")
-	if format == "" {
-		format = "raw"
-	}
-	b, err := NewBuilder(ctx, tmpPath, imgUUID, "", o.size, r, format, o.cmdLineExtra, o.splitBoot, o.bootFS, o.bootSize, o.luksPassword, o.bootLoader, o.platform, o.hostname, o.dns, o.dnsSearch, o.hosts)
+	logger(ctx).Infof("creating vm image")
+	name := o.name()
+	b, err := NewBuilder(ctx, tmpPath, imgUUID, name, o.size.Bytes, r, "", o.cmdLineExtra, o.splitBoot, o.bootFS, o.bootSize, o.luksPassword, o.bootLoader, o.platform, o.hostname, o.dns, o.dnsSearch, o.hosts, opts...)
 	if err != nil {
 		return err
 	}
@@ -96,16 +182,118 @@ func Convert(ctx context.Context, img string, opts ...ConvertOption) error {
 	if err := b.Build(ctx); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(o.output); err != nil {
-		return err
+	return o.progress.phase(PhaseOutput, func() error {
+		if !o.outputKind.IsDisk() {
+			src := o.artifacts(tmpPath)
+			for i, p := range o.artifacts(filepath.Dir(o.output)) {
+				if err := os.RemoveAll(p); err != nil {
+					return err
+				}
+				if err := MoveFile(src[i], p); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, v := range outputs {
+			src := output{format: v.format, path: filepath.Join(tmpPath, name+"."+v.format)}.files()
+			for i, p := range v.files() {
+				if err := os.RemoveAll(p); err != nil {
+					return err
+				}
+				if err := MoveFile(src[i], p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// OutputPaths returns the paths of the disk images written by Convert for the output path and formats.
+func OutputPaths(output string, formats ...string) []string {
+	var paths []string
+	for _, v := range (&convertOptions{output: output, formats: formats}).outputs() {
+		paths = append(paths, v.files()...)
 	}
-	if err := MoveFile(filepath.Join(tmpPath, "disk0."+format), o.output); err != nil {
-		return err
+	return paths
+}
+
+type output struct {
+	format string
+	path   string
+}
+
+// files returns the output files: the ovf appliance disk and manifest are written next to its descriptor.
+func (o output) files() []string {
+	if o.format == "ovf" {
+		return applianceFiles(o.path)
+	}
+	return []string{o.path}
+}
+
+// artifacts returns the paths of the netboot or microvm artifacts in dir, named after the output file.
+func (o *convertOptions) artifacts(dir string) []string {
+	base := filepath.Join(dir, o.name())
+	switch {
+	case o.outputKind.IsNetboot():
+		return netbootFiles(base, o.netboot.withDefaults().Root)
+	case o.outputKind.IsMicroVM():
+		return microVMFiles(base)
+	default:
+		return nil
 	}
-	return nil
+}
+
+// name returns the output file name without its format extension, used to name the appliances
+// and the netboot and microvm artifacts.
+func (o *convertOptions) name() string {
+	name := strings.TrimSuffix(filepath.Base(o.output), formatExt(o.output))
+	switch {
+	case o.outputKind.IsNetboot():
+		name = strings.TrimSuffix(name, ".ipxe")
+	case o.outputKind.IsMicroVM():
+		name = strings.TrimSuffix(name, ".json")
+	}
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		return "disk0"
+	}
+	return name
+}
+
+// outputs returns the disk images to write: the output path is used as is for its own format,
+// the other formats replace its extension.
+func (o *convertOptions) outputs() []output {
+	ext := formatExt(o.output)
+	format := strings.ToLower(strings.TrimPrefix(ext, "."))
+	if format == "" {
+		format = "raw"
+	}
+	if len(o.formats) == 0 {
+		return []output{{format: format, path: o.output}}
+	}
+	var outputs []output
+	seen := make(map[string]bool)
+	for _, v := range o.formats {
+		f := strings.ToLower(v)
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		if f == format {
+			outputs = append(outputs, output{format: f, path: o.output})
+		} else {
+			outputs = append(outputs, output{format: f, path: strings.TrimSuffix(o.output, ext) + "." + f})
+		}
+	}
+	return outputs
 }
 
 func MoveFile(sourcePath, destPath string) error {
+	// renaming keeps the file sparse and is instantaneous, but only works on the same filesystem
+	if err := os.Rename(sourcePath, destPath); err == nil {
+		return nil
+	}
 	inputFile, err := os.Open(sourcePath)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %s", err)
@@ -128,3 +316,8 @@ func MoveFile(sourcePath, destPath string) error {
 	}
 	return nil
 }
+
+// logger returns the build logger set on the context.
+func logger(ctx context.Context) *logrus.Entry {
+	return exec.Logger(ctx)
+}
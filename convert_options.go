@@ -14,22 +14,50 @@
 
 package d2vm
 
+import (
+	"github.com/sirupsen/logrus"
+)
+
 type ConvertOption func(o *convertOptions)
 
 type convertOptions struct {
-	size           uint64
-	password       string
-	output         string
-	cmdLineExtra   string
-	networkManager NetworkManager
-	bootLoader     string
-	raw            bool
-
-	splitBoot bool
-	bootSize  uint64
-	bootFS    BootFS
+	size     Size
+	password string
+	output   string
+	formats  []string
+
+	outputKind OutputKind
+	netboot    NetbootOptions
+
+	qcow2Compression QCOW2Compression
+	appliance        ApplianceOptions
+	cmdLineExtra     string
+	networkManager   NetworkManager
+	bootLoader       string
+	raw              bool
+
+	splitBoot      bool
+	bootSize       uint64
+	bootFS         BootFS
+	partitionTable PartitionTable
+
+	rootFS     RootFS
+	rootFSOpts RootFSOptions
+
+	swapType SwapType
+	swapSize uint64
+
+	layout Layout
+
+	readOnly ReadOnlyRoot
+	verity   Verity
 
 	luksPassword string
+	luksOpts     LuksOptions
+
+	rootless          bool
+	reproducible      bool
+	buildReproducible Reproducible
 
 	keepCache bool
 	platform  string
@@ -39,6 +67,12 @@ type convertOptions struct {
 	dns       []string
 	dnsSearch []string
 	hosts     map[string]string
+
+	hooks    Hooks
+	progress ProgressFunc
+
+	logger  *logrus.Entry
+	limiter *Limiter
 }
 
 func (o *convertOptions) hasGrubBIOS() bool {
@@ -49,9 +83,53 @@ func (o *convertOptions) hasGrubEFI() bool {
 	return o.bootLoader == "grub" || o.bootLoader == "grub-efi"
 }
 
+// rootFSType returns the root filesystem: the layout root partition filesystem takes precedence over the option.
+func (o *convertOptions) rootFSType() RootFS {
+	if p, ok := o.layout.partition("/"); ok && p.FS != "" {
+		return RootFS(p.FS)
+	}
+	return o.rootFS
+}
+
+// log returns the conversion logger, or the standard logger.
+func (o *convertOptions) log() *logrus.Entry {
+	if o.logger != nil {
+		return o.logger
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// netbootOptions returns the network boot options of the netboot output, or the zero options.
+func (o *convertOptions) netbootOptions() NetbootOptions {
+	if !o.outputKind.IsNetboot() {
+		return NetbootOptions{}
+	}
+	return o.netboot.withDefaults()
+}
+
+// hasFormat reports whether one of the disk images is written in the format.
+func (o *convertOptions) hasFormat(format string) bool {
+	if !o.outputKind.IsDisk() {
+		return false
+	}
+	for _, v := range o.outputs() {
+		if v.format == format {
+			return true
+		}
+	}
+	return false
+}
+
 func WithSize(size uint64) ConvertOption {
 	return func(o *convertOptions) {
-		o.size = size
+		o.size = Size{Bytes: size}
+	}
+}
+
+// WithAutoSize uses the smallest disk size able to hold the image, plus headroom bytes of free space.
+func WithAutoSize(headroom uint64) ConvertOption {
+	return func(o *convertOptions) {
+		o.size = Size{Bytes: headroom, Auto: true}
 	}
 }
 
@@ -67,6 +145,42 @@ func WithOutput(output string) ConvertOption {
 	}
 }
 
+// WithFormats converts the disk image to each of the formats. The images are written next to the output path,
+// with the format as extension. The output path extension is the format if none is given.
+func WithFormats(formats ...string) ConvertOption {
+	return func(o *convertOptions) {
+		o.formats = formats
+	}
+}
+
+// WithOutputKind sets the kind of artifacts to write: the disk images, or the network boot artifacts.
+func WithOutputKind(kind OutputKind) ConvertOption {
+	return func(o *convertOptions) {
+		o.outputKind = kind
+	}
+}
+
+// WithNetbootOptions configures the network boot artifacts written with the netboot output kind.
+func WithNetbootOptions(opts NetbootOptions) ConvertOption {
+	return func(o *convertOptions) {
+		o.netboot = opts
+	}
+}
+
+// WithApplianceOptions configures the virtual machine described by the ova and ovf appliances.
+func WithApplianceOptions(opts ApplianceOptions) ConvertOption {
+	return func(o *convertOptions) {
+		o.appliance = opts
+	}
+}
+
+// WithQCOW2Compression compresses the qcow2 image clusters with the given algorithm.
+func WithQCOW2Compression(c QCOW2Compression) ConvertOption {
+	return func(o *convertOptions) {
+		o.qcow2Compression = c
+	}
+}
+
 func WithCmdLineExtra(cmdLineExtra string) ConvertOption {
 	return func(o *convertOptions) {
 		o.cmdLineExtra = cmdLineExtra
@@ -109,12 +223,88 @@ func WithBootFS(bootFS BootFS) ConvertOption {
 	}
 }
 
+func WithPartitionTable(partitionTable PartitionTable) ConvertOption {
+	return func(o *convertOptions) {
+		o.partitionTable = partitionTable
+	}
+}
+
+func WithRootFS(rootFS RootFS) ConvertOption {
+	return func(o *convertOptions) {
+		o.rootFS = rootFS
+	}
+}
+
+func WithRootFSOptions(opts RootFSOptions) ConvertOption {
+	return func(o *convertOptions) {
+		o.rootFSOpts = opts
+	}
+}
+
+// WithSwap adds a swap partition or a swap file of the given size to the image.
+func WithSwap(swapType SwapType, size uint64) ConvertOption {
+	return func(o *convertOptions) {
+		o.swapType = swapType
+		o.swapSize = size
+	}
+}
+
+// WithLayout sets the disk partitions layout.
+func WithLayout(layout Layout) ConvertOption {
+	return func(o *convertOptions) {
+		o.layout = layout
+	}
+}
+
+// WithVerity protects the read-only root partition with a dm-verity hash tree stored at the given location.
+func WithVerity(verity Verity) ConvertOption {
+	return func(o *convertOptions) {
+		o.verity = verity
+	}
+}
+
+// WithReadOnlyRoot mounts the root filesystem read-only, under an overlayfs writable layer.
+func WithReadOnlyRoot(readOnly ReadOnlyRoot) ConvertOption {
+	return func(o *convertOptions) {
+		o.readOnly = readOnly
+	}
+}
+
 func WithLuksPassword(password string) ConvertOption {
 	return func(o *convertOptions) {
 		o.luksPassword = password
 	}
 }
 
+// WithLuksOptions configures the root partition key slots, the unattended unlock and the LUKS2 parameters.
+func WithLuksOptions(opts LuksOptions) ConvertOption {
+	return func(o *convertOptions) {
+		o.luksOpts = opts
+	}
+}
+
+func WithRootless(b bool) ConvertOption {
+	return func(o *convertOptions) {
+		o.rootless = b
+	}
+}
+
+// WithReproducible derives the disk image UUIDs and hash seeds from the source image digest,
+// and clamps the files timestamps to SOURCE_DATE_EPOCH, or to the source image creation date.
+func WithReproducible(b bool) ConvertOption {
+	return func(o *convertOptions) {
+		o.reproducible = b
+	}
+}
+
+// WithBuildReproducible sets the seed and the timestamp of the disk image build: Convert sets them from the image
+// when the build is reproducible.
+func WithBuildReproducible(r Reproducible) ConvertOption {
+	return func(o *convertOptions) {
+		o.buildReproducible = r
+	}
+}
+
 func WithKeepCache(b bool) ConvertOption {
 	return func(o *convertOptions) {
 		o.keepCache = b
@@ -156,3 +346,35 @@ func WithExtraHosts(hosts map[string]string) ConvertOption {
 		o.hosts = hosts
 	}
 }
+
+// WithHook registers a hook to run once the build phase completed.
+func WithHook(phase Phase, hook Hook) ConvertOption {
+	return func(o *convertOptions) {
+		if o.hooks == nil {
+			o.hooks = make(Hooks)
+		}
+		o.hooks[phase] = append(o.hooks[phase], hook)
+	}
+}
+
+// WithProgress registers a function receiving the conversion progress events.
+func WithProgress(fn ProgressFunc) ConvertOption {
+	return func(o *convertOptions) {
+		o.progress = fn
+	}
+}
+
+// WithLogger sets the conversion logger: the conversion messages and its commands output are logged to it,
+// e.g. to tell apart the concurrent conversions messages with a field.
+func WithLogger(logger *logrus.Entry) ConvertOption {
+	return func(o *convertOptions) {
+		o.logger = logger
+	}
+}
+
+// WithLimiter waits for the limiter to allow the conversion to run.
+func WithLimiter(l *Limiter) ConvertOption {
+	return func(o *convertOptions) {
+		o.limiter = l
+	}
+}
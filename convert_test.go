@@ -0,0 +1,47 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		formats []string
+		want    []string
+	}{
+		{name: "output format", output: "out/disk0.qcow2", want: []string{"out/disk0.qcow2"}},
+		{name: "no extension", output: "disk0", want: []string{"disk0"}},
+		{name: "formats", output: "out/disk0.qcow2", formats: []string{"qcow2", "vmdk", "VHDX"}, want: []string{"out/disk0.qcow2", "out/disk0.vmdk", "out/disk0.vhdx"}},
+		{name: "other formats", output: "disk0.qcow2", formats: []string{"vmdk", "vmdk"}, want: []string{"disk0.vmdk"}},
+		{name: "raw without extension", output: "disk0", formats: []string{"raw", "qcow2"}, want: []string{"disk0", "disk0.qcow2"}},
+		{name: "compressed raw", output: "out/disk0.raw.zst", formats: []string{"raw.zst", "qcow2", "raw.gz"}, want: []string{"out/disk0.raw.zst", "out/disk0.qcow2", "out/disk0.raw.gz"}},
+		{name: "compressed raw format", output: "out/disk0.qcow2", formats: []string{"raw.xz"}, want: []string{"out/disk0.raw.xz"}},
+		{name: "azure", output: "out/disk0.azure.vhd", formats: []string{"azure.vhd", "vhd"}, want: []string{"out/disk0.azure.vhd", "out/disk0.vhd"}},
+		{name: "ova", output: "out/vm.ova", want: []string{"out/vm.ova"}},
+		{name: "iso", output: "out/live.iso", formats: []string{"iso", "qcow2"}, want: []string{"out/live.iso", "out/live.qcow2"}},
+		{name: "ovf", output: "out/vm.qcow2", formats: []string{"qcow2", "ovf"}, want: []string{"out/vm.qcow2", "out/vm.ovf", "out/vm.mf", "out/vm-disk1.vmdk"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, OutputPaths(tt.output, tt.formats...))
+		})
+	}
+}
@@ -15,21 +15,26 @@
 package d2vm
 
 import (
+	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/google/go-containerregistry/cmd/crane/cmd"
 	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 
+	"go.linka.cloud/d2vm/pkg/archive"
 	"go.linka.cloud/d2vm/pkg/docker"
-	"go.linka.cloud/d2vm/pkg/exec"
 )
 
 const (
@@ -109,26 +114,84 @@ type image struct {
 	Layers   []string `json:"Layers"`
 }
 
-func (i image) Flatten(ctx context.Context, out string) error {
-	if err := os.MkdirAll(out, os.ModePerm); err != nil {
-		return err
-	}
-	tar := filepath.Join(i.dir, "img.tar")
-	f, err := os.Create(tar)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := io.Copy(f, mutate.Extract(i.img)); err != nil {
+func (i image) Flatten(ctx context.Context, out string, progress ProgressFunc) error {
+	r := mutate.Extract(i.img)
+	defer r.Close()
+	var lastLog, lastEvent time.Time
+	var total int64
+	if err := archive.Extract(ctx, r, out, archive.WithProgress(func(n int64) {
+		total = n
+		if time.Since(lastEvent) >= progressInterval {
+			lastEvent = time.Now()
+			progress.emit(Event{Type: EventExtract, Phase: PhaseCopyRootFS, Bytes: uint64(n)})
+		}
+		if time.Since(lastLog) < 5*time.Second {
+			return
+		}
+		lastLog = time.Now()
+		logger(ctx).Infof("extracted %s", humanize.Bytes(uint64(n)))
+	})); err != nil {
 		return err
 	}
-	if err := f.Close(); err != nil {
-		return err
+	progress.emit(Event{Type: EventExtract, Phase: PhaseCopyRootFS, Bytes: uint64(total)})
+	return nil
+}
+
+// diskUsage measures the space used by the flattened image filesystem, without extracting it.
+// The space used under the mounts directories is accounted separately.
+func (i image) diskUsage(ctx context.Context, mounts ...string) (diskUsage, error) {
+	r := mutate.Extract(i.img)
+	defer r.Close()
+	u := diskUsage{mounts: make(map[string]*mountUsage)}
+	for _, v := range mounts {
+		u.mounts[v] = &mountUsage{}
 	}
-	if err := exec.Run(ctx, "tar", "xvf", tar, "-C", out); err != nil {
-		return err
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return u, err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return u, nil
+		}
+		if err != nil {
+			return u, err
+		}
+		var n uint64
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			n = roundUp(uint64(hdr.Size), fsBlockSize)
+		case tar.TypeDir:
+			n = fsBlockSize
+		case tar.TypeSymlink:
+			// short symlinks targets are stored in the inode
+			if len(hdr.Linkname) >= 60 {
+				n = fsBlockSize
+			}
+		case tar.TypeLink:
+			// hardlinks share the inode and the data of their target
+			continue
+		}
+		name := path.Clean("/" + hdr.Name)
+		if m := u.mount(name); m != nil {
+			m.bytes += n
+			m.inodes++
+			continue
+		}
+		u.inodes++
+		if isUnder(name, "/boot") {
+			u.boot += n
+		} else {
+			u.root += n
+		}
 	}
-	return nil
+}
+
+// Export writes the flattened image filesystem as a tar archive to path.
+// tarball returns the stream of the image flattened filesystem tar archive.
+func (i image) tarball() io.ReadCloser {
+	return mutate.Extract(i.img)
 }
 
 func (i image) Close() error {
@@ -149,7 +149,7 @@ RUN rm -rf /etc/apk
 	require.NoError(t, err)
 
 	rootfs := filepath.Join(tmp, "rootfs")
-	require.NoError(t, i.Flatten(ctx, rootfs))
+	require.NoError(t, i.Flatten(ctx, rootfs, nil))
 
 	b, err := os.ReadFile(filepath.Join(rootfs, "etc", "resolv.conf"))
 	require.NoError(t, err)
@@ -15,13 +15,15 @@
 package d2vm
 
 import (
-	_ "embed"
+	"embed"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"text/template"
-
-	"github.com/sirupsen/logrus"
 )
 
 //go:embed templates/ubuntu.Dockerfile
@@ -36,6 +38,12 @@ var alpineDockerfile string
 //go:embed templates/centos.Dockerfile
 var centOSDockerfile string
 
+// initramfsFiles are the initramfs scripts setting up the read-only root filesystem overlay,
+// the dm-verity root device and the luks key file, copied to the docker build context.
+//
+//go:embed templates/overlay templates/verity templates/luks
+var initramfsFiles embed.FS
+
 var (
 	ubuntuDockerfileTemplate = template.Must(template.New("ubuntu.Dockerfile").Funcs(tplFuncs).Parse(ubuntuDockerfile))
 	debianDockerfileTemplate = template.Must(template.New("debian.Dockerfile").Funcs(tplFuncs).Parse(debianDockerfile))
@@ -68,19 +76,102 @@ type Dockerfile struct {
 	Luks           bool
 	GrubBIOS       bool
 	GrubEFI        bool
-	tmpl           *template.Template
+	RootFS         RootFS
+	// Overlay installs the initramfs scripts mounting the read-only root filesystem under an overlayfs.
+	Overlay bool
+	// Verity installs the initramfs scripts opening the dm-verity protected root partition.
+	Verity bool
+	// LuksUnlock installs the luks key file unlocking the root partition at boot.
+	LuksUnlock LuksUnlock
+	// Vagrant sets up the vagrant user: it logs in over ssh with the Vagrant insecure key and uses sudo without password.
+	Vagrant bool
+	// Azure installs the Hyper-V drivers in the initramfs and the Azure provisioning agent.
+	Azure bool
+	// Live installs the live system initramfs support, mounting the root filesystem squashfs image from the iso.
+	Live bool
+	// Netboot installs the network boot initramfs support, fetching the root filesystem over http or mounting it over nfs.
+	Netboot NetbootRoot
+	// luksKeyFile is the luks key file path
+	luksKeyFile string
+	tmpl        *template.Template
 }
 
 func (d Dockerfile) Grub() bool {
 	return d.GrubBIOS || d.GrubEFI
 }
 
+// RootFSTools returns the package providing the root filesystem tools, if it needs to be installed.
+func (d Dockerfile) RootFSTools() string {
+	switch d.RootFS {
+	case RootFSXFS:
+		return "xfsprogs"
+	case RootFSBtrfs:
+		return "btrfs-progs"
+	default:
+		return ""
+	}
+}
+
+// VagrantKey returns the key authorized to log in as the vagrant user.
+func (d Dockerfile) VagrantKey() string {
+	return VagrantInsecureKey
+}
+
 func (d Dockerfile) Render(w io.Writer) error {
 	return d.tmpl.Execute(w, d)
 }
 
-func NewDockerfile(release OSRelease, img, password string, networkManager NetworkManager, luks, grubBIOS, grubEFI bool) (Dockerfile, error) {
-	d := Dockerfile{Release: release, Image: img, Password: password, NetworkManager: networkManager, Luks: luks, GrubBIOS: grubBIOS, GrubEFI: grubEFI}
+// WriteFiles writes the files copied by the Dockerfile to the docker build context directory.
+func (d Dockerfile) WriteFiles(dir string) error {
+	for name, ok := range map[string]bool{"overlay": d.Overlay, "verity": d.Verity, "luks": d.LuksUnlock != ""} {
+		if !ok {
+			continue
+		}
+		src := "templates/" + name
+		if err := fs.WalkDir(initramfsFiles, src, func(path string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			p := filepath.Join(dir, name, strings.TrimPrefix(path, src))
+			if e.IsDir() {
+				return os.MkdirAll(p, os.ModePerm)
+			}
+			b, err := initramfsFiles.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(p, b, 0755)
+		}); err != nil {
+			return err
+		}
+	}
+	// the key file is only part of the image when it is embedded in the initramfs
+	if !d.LuksUnlock.IsInitramfs() {
+		return nil
+	}
+	b, err := os.ReadFile(d.luksKeyFile)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "luks", "root.key"), b, 0400)
+}
+
+// NewDockerfile returns the Dockerfile installing the kernel and the boot requirements in the image.
+// The conversion options set the root filesystem, read-only root, verity, luks unlock, vagrant, azure, iso live and netboot requirements.
+func NewDockerfile(release OSRelease, img, password string, networkManager NetworkManager, luks, grubBIOS, grubEFI bool, opts ...ConvertOption) (Dockerfile, error) {
+	o := &convertOptions{}
+	for _, v := range opts {
+		v(o)
+	}
+	netboot := o.netbootOptions().Root
+	rootFS := o.rootFSType()
+	if rootFS == "" {
+		rootFS = RootFSExt4
+	}
+	if err := rootFS.Validate(); err != nil {
+		return Dockerfile{}, err
+	}
+	d := Dockerfile{Release: release, Image: img, Password: password, NetworkManager: networkManager, Luks: luks, GrubBIOS: grubBIOS, GrubEFI: grubEFI, RootFS: rootFS, Overlay: o.readOnly.IsEnabled(), Verity: o.verity.IsEnabled(), LuksUnlock: o.luksOpts.Unlock, luksKeyFile: o.luksOpts.KeyFile, Vagrant: o.hasFormat("box"), Azure: o.hasFormat(azureFormat), Live: o.hasFormat(isoFormat), Netboot: netboot}
 	var net NetworkManager
 	switch release.ID {
 	case ReleaseDebian:
@@ -102,18 +193,27 @@ func NewDockerfile(release OSRelease, img, password string, networkManager Netwo
 		if networkManager == NetworkManagerNetplan {
 			return d, fmt.Errorf("netplan is not supported on alpine")
 		}
+		if d.Live {
+			return Dockerfile{}, fmt.Errorf("iso output is not supported on alpine")
+		}
+		if netboot != "" {
+			return Dockerfile{}, fmt.Errorf("netboot output is not supported on alpine")
+		}
 	case ReleaseCentOS, ReleaseRocky, ReleaseAlmaLinux:
 		d.tmpl = centOSDockerfileTemplate
 		net = NetworkManagerNone
 		if networkManager != "" && networkManager != NetworkManagerNone {
 			return Dockerfile{}, fmt.Errorf("network manager is not supported on centos")
 		}
+		if rootFS.IsBtrfs() {
+			return Dockerfile{}, fmt.Errorf("btrfs is not supported on centos")
+		}
 	default:
 		return Dockerfile{}, fmt.Errorf("unsupported distribution: %s", release.ID)
 	}
 	if d.NetworkManager == "" {
 		if release.ID != ReleaseCentOS && release.ID != ReleaseRocky && release.ID != ReleaseAlmaLinux {
-			logrus.Warnf("no network manager specified, using distribution defaults: %s", net)
+			o.log().Warnf("no network manager specified, using distribution defaults: %s", net)
 		}
 		d.NetworkManager = net
 	}
@@ -18,15 +18,21 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/c2h5oh/datasize"
+	"github.com/sirupsen/logrus"
 	require2 "github.com/stretchr/testify/require"
 
 	"go.linka.cloud/d2vm"
@@ -35,9 +41,13 @@ import (
 )
 
 type test struct {
-	name string
-	args []string
-	efi  bool
+	name         string
+	args         []string
+	efi          bool
+	btrfs        bool
+	verity       bool
+	iso          bool
+	reproducible bool
 }
 
 type img struct {
@@ -81,15 +91,111 @@ func TestConvert(t *testing.T) {
 			name: "fat32",
 			args: []string{"--split-boot", "--boot-fs=fat32"},
 		},
+		{
+			name: "size-auto",
+			args: []string{"--size=auto+512M"},
+		},
+		{
+			name: "swap",
+			args: []string{"--swap-size=256M"},
+		},
+		{
+			name: "swap-file",
+			args: []string{"--swap-size=256M", "--swap-type=file"},
+		},
+		{
+			name: "layout",
+			args: []string{`--layout={"partitions":[{"mount":"/var","size":"1G"},{"mount":"/home","size":"512M","fs":"xfs"}]}`},
+		},
+		{
+			name: "read-only",
+			args: []string{"--read-only", "--overlay-size=256M"},
+		},
+		{
+			name:   "verity",
+			args:   []string{"--verity", "--squashfs"},
+			verity: true,
+		},
+		{
+			name:   "verity-syslinux",
+			args:   []string{"--verity"},
+			verity: true,
+		},
+		{
+			name:   "verity-grub",
+			args:   []string{"--verity", "--bootloader=grub"},
+			verity: true,
+			efi:    true,
+		},
+		{
+			name: "gpt",
+			args: []string{"--partition-table=gpt"},
+		},
+		{
+			name: "gpt-split-boot",
+			args: []string{"--partition-table=gpt", "--split-boot"},
+		},
+		{
+			name: "xfs",
+			args: []string{"--root-fs=xfs"},
+		},
+		{
+			name:  "btrfs",
+			args:  []string{"--root-fs=btrfs", "--bootloader=grub-bios"},
+			btrfs: true,
+		},
+		{
+			name: "rootless",
+			args: []string{"--rootless"},
+		},
+		{
+			name: "formats",
+			args: []string{"--formats=qcow2,vmdk,vhdx"},
+		},
+		{
+			name: "appliance",
+			args: []string{"--formats=qcow2,ova,ovf", "--appliance-cpus=2", "--appliance-memory=2048", "--appliance-nic=virtio"},
+		},
+		{
+			name: "vagrant",
+			args: []string{"--formats=qcow2,box", "--vagrant-provider=virtualbox"},
+		},
+		{
+			name: "azure",
+			args: []string{"--formats=qcow2,azure.vhd"},
+		},
+		{
+			name: "iso",
+			args: []string{"--formats=qcow2,iso"},
+			iso:  true,
+		},
+		{
+			name: "qcow2-compression",
+			args: []string{"--qcow2-compression=zstd"},
+		},
+		{
+			name:         "reproducible",
+			args:         []string{"--reproducible", "--rootless"},
+			reproducible: true,
+		},
 		{
 			name: "luks",
 			args: []string{"--luks-password=root"},
 		},
+		{
+			name: "luks-unlock",
+			args: []string{"--luks-password=root", "--luks-recovery-password=recovery", "--luks-unlock=initramfs", "--luks-pbkdf=pbkdf2", "--luks-iter-time=100"},
+		},
 		{
 			name: "grub",
 			args: []string{"--bootloader=grub"},
 			efi:  true,
 		},
+		{
+			name: "grub-gpt",
+			args: []string{"--bootloader=grub", "--partition-table=gpt"},
+			efi:  true,
+		},
 		{
 			name: "grub-luks",
 			args: []string{"--bootloader=grub", "--luks-password=root"},
@@ -123,94 +229,199 @@ imgs:
 				if (strings.Contains(img.name, "centos") || strings.Contains(img.name, "almalinux") || strings.Contains(img.name, "rocky")) && tt.efi {
 					t.Skip("efi not supported for CentOS")
 				}
+				if (strings.Contains(img.name, "centos") || strings.Contains(img.name, "almalinux") || strings.Contains(img.name, "rocky")) && tt.btrfs {
+					t.Skip("btrfs not supported for CentOS")
+				}
 				t.Run(img.name, func(t *testing.T) {
-					ctx, cancel := context.WithCancel(context.Background())
-					defer cancel()
-
+					if strings.Contains(img.name, "alpine") && tt.verity {
+						t.Skip("dm-verity not supported for Alpine")
+					}
+					if strings.Contains(img.name, "alpine") && tt.iso {
+						t.Skip("iso not supported for Alpine")
+					}
 					require := require2.New(t)
 
 					out := filepath.Join(dir, strings.NewReplacer(":", "-", ".", "-", "/", "-").Replace(img.name)+".qcow2")
 
-					if _, err := os.Stat(out); err == nil {
-						require.NoError(os.Remove(out))
+					convert := func(out string) {
+						if _, err := os.Stat(out); err == nil {
+							require.NoError(os.Remove(out))
+						}
+						require.NoError(docker.RunD2VM(context.Background(), d2vm.Image, d2vm.Version, dir, dir, "convert", append([]string{"-p", "root", "-o", "/out/" + filepath.Base(out), "-v", "--keep-cache", img.name}, tt.args...)...))
+					}
+					convert(out)
+					if tt.reproducible {
+						// the second conversion reuses the kept docker build cache: it must give the same disk image,
+						// compared before the boot, which writes to the first one
+						rebuild := strings.TrimSuffix(out, ".qcow2") + "-rebuild.qcow2"
+						convert(rebuild)
+						require.Equal(sha256sum(t, out), sha256sum(t, rebuild))
 					}
 
-					require.NoError(docker.RunD2VM(ctx, d2vm.Image, d2vm.Version, dir, dir, "convert", append([]string{"-p", "root", "-o", "/out/" + filepath.Base(out), "-v", "--keep-cache", img.name}, tt.args...)...))
-
-					inr, inw := io.Pipe()
-					defer inr.Close()
-					outr, outw := io.Pipe()
-					defer outw.Close()
-					var success atomic.Bool
-					go func() {
-						time.AfterFunc(2*time.Minute, cancel)
-						defer inw.Close()
-						defer outr.Close()
-						login := []byte("login:")
-						password := []byte("Password:")
-						s := bufio.NewScanner(outr)
-						// fix failed to scan output: bufio.Scanner: token too long
-						s.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
-						s.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-							if i := bytes.Index(data, []byte(img.luks)); i >= 0 {
-								return i + len(img.luks), []byte(img.luks), nil
-							}
-							if i := bytes.Index(data, login); i >= 0 {
-								return i + len(login), login, nil
-							}
-							if i := bytes.Index(data, password); i >= 0 {
-								return i + len(password), password, nil
-							}
-							if atEOF {
-								return 0, nil, io.EOF
-							}
-							return 0, nil, nil
+					boot(t, img, out, tt.efi)
+					if tt.iso {
+						// the hybrid iso boots from a usb stick with the bios and with the efi firmware
+						iso := strings.TrimSuffix(out, ".qcow2") + ".iso"
+						t.Run("iso-bios", func(t *testing.T) {
+							boot(t, img, iso, false)
+						})
+						t.Run("iso-efi", func(t *testing.T) {
+							boot(t, img, iso, true)
 						})
-						for s.Scan() {
-							b := s.Bytes()
-							if bytes.Contains(b, []byte(img.luks)) {
-								t.Logf("sending luks password")
-								if _, err := inw.Write([]byte("root\n")); err != nil {
-									t.Logf("failed to write luks password: %v", err)
-									cancel()
-								}
-							}
-							if bytes.Contains(b, login) {
-								t.Logf("sending login")
-								if _, err := inw.Write([]byte("root\n")); err != nil {
-									t.Logf("failed to write login: %v", err)
-									cancel()
-								}
-							}
-							if bytes.Contains(b, password) {
-								t.Logf("sending password")
-								if _, err := inw.Write([]byte("root\n")); err != nil {
-									t.Logf("failed to write password: %v", err)
-									cancel()
-								}
-								time.Sleep(time.Second)
-								if _, err := inw.Write([]byte("poweroff\n")); err != nil {
-									t.Logf("failed to write poweroff: %v", err)
-									cancel()
-								}
-								success.Store(true)
-								return
-							}
-						}
-						if err := s.Err(); err != nil {
-							t.Logf("failed to scan output: %v", err)
-							cancel()
-						}
-					}()
-					opts := []qemu.Option{qemu.WithStdin(inr), qemu.WithStdout(io.MultiWriter(outw, os.Stdout)), qemu.WithStderr(io.Discard), qemu.WithMemory(2048), qemu.WithCPUs(2)}
-					if tt.efi {
-						opts = append(opts, qemu.WithBios("/usr/share/ovmf/OVMF.fd"))
-					}
-					if err := qemu.Run(ctx, out, opts...); err != nil && !success.Load() {
-						t.Fatalf("failed to run qemu: %v", err)
 					}
 				})
 			}
 		})
 	}
 }
+
+func sha256sum(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require2.NoError(t, err)
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	require2.NoError(t, err)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// boot runs the image in qemu, logs in as root and powers the system off.
+func boot(t *testing.T, img img, path string, efi bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inr, inw := io.Pipe()
+	defer inr.Close()
+	outr, outw := io.Pipe()
+	defer outw.Close()
+	var success atomic.Bool
+	go func() {
+		time.AfterFunc(2*time.Minute, cancel)
+		defer inw.Close()
+		defer outr.Close()
+		login := []byte("login:")
+		password := []byte("Password:")
+		s := bufio.NewScanner(outr)
+		// fix failed to scan output: bufio.Scanner: token too long
+		s.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+		s.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+			if i := bytes.Index(data, []byte(img.luks)); i >= 0 {
+				return i + len(img.luks), []byte(img.luks), nil
+			}
+			if i := bytes.Index(data, login); i >= 0 {
+				return i + len(login), login, nil
+			}
+			if i := bytes.Index(data, password); i >= 0 {
+				return i + len(password), password, nil
+			}
+			if atEOF {
+				return 0, nil, io.EOF
+			}
+			return 0, nil, nil
+		})
+		for s.Scan() {
+			b := s.Bytes()
+			if bytes.Contains(b, []byte(img.luks)) {
+				t.Logf("sending luks password")
+				if _, err := inw.Write([]byte("root\n")); err != nil {
+					t.Logf("failed to write luks password: %v", err)
+					cancel()
+				}
+			}
+			if bytes.Contains(b, login) {
+				t.Logf("sending login")
+				if _, err := inw.Write([]byte("root\n")); err != nil {
+					t.Logf("failed to write login: %v", err)
+					cancel()
+				}
+			}
+			if bytes.Contains(b, password) {
+				t.Logf("sending password")
+				if _, err := inw.Write([]byte("root\n")); err != nil {
+					t.Logf("failed to write password: %v", err)
+					cancel()
+				}
+				time.Sleep(time.Second)
+				if _, err := inw.Write([]byte("poweroff\n")); err != nil {
+					t.Logf("failed to write poweroff: %v", err)
+					cancel()
+				}
+				success.Store(true)
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			t.Logf("failed to scan output: %v", err)
+			cancel()
+		}
+	}()
+	opts := []qemu.Option{qemu.WithStdin(inr), qemu.WithStdout(io.MultiWriter(outw, os.Stdout)), qemu.WithStderr(io.Discard), qemu.WithMemory(2048), qemu.WithCPUs(2)}
+	if efi {
+		opts = append(opts, qemu.WithBios("/usr/share/ovmf/OVMF.fd"))
+	}
+	if err := qemu.Run(ctx, path, opts...); err != nil && !success.Load() {
+		t.Fatalf("failed to run qemu: %v", err)
+	}
+}
+
+// TestConvertParallel runs concurrent conversions in the same process, sharing a limiter.
+// It must run as root, as the conversions use loop devices, device mappings and mounts.
+func TestConvertParallel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("parallel conversions require root")
+	}
+	require := require2.New(t)
+	img := images[0].name
+	if *imgs != "" {
+		img = strings.Split(*imgs, ",")[0]
+	}
+	dir := filepath.Join("/tmp", "d2vm-e2e", "parallel")
+	require.NoError(os.MkdirAll(dir, os.ModePerm))
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	require.NoError(docker.Pull(ctx, "linux/amd64", img))
+
+	builds := [][]d2vm.ConvertOption{
+		{},
+		{d2vm.WithBootFS(d2vm.BootFSFat32)},
+		{d2vm.WithLuksPassword("root")},
+		{d2vm.WithBootFS(d2vm.BootFSFat32), d2vm.WithLuksPassword("root")},
+	}
+	limiter := d2vm.NewLimiter(3)
+	logs := make([]bytes.Buffer, len(builds))
+	errs := make([]error, len(builds))
+	var wg sync.WaitGroup
+	for i, opts := range builds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := logrus.New()
+			l.SetOutput(&logs[i])
+			l.SetLevel(logrus.DebugLevel)
+			out := filepath.Join(dir, fmt.Sprintf("disk%d.qcow2", i))
+			errs[i] = d2vm.Convert(ctx, img, append([]d2vm.ConvertOption{
+				d2vm.WithSize(uint64(datasize.GB)),
+				d2vm.WithPassword("root"),
+				d2vm.WithOutput(out),
+				d2vm.WithBootLoader("syslinux"),
+				// the library does not apply the cli defaults: luks requires a boot partition
+				d2vm.WithSplitBoot(true),
+				d2vm.WithBootSize(100),
+				d2vm.WithPlatform("linux/amd64"),
+				d2vm.WithLogger(l.WithField("build", i)),
+				d2vm.WithLimiter(limiter),
+			}, opts...)...)
+		}()
+	}
+	wg.Wait()
+	for i := range builds {
+		require.NoError(errs[i], "build %d logs:\n%s", i, logs[i].String())
+		require.FileExists(filepath.Join(dir, fmt.Sprintf("disk%d.qcow2", i)))
+		// each conversion only logs its own messages and commands
+		for _, l := range strings.Split(strings.TrimSpace(logs[i].String()), "\n") {
+			require.Contains(l, fmt.Sprintf("build=%d", i))
+		}
+	}
+}
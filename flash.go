@@ -0,0 +1,407 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/google/uuid"
+	"github.com/svenwiltink/sparsecat"
+
+	"go.linka.cloud/d2vm/pkg/compress"
+	"go.linka.cloud/d2vm/pkg/exec"
+	"go.linka.cloud/d2vm/pkg/qemu_img"
+)
+
+var (
+	// sysBlockDir lists the block devices and their partitions.
+	sysBlockDir = "/sys/class/block"
+	procMounts  = "/proc/self/mounts"
+	procSwaps   = "/proc/swaps"
+)
+
+var (
+	// errSystemDisk is returned for the disk holding the system root filesystem: it is never written to, even when forced.
+	errSystemDisk = errors.New("is the system disk")
+	// errMounted is returned for a disk with a mounted filesystem: it is never written to, even when forced.
+	errMounted = errors.New("is mounted")
+)
+
+// Flash writes the disk image to the block device, e.g. /dev/sdb, skipping the image holes,
+// and grows its last partition and filesystem to fill the device.
+// It refuses to write to a used or non-removable disk unless forced, and always refuses the system disk and the mounted disks.
+func Flash(ctx context.Context, img, device string, force bool) error {
+	if err := CheckFlashDevice(ctx, device, force); err != nil {
+		return err
+	}
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return err
+	}
+	switch strings.TrimPrefix(strings.ToLower(formatExt(img)), ".") {
+	case "ova", "ovf", "box":
+		return fmt.Errorf("%s is an appliance, not a disk image", img)
+	}
+	tmpPath := filepath.Join(os.TempDir(), "d2vm", uuid.New().String())
+	if err := os.MkdirAll(tmpPath, os.ModePerm); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+	raw, err := flashRawImage(ctx, img, tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := writeSparse(ctx, raw, dev); err != nil {
+		return err
+	}
+	return growLastPartition(ctx, dev)
+}
+
+// CheckFlashDevice returns an error if the device is not a whole disk block device, or if it is used or not removable,
+// unless forced. The disk holding the system root filesystem and the mounted disks are always refused, including when
+// mounted through the devices built on top of them, e.g. lvm volumes or dm-crypt mappings.
+func CheckFlashDevice(ctx context.Context, device string, force bool) error {
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return err
+	}
+	i, err := os.Stat(dev)
+	if err != nil {
+		return err
+	}
+	if i.Mode()&os.ModeDevice == 0 || i.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", device)
+	}
+	err = checkFlashDisk(filepath.Base(dev))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errSystemDisk), errors.Is(err, errMounted):
+		return err
+	case !force:
+		return fmt.Errorf("%w: use force to write to it anyway", err)
+	}
+	logger(ctx).Warnf("%v: writing to it anyway", err)
+	return nil
+}
+
+// flashRawImage returns the raw disk image of img: the image itself when already raw, or its conversion in dir.
+func flashRawImage(ctx context.Context, img, dir string) (string, error) {
+	raw := filepath.Join(dir, "disk.raw")
+	if _, ok := compress.FromPath(img); ok {
+		logger(ctx).Infof("decompressing %s", img)
+		return raw, compress.Decompress(ctx, img, raw)
+	}
+	i, err := qemu_img.Info(ctx, img)
+	if err != nil {
+		return "", err
+	}
+	// the hybrid iso is written as is
+	if i.Format == "raw" {
+		return img, nil
+	}
+	logger(ctx).Infof("converting %s image to raw", i.Format)
+	return raw, qemu_img.Convert(ctx, "raw", img, raw)
+}
+
+// checkFlashDisk returns an error if the disk is a partition, is mounted or used, holds the system root filesystem,
+// or is not removable. The disk is mounted or used through its partitions, and through the devices built on top of them.
+func checkFlashDisk(name string) error {
+	dir := filepath.Join(sysBlockDir, name)
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		return fmt.Errorf("/dev/%s is a partition, not a disk", name)
+	}
+	devices := make(map[string]bool)
+	holders := stackedDevices(dir, devices)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		if _, err := os.Stat(filepath.Join(dir, v.Name(), "partition")); err != nil {
+			continue
+		}
+		holders = append(holders, stackedDevices(filepath.Join(dir, v.Name()), devices)...)
+	}
+	mounts, err := os.ReadFile(procMounts)
+	if err != nil {
+		return err
+	}
+	var mounted []string
+	for _, l := range strings.Split(string(mounts), "\n") {
+		f := strings.Fields(l)
+		if len(f) < 2 || !devices[resolveDevice(f[0])] {
+			continue
+		}
+		if f[1] == "/" {
+			return fmt.Errorf("/dev/%s %w", name, errSystemDisk)
+		}
+		mounted = append(mounted, f[1])
+	}
+	if len(mounted) != 0 {
+		return fmt.Errorf("/dev/%s %w on %s", name, errMounted, strings.Join(mounted, ", "))
+	}
+	// the swaps file is missing without swap support
+	swaps, _ := os.ReadFile(procSwaps)
+	for _, l := range strings.Split(string(swaps), "\n") {
+		if f := strings.Fields(l); len(f) != 0 && devices[resolveDevice(f[0])] {
+			return fmt.Errorf("/dev/%s is used as swap", name)
+		}
+	}
+	if len(holders) != 0 {
+		return fmt.Errorf("/dev/%s is used by %s", name, strings.Join(holders, ", "))
+	}
+	if !isRemovable(dir) {
+		return fmt.Errorf("/dev/%s is not a removable disk", name)
+	}
+	return nil
+}
+
+// stackedDevices adds the block device in the sysfs dir and the devices built on top of it, transitively,
+// e.g. the dm-crypt mappings and the lvm volumes, to devices. It returns the devices built on top of it.
+func stackedDevices(dir string, devices map[string]bool) []string {
+	name := filepath.Base(dir)
+	if devices["/dev/"+name] {
+		return nil
+	}
+	devices["/dev/"+name] = true
+	// the device-mapper devices are usually referenced by their /dev/mapper name
+	if b, err := os.ReadFile(filepath.Join(dir, "dm", "name")); err == nil {
+		devices["/dev/mapper/"+strings.TrimSpace(string(b))] = true
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "holders"))
+	var holders []string
+	for _, v := range entries {
+		holders = append(holders, "/dev/"+v.Name())
+		holders = append(holders, stackedDevices(filepath.Join(sysBlockDir, v.Name()), devices)...)
+	}
+	return holders
+}
+
+func resolveDevice(path string) string {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// isRemovable reports whether the disk is removable, or attached through USB: many USB disks report themselves as fixed.
+func isRemovable(dir string) bool {
+	if b, err := os.ReadFile(filepath.Join(dir, "removable")); err == nil && strings.TrimSpace(string(b)) == "1" {
+		return true
+	}
+	p, err := filepath.EvalSymlinks(dir)
+	return err == nil && strings.Contains(p, "/usb")
+}
+
+// writeSparse writes the raw image data to the device: the image holes are skipped, the device signatures are wiped first
+// so that no stale partition table or filesystem is found in them.
+func writeSparse(ctx context.Context, img, dev string) error {
+	i, err := os.Stat(img)
+	if err != nil {
+		return err
+	}
+	size, err := blockDeviceSize(dev)
+	if err != nil {
+		return err
+	}
+	if uint64(i.Size()) > size {
+		return fmt.Errorf("%s is too small: %s, the image requires %s", dev, datasize.ByteSize(size).HR(), datasize.ByteSize(i.Size()).HR())
+	}
+	if err := exec.Run(ctx, "wipefs", "--all", dev); err != nil {
+		return err
+	}
+	logger(ctx).Infof("writing %s to %s", img, dev)
+	in, err := os.Open(img)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	d := sparsecat.NewDecoder(sparsecat.NewEncoder(in))
+	// the device cannot be truncated
+	d.DisableFileTruncate = true
+	if _, err := d.WriteTo(out); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", dev, err)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// blockDeviceSize returns the device size in bytes, reported by the kernel in 512 bytes sectors.
+func blockDeviceSize(dev string) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(sysBlockDir, filepath.Base(dev), "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected %s size: %w", dev, err)
+	}
+	return sectors * 512, nil
+}
+
+// partitionDevice returns the partition device path, e.g. /dev/sdb1 or /dev/nvme0n1p1.
+func partitionDevice(dev string, num int) string {
+	if last := dev[len(dev)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", dev, num)
+	}
+	return fmt.Sprintf("%s%d", dev, num)
+}
+
+// growLastPartition grows the last partition to the end of the device, and its filesystem to the partition size.
+// Only the ext4, xfs and btrfs filesystems are grown: the swap, encrypted or read-only last partitions are kept as is.
+func growLastPartition(ctx context.Context, dev string) error {
+	if err := rereadPartitions(ctx, dev); err != nil {
+		return err
+	}
+	o, _, err := exec.RunOut(ctx, "blkid", "-p", "-s", "PTTYPE", "-o", "value", dev)
+	if err != nil || strings.TrimSpace(o) == "" {
+		logger(ctx).Warnf("%s has no partition table: not growing its partitions", dev)
+		return nil
+	}
+	// the gpt backup header is moved to the end of the device
+	if strings.TrimSpace(o) == "gpt" {
+		if err := exec.Run(ctx, "sgdisk", "-e", dev); err != nil {
+			return err
+		}
+	}
+	parts, err := imgPartitions(ctx, dev)
+	if err != nil {
+		return err
+	}
+	var last partition
+	for _, v := range parts {
+		if v.offset >= last.offset {
+			last = v
+		}
+	}
+	if last.num == 0 {
+		logger(ctx).Warnf("%s has no partition: not growing", dev)
+		return nil
+	}
+	part := partitionDevice(dev, last.num)
+	o, _, err = exec.RunOut(ctx, "blkid", "-s", "TYPE", "-o", "value", part)
+	if err != nil {
+		return err
+	}
+	fs := strings.TrimSpace(o)
+	switch fs {
+	case "ext4", "xfs", "btrfs":
+	default:
+		logger(ctx).Warnf("%s is not an ext4, xfs or btrfs filesystem: not growing it", part)
+		return nil
+	}
+	if fs == "ext4" {
+		// the read-only root partition may hold the dm-verity hash tree after its filesystem
+		size, err := ext4Size(ctx, part)
+		if err != nil {
+			return err
+		}
+		if size+uint64(datasize.MB) < last.size {
+			logger(ctx).Warnf("%s filesystem does not fill its partition: not growing it", part)
+			return nil
+		}
+	}
+	logger(ctx).Infof("growing %s partition to fill %s", part, dev)
+	if err := exec.Run(ctx, "parted", "-s", dev, "resizepart", strconv.Itoa(last.num), "100%"); err != nil {
+		return err
+	}
+	if err := rereadPartitions(ctx, dev); err != nil {
+		return err
+	}
+	logger(ctx).Infof("growing %s %s filesystem", part, fs)
+	switch fs {
+	case "ext4":
+		// the filesystem was mounted during the build: resize2fs requires it to be checked first
+		if err := exec.Run(ctx, "e2fsck", "-f", "-y", part); err != nil && !isExitCode(err, 1) {
+			return err
+		}
+		return exec.Run(ctx, "resize2fs", part)
+	default:
+		// xfs and btrfs are only grown when mounted
+		dir, err := os.MkdirTemp("", "d2vm-flash")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := exec.Run(ctx, "mount", part, dir); err != nil {
+			return err
+		}
+		if fs == "xfs" {
+			err = exec.Run(ctx, "xfs_growfs", dir)
+		} else {
+			err = exec.Run(ctx, "btrfs", "filesystem", "resize", "max", dir)
+		}
+		if uerr := exec.Run(ctx, "umount", dir); err == nil {
+			err = uerr
+		}
+		return err
+	}
+}
+
+func rereadPartitions(ctx context.Context, dev string) error {
+	if err := exec.Run(ctx, "partprobe", dev); err != nil {
+		return err
+	}
+	return exec.Run(ctx, "udevadm", "settle")
+}
+
+// ext4Size returns the size of the ext4 filesystem, as reported by its superblock.
+func ext4Size(ctx context.Context, dev string) (uint64, error) {
+	o, _, err := exec.RunOut(ctx, "dumpe2fs", "-h", dev)
+	if err != nil {
+		return 0, err
+	}
+	var count, size uint64
+	for _, l := range strings.Split(o, "\n") {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "Block count":
+			count, err = strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		case "Block size":
+			size, err = strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unexpected dumpe2fs output: %s", l)
+		}
+	}
+	if count == 0 || size == 0 {
+		return 0, fmt.Errorf("%s: ext4 block count or size not found", dev)
+	}
+	return count * size, nil
+}
+
+func isExitCode(err error, code int) bool {
+	var e *osexec.ExitError
+	return errors.As(err, &e) && e.ExitCode() == code
+}
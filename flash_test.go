@@ -0,0 +1,97 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionDevice(t *testing.T) {
+	assert.Equal(t, "/dev/sdb2", partitionDevice("/dev/sdb", 2))
+	assert.Equal(t, "/dev/vda1", partitionDevice("/dev/vda", 1))
+	assert.Equal(t, "/dev/nvme0n1p3", partitionDevice("/dev/nvme0n1", 3))
+	assert.Equal(t, "/dev/mmcblk0p1", partitionDevice("/dev/mmcblk0", 1))
+	assert.Equal(t, "/dev/loop0p2", partitionDevice("/dev/loop0", 2))
+}
+
+func TestCheckFlashDisk(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), perm))
+	}
+	// sda is the system disk, sdb a usb stick, sdc a fixed disk, sdd a removable disk used by device-mapper,
+	// sde a removable disk holding a dm-crypt mapping holding an lvm volume
+	write("sys/sda/removable", "0\n")
+	write("sys/sda/sda1/partition", "1\n")
+	write("sys/sdb/removable", "1\n")
+	write("sys/sdb/sdb1/partition", "1\n")
+	write("sys/sdc/removable", "0\n")
+	write("sys/sdd/removable", "1\n")
+	write("sys/sdd/sdd1/partition", "1\n")
+	write("sys/sdd/sdd1/holders/dm-0", "")
+	write("sys/dm-0/dm/name", "data\n")
+	write("sys/sde/removable", "1\n")
+	write("sys/sde/sde1/partition", "1\n")
+	write("sys/sde/sde1/holders/dm-1", "")
+	write("sys/dm-1/dm/name", "luks-sde1\n")
+	write("sys/dm-1/holders/dm-2", "")
+	write("sys/dm-2/dm/name", "vg-root\n")
+	// the partitions are also listed next to the disks
+	require.NoError(t, os.Symlink(filepath.Join(dir, "sys/sdb/sdb1"), filepath.Join(dir, "sys/sdb1")))
+	defer func(s, m, sw string) { sysBlockDir, procMounts, procSwaps = s, m, sw }(sysBlockDir, procMounts, procSwaps)
+	sysBlockDir, procMounts, procSwaps = filepath.Join(dir, "sys"), filepath.Join(dir, "mounts"), filepath.Join(dir, "swaps")
+
+	tests := []struct {
+		name  string
+		disk  string
+		mount string
+		swap  string
+		err   string
+	}{
+		{name: "removable", disk: "sdb"},
+		{name: "system disk", disk: "sda", err: "/dev/sda is the system disk"},
+		{name: "partition", disk: "sdb1", err: "/dev/sdb1 is a partition, not a disk"},
+		{name: "fixed", disk: "sdc", err: "/dev/sdc is not a removable disk"},
+		{name: "holders", disk: "sdd", err: "/dev/sdd is used by /dev/dm-0"},
+		{name: "mounted", disk: "sdb", mount: "/dev/sdb1 /mnt vfat rw 0 0\n", err: "/dev/sdb is mounted on /mnt"},
+		{name: "mounted holder", disk: "sdd", mount: "/dev/mapper/data /data ext4 rw 0 0\n", err: "/dev/sdd is mounted on /data"},
+		{name: "stacked holders", disk: "sde", err: "/dev/sde is used by /dev/dm-1, /dev/dm-2"},
+		{name: "stacked system disk", disk: "sde", mount: "/dev/mapper/vg-root / ext4 rw 0 0\n", err: "/dev/sde is the system disk"},
+		{name: "swap", disk: "sdb", swap: "/dev/sdb1 partition 1024 0 -2\n", err: "/dev/sdb is used as swap"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write("mounts", "/dev/sda1 / ext4 rw 0 0\n"+tt.mount)
+			write("swaps", "Filename Type Size Used Priority\n"+tt.swap)
+			err := checkFlashDisk(tt.disk)
+			// the system disk and the mounted disks are never written to, even when forced
+			assert.Equal(t, strings.HasSuffix(tt.name, "system disk"), errors.Is(err, errSystemDisk))
+			assert.Equal(t, strings.HasPrefix(tt.name, "mounted"), errors.Is(err, errMounted))
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
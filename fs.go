@@ -16,6 +16,8 @@ package d2vm
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type BootFS string
@@ -56,3 +58,105 @@ func (f BootFS) linux() string {
 		return "ext4"
 	}
 }
+
+type RootFS string
+
+const (
+	RootFSExt4  RootFS = "ext4"
+	RootFSXFS   RootFS = "xfs"
+	RootFSBtrfs RootFS = "btrfs"
+)
+
+// btrfsSubvolumes is the subvolumes layout created on btrfs root filesystems, parents first.
+var btrfsSubvolumes = []struct {
+	name string
+	path string
+}{
+	{name: "@", path: "/"},
+	{name: "@home", path: "/home"},
+}
+
+func (f RootFS) String() string {
+	return string(f)
+}
+
+func (f RootFS) IsExt() bool {
+	return f == RootFSExt4
+}
+
+func (f RootFS) IsXFS() bool {
+	return f == RootFSXFS
+}
+
+func (f RootFS) IsBtrfs() bool {
+	return f == RootFSBtrfs
+}
+
+func (f RootFS) IsSupported() bool {
+	return f.IsExt() || f.IsXFS() || f.IsBtrfs()
+}
+
+func (f RootFS) Validate() error {
+	if !f.IsSupported() {
+		return fmt.Errorf("invalid root filesystem: %s valid filesystems are: ext4, xfs, btrfs", f)
+	}
+	return nil
+}
+
+func (f RootFS) mkfs() string {
+	return "mkfs." + f.String()
+}
+
+// RootFSOptions tunes the creation of the root filesystem.
+type RootFSOptions struct {
+	// Label is the filesystem label.
+	Label string
+	// InodeRatio is the bytes-per-inode ratio, ext4 only.
+	InodeRatio uint64
+	// ReservedBlocks is the percentage of the filesystem blocks reserved for the super-user, ext4 only.
+	// The mkfs default is used when nil.
+	ReservedBlocks *float64
+	// Features is the list of filesystem features to enable, or to disable when prefixed with '^', ext4 only.
+	Features []string
+}
+
+func (o RootFSOptions) Validate(fs RootFS) error {
+	if !fs.IsExt() && (o.InodeRatio != 0 || o.ReservedBlocks != nil || len(o.Features) != 0) {
+		return fmt.Errorf("inode ratio, reserved blocks and features are only supported on ext4 root filesystem")
+	}
+	if fs.IsXFS() && len(o.Label) > 12 {
+		return fmt.Errorf("xfs label must be at most 12 characters long")
+	}
+	if fs.IsExt() && len(o.Label) > 16 {
+		return fmt.Errorf("ext4 label must be at most 16 characters long")
+	}
+	if o.ReservedBlocks != nil && (*o.ReservedBlocks < 0 || *o.ReservedBlocks > 50) {
+		return fmt.Errorf("reserved blocks percentage must be between 0 and 50")
+	}
+	return nil
+}
+
+// args returns the mkfs arguments for the filesystem.
+func (o RootFSOptions) args(fs RootFS) []string {
+	var args []string
+	if !fs.IsExt() {
+		// xfs and btrfs refuse to overwrite an existing filesystem signature
+		args = append(args, "-f")
+	}
+	if o.Label != "" {
+		args = append(args, "-L", o.Label)
+	}
+	if !fs.IsExt() {
+		return args
+	}
+	if o.InodeRatio != 0 {
+		args = append(args, "-i", strconv.FormatUint(o.InodeRatio, 10))
+	}
+	if o.ReservedBlocks != nil {
+		args = append(args, "-m", strconv.FormatFloat(*o.ReservedBlocks, 'f', -1, 64))
+	}
+	if len(o.Features) != 0 {
+		args = append(args, "-O", strings.Join(o.Features, ","))
+	}
+	return args
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootFSOptionsArgs(t *testing.T) {
+	reserved := 0.5
+	none := 0.0
+	tests := []struct {
+		name string
+		fs   RootFS
+		opts RootFSOptions
+		want []string
+	}{
+		{name: "ext4 defaults", fs: RootFSExt4},
+		{
+			name: "ext4",
+			fs:   RootFSExt4,
+			opts: RootFSOptions{Label: "root", InodeRatio: 65536, ReservedBlocks: &reserved, Features: []string{"^has_journal", "metadata_csum"}},
+			want: []string{"-L", "root", "-i", "65536", "-m", "0.5", "-O", "^has_journal,metadata_csum"},
+		},
+		{
+			name: "ext4 no reserved blocks",
+			fs:   RootFSExt4,
+			opts: RootFSOptions{ReservedBlocks: &none},
+			want: []string{"-m", "0"},
+		},
+		{name: "xfs defaults", fs: RootFSXFS, want: []string{"-f"}},
+		{name: "xfs", fs: RootFSXFS, opts: RootFSOptions{Label: "root"}, want: []string{"-f", "-L", "root"}},
+		{name: "btrfs", fs: RootFSBtrfs, opts: RootFSOptions{Label: "root"}, want: []string{"-f", "-L", "root"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.opts.args(tt.fs))
+		})
+	}
+}
+
+func TestRootFSOptionsValidate(t *testing.T) {
+	reserved := 5.0
+	negative := -1.0
+	tooMany := 51.0
+	tests := []struct {
+		name    string
+		fs      RootFS
+		opts    RootFSOptions
+		wantErr bool
+	}{
+		{name: "ext4", fs: RootFSExt4, opts: RootFSOptions{Label: "root", InodeRatio: 16384, ReservedBlocks: &reserved, Features: []string{"^has_journal"}}},
+		{name: "ext4 label", fs: RootFSExt4, opts: RootFSOptions{Label: "0123456789abcdef"}},
+		{name: "ext4 label too long", fs: RootFSExt4, opts: RootFSOptions{Label: "0123456789abcdefg"}, wantErr: true},
+		{name: "negative reserved blocks", fs: RootFSExt4, opts: RootFSOptions{ReservedBlocks: &negative}, wantErr: true},
+		{name: "too many reserved blocks", fs: RootFSExt4, opts: RootFSOptions{ReservedBlocks: &tooMany}, wantErr: true},
+		{name: "xfs label", fs: RootFSXFS, opts: RootFSOptions{Label: "0123456789ab"}},
+		{name: "xfs label too long", fs: RootFSXFS, opts: RootFSOptions{Label: "0123456789abc"}, wantErr: true},
+		{name: "btrfs label", fs: RootFSBtrfs, opts: RootFSOptions{Label: "0123456789abcdefg"}},
+		{name: "xfs inode ratio", fs: RootFSXFS, opts: RootFSOptions{InodeRatio: 16384}, wantErr: true},
+		{name: "btrfs reserved blocks", fs: RootFSBtrfs, opts: RootFSOptions{ReservedBlocks: &reserved}, wantErr: true},
+		{name: "xfs features", fs: RootFSXFS, opts: RootFSOptions{Features: []string{"bigtime"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate(tt.fs)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
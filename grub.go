@@ -17,8 +17,6 @@ package d2vm
 import (
 	"context"
 	"fmt"
-
-	"github.com/sirupsen/logrus"
 )
 
 type grub struct {
@@ -35,7 +33,7 @@ func (g grub) Validate(fs BootFS) error {
 }
 
 func (g grub) Setup(ctx context.Context, dev, root string, cmdline string) error {
-	logrus.Infof("setting up grub bootloader")
+	logger(ctx).Infof("setting up grub bootloader")
 	clean, err := g.prepare(ctx, dev, root, cmdline)
 	if err != nil {
 		return err
@@ -58,7 +56,7 @@ type grubProvider struct {
 }
 
 func (g grubProvider) New(c Config, r OSRelease, arch string) (Bootloader, error) {
-	if arch != "x86_64" {
+	if arch != archAMD64 {
 		return nil, fmt.Errorf("grub is only supported for amd64")
 	}
 	if r.ID == ReleaseCentOS || r.ID == ReleaseRocky || r.ID == ReleaseAlmaLinux {
@@ -17,8 +17,6 @@ package d2vm
 import (
 	"context"
 	"fmt"
-
-	"github.com/sirupsen/logrus"
 )
 
 type grubBios struct {
@@ -30,7 +28,7 @@ func (g grubBios) Validate(_ BootFS) error {
 }
 
 func (g grubBios) Setup(ctx context.Context, dev, root string, cmdline string) error {
-	logrus.Infof("setting up grub bootloader")
+	logger(ctx).Infof("setting up grub bootloader")
 	clean, err := g.prepare(ctx, dev, root, cmdline)
 	if err != nil {
 		return err
@@ -50,7 +48,7 @@ type grubBiosProvider struct {
 }
 
 func (g grubBiosProvider) New(c Config, r OSRelease, arch string) (Bootloader, error) {
-	if arch != "x86_64" {
+	if arch != archAMD64 {
 		return nil, fmt.Errorf("grub-bios is only supported for amd64")
 	}
 	return grubBios{grubCommon: newGrubCommon(c, r)}, nil
@@ -20,8 +20,6 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/sirupsen/logrus"
-
 	"go.linka.cloud/d2vm/pkg/exec"
 )
 
@@ -68,7 +66,7 @@ func (g *grubCommon) prepare(ctx context.Context, dev, root, cmdline string) (cl
 	clean = func() {
 		for _, v := range unmounts {
 			if err := exec.Run(ctx, "umount", filepath.Join(root, v)); err != nil {
-				logrus.Errorf("failed to unmount /%s: %s", v, err)
+				logger(ctx).Errorf("failed to unmount /%s: %s", v, err)
 			}
 		}
 	}
@@ -17,8 +17,6 @@ package d2vm
 import (
 	"context"
 	"fmt"
-
-	"github.com/sirupsen/logrus"
 )
 
 type grubEFI struct {
@@ -36,7 +34,7 @@ func (g grubEFI) Validate(fs BootFS) error {
 }
 
 func (g grubEFI) Setup(ctx context.Context, dev, root string, cmdline string) error {
-	logrus.Infof("setting up grub-efi bootloader")
+	logger(ctx).Infof("setting up grub-efi bootloader")
 	clean, err := g.prepare(ctx, dev, root, cmdline)
 	if err != nil {
 		return err
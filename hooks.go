@@ -0,0 +1,181 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Phase is a step of the disk image build. The hooks registered for a phase run once the phase completed.
+type Phase string
+
+const (
+	// PhaseMakeImg creates the raw disk image and its partition table.
+	PhaseMakeImg Phase = "make-img"
+	// PhaseMount attaches the disk image, creates and mounts the filesystems.
+	// In rootless builds, it prepares the staging directory.
+	PhaseMount Phase = "mount"
+	// PhaseCopyRootFS copies the image filesystem to the mount point.
+	PhaseCopyRootFS Phase = "copy-rootfs"
+	// PhaseSetupRootFS writes the fstab, hostname, hosts and resolv.conf files.
+	// Its hooks are the last ones to change the root filesystem content.
+	PhaseSetupRootFS Phase = "setup-rootfs"
+	// PhaseInstallBootloader installs the bootloader. The root filesystem is complete before it:
+	// its files timestamps are clamped, the rootless builds write it to the disk image, dm-verity hashes it
+	// and makes it read-only, and the live, netboot and microvm root filesystems are made from it after it.
+	// Its hooks changes to the root filesystem are not part of all the artifacts: make them in the setup-rootfs hooks.
+	PhaseInstallBootloader Phase = "install-bootloader"
+	// PhaseUnmount unmounts the filesystems and detaches the disk image.
+	PhaseUnmount Phase = "unmount"
+	// PhaseConvert converts the raw disk image to the output format.
+	PhaseConvert Phase = "convert"
+)
+
+var phases = []Phase{
+	PhaseMakeImg,
+	PhaseMount,
+	PhaseCopyRootFS,
+	PhaseSetupRootFS,
+	PhaseInstallBootloader,
+	PhaseUnmount,
+	PhaseConvert,
+}
+
+func (p Phase) String() string {
+	return string(p)
+}
+
+func (p Phase) Validate() error {
+	for _, v := range phases {
+		if p == v {
+			return nil
+		}
+	}
+	var s []string
+	for _, v := range phases {
+		s = append(s, v.String())
+	}
+	return fmt.Errorf("invalid build phase: %s valid phases are: %s", p, strings.Join(s, ", "))
+}
+
+// Phases returns the build phases, in execution order.
+func Phases() []Phase {
+	return phases[:]
+}
+
+// Hook is a function called once a build phase completed.
+// Returning an error aborts the build.
+type Hook func(ctx context.Context, c BuildContext) error
+
+// Hooks are the hooks to run, by phase.
+type Hooks map[Phase][]Hook
+
+func (h Hooks) Validate() error {
+	for k := range h {
+		if err := k.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildContext describes the disk image being built. The fields are set as soon as they are known,
+// e.g. the devices once the image is mounted and the UUIDs once the root filesystem is set up.
+type BuildContext struct {
+	// Phase is the phase that just completed.
+	Phase Phase
+	// Disk is the path of the raw disk image.
+	Disk string
+	// Output is the path of the disk image converted to the first output format, written by the convert phase.
+	Output string
+	// Outputs are the paths of the converted disk images, by format.
+	Outputs map[string]string
+	// MountPoint is the directory where the root filesystem is mounted, or its staging directory in rootless builds.
+	MountPoint string
+	// Device is the loop device the disk image is attached to. It is empty in rootless builds.
+	Device string
+	// BootPartition is the boot partition device, if the boot partition is split from the root partition.
+	BootPartition string
+	// RootPartition is the root partition device.
+	RootPartition string
+	// RootDevice is the device holding the root filesystem: the LUKS mapped device if the root partition
+	// is encrypted, the root partition otherwise.
+	RootDevice string
+	// Partitions are the layout partitions devices, by mount point.
+	Partitions map[string]string
+	// SwapPartition is the swap partition device, if the swap is a partition.
+	SwapPartition string
+	// OverlayPartition is the read-only root filesystem overlay partition device, if the overlay is a partition.
+	OverlayPartition string
+	// BootUUID is the boot filesystem UUID.
+	BootUUID string
+	// RootUUID is the root filesystem UUID.
+	RootUUID string
+	// CryptUUID is the LUKS partition UUID, if the root partition is encrypted.
+	CryptUUID string
+	// VerityRootHash is the dm-verity root hash, once the root partition hash tree is computed.
+	VerityRootHash string
+	// Rootless is true when the image is built without loop devices nor mounts.
+	Rootless bool
+}
+
+func (b *builder) buildContext(phase Phase) BuildContext {
+	c := BuildContext{
+		Phase:            phase,
+		Disk:             b.diskRaw,
+		Output:           b.outPath(b.formats[0]),
+		Outputs:          make(map[string]string),
+		MountPoint:       b.mntPoint,
+		Device:           b.loDevice,
+		SwapPartition:    b.swapPart,
+		OverlayPartition: b.overlayPart,
+		BootUUID:         b.bootUUID,
+		RootUUID:         b.rootUUID,
+		CryptUUID:        b.cryptUUID,
+		VerityRootHash:   b.verityRootHash,
+		Rootless:         b.rootless,
+	}
+	for _, v := range b.formats {
+		c.Outputs[v] = b.outPath(v)
+	}
+	if b.splitBoot {
+		c.BootPartition = b.bootPart
+	}
+	if len(b.layoutParts) != 0 {
+		c.Partitions = make(map[string]string)
+		for _, v := range b.layoutParts {
+			c.Partitions[v.Mount] = v.dev
+		}
+	}
+	c.RootPartition, c.RootDevice = b.rootPart, b.rootDev()
+	return c
+}
+
+func (b *builder) runHooks(ctx context.Context, phase Phase) error {
+	hooks := b.hooks[phase]
+	if len(hooks) == 0 {
+		return nil
+	}
+	logger(ctx).Infof("running %s hooks", phase)
+	c := b.buildContext(phase)
+	for _, v := range hooks {
+		if err := v(ctx, c); err != nil {
+			return fmt.Errorf("%s hook: %w", phase, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhases(t *testing.T) {
+	assert.Equal(t, []Phase{PhaseMakeImg, PhaseMount, PhaseCopyRootFS, PhaseSetupRootFS, PhaseInstallBootloader, PhaseUnmount, PhaseConvert}, Phases())
+	for _, v := range Phases() {
+		assert.NoError(t, v.Validate())
+	}
+	assert.NoError(t, Hooks{PhaseConvert: nil}.Validate())
+	assert.Error(t, Hooks{"finalize": nil}.Validate())
+}
+
+func TestRunHooks(t *testing.T) {
+	var calls []string
+	hook := func(name string, err error) Hook {
+		return func(ctx context.Context, c BuildContext) error {
+			calls = append(calls, name+":"+c.Phase.String())
+			return err
+		}
+	}
+	b := &builder{formats: []string{"raw"}, hooks: Hooks{
+		PhaseSetupRootFS: {hook("first", nil), hook("second", nil)},
+		PhaseConvert:     {hook("failing", errors.New("failed")), hook("skipped", nil)},
+	}}
+	ctx := context.Background()
+	require.NoError(t, b.runHooks(ctx, PhaseMount))
+	assert.Empty(t, calls)
+	// the hooks run in registration order
+	require.NoError(t, b.runHooks(ctx, PhaseSetupRootFS))
+	assert.Equal(t, []string{"first:setup-rootfs", "second:setup-rootfs"}, calls)
+	// a failing hook aborts the build: the next ones do not run
+	calls = nil
+	assert.EqualError(t, b.runHooks(ctx, PhaseConvert), "convert hook: failed")
+	assert.Equal(t, []string{"failing:convert"}, calls)
+}
+
+func TestBuildContext(t *testing.T) {
+	b := &builder{
+		diskRaw:         "/tmp/d2vm/disk.raw",
+		diskOut:         "/out/disk",
+		formats:         []string{"qcow2", "vmdk"},
+		mntPoint:        "/tmp/d2vm/mnt",
+		loDevice:        "/dev/loop0",
+		bootPart:        "/dev/mapper/loop0p1",
+		rootPart:        "/dev/mapper/loop0p2",
+		swapPart:        "/dev/mapper/loop0p3",
+		mappedCryptRoot: "/dev/mapper/d2vm-root",
+		layoutParts:     []*layoutPart{{LayoutPartition: LayoutPartition{Mount: "/var"}, dev: "/dev/mapper/loop0p4"}},
+		bootUUID:        "boot-uuid",
+		rootUUID:        "root-uuid",
+		cryptUUID:       "crypt-uuid",
+	}
+	c := b.buildContext(PhaseSetupRootFS)
+	assert.Equal(t, BuildContext{
+		Phase:         PhaseSetupRootFS,
+		Disk:          "/tmp/d2vm/disk.raw",
+		Output:        "/out/disk.qcow2",
+		Outputs:       map[string]string{"qcow2": "/out/disk.qcow2", "vmdk": "/out/disk.vmdk"},
+		MountPoint:    "/tmp/d2vm/mnt",
+		Device:        "/dev/loop0",
+		RootPartition: "/dev/mapper/loop0p2",
+		RootDevice:    "/dev/mapper/loop0p2",
+		Partitions:    map[string]string{"/var": "/dev/mapper/loop0p4"},
+		SwapPartition: "/dev/mapper/loop0p3",
+		BootUUID:      "boot-uuid",
+		RootUUID:      "root-uuid",
+		CryptUUID:     "crypt-uuid",
+	}, c)
+
+	// the boot partition is only set when split, the root device is the mapped one when encrypted
+	b.splitBoot, b.luksPassword, b.layoutParts = true, "root", nil
+	c = b.buildContext(PhaseInstallBootloader)
+	assert.Equal(t, "/dev/mapper/loop0p1", c.BootPartition)
+	assert.Equal(t, "/dev/mapper/loop0p2", c.RootPartition)
+	assert.Equal(t, "/dev/mapper/d2vm-root", c.RootDevice)
+	assert.Nil(t, c.Partitions)
+}
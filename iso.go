@@ -0,0 +1,292 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+const (
+	isoFormat = "iso"
+	// isoLabel is the iso volume label, used by the live initramfs and the efi bootloader to find the iso
+	isoLabel = "D2VM_LIVE"
+
+	liveKernel = "/live/vmlinuz"
+	liveInitrd = "/live/initrd.img"
+)
+
+const isolinuxCfg = `DEFAULT live
+  SAY Now booting the live system from ISOLINUX...
+ LABEL live
+  KERNEL %s
+  APPEND %s
+`
+
+const isoGrubCfg = `set timeout=0
+set default=0
+
+menuentry "live" {
+  linux %s %s
+  initrd %s
+}
+`
+
+// isoGrubEFICfg is embedded in the standalone efi grub image: it loads the iso grub configuration.
+const isoGrubEFICfg = `search --no-floppy --set=root --label ` + isoLabel + `
+set prefix=($root)/boot/grub
+configfile ($root)/boot/grub/grub.cfg
+`
+
+var isolinuxDirs = []string{
+	// debian and ubuntu paths
+	"/usr/lib/ISOLINUX",
+	"/usr/lib/syslinux/modules/bios",
+	// alpine, centos and archlinux paths
+	"/usr/share/syslinux",
+	"/usr/lib/syslinux/bios",
+}
+
+// isolinuxFile returns the host path of the isolinux file.
+func isolinuxFile(name string) (string, error) {
+	for _, v := range isolinuxDirs {
+		p := filepath.Join(v, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found", name)
+}
+
+func (b *builder) isoDir() string {
+	return filepath.Join(filepath.Dir(b.mntPoint), "iso")
+}
+
+// liveSquashFS returns the iso path of the root filesystem squashfs image, where the live initramfs looks for it.
+func (b *builder) liveSquashFS() string {
+	switch b.osRelease.ID {
+	case ReleaseCentOS, ReleaseRocky, ReleaseAlmaLinux:
+		return "/LiveOS/squashfs.img"
+	default:
+		return "/live/filesystem.squashfs"
+	}
+}
+
+// liveCmdline returns the live system kernel command line: the root filesystem is the squashfs image found on the iso
+// by live-boot on debian and ubuntu, or by the dracut dmsquash-live module on centos.
+func (b *builder) liveCmdline() string {
+	c := b.config
+	c.Initrd = liveInitrd
+	c.RootFS = "squashfs"
+	switch b.osRelease.ID {
+	case ReleaseCentOS, ReleaseRocky, ReleaseAlmaLinux:
+		return c.Cmdline(RootPath("live:CDLABEL="+isoLabel), "rd.live.image", "rd.live.overlay.overlayfs=1", b.cmdLineExtra)
+	default:
+		return c.Cmdline(nil, "boot=live", b.cmdLineExtra)
+	}
+}
+
+func (b *builder) validateLive() error {
+	if !b.hasFormat(isoFormat) {
+		return nil
+	}
+	if b.osRelease.ID == ReleaseAlpine {
+		return fmt.Errorf("iso output is not supported on %s", b.osRelease.ID)
+	}
+	return nil
+}
+
+// bootFile returns the path of the kernel or of the initramfs in the root filesystem: the Config path,
+// or the most recent versioned one when the bootloader kept the versioned files.
+func (b *builder) bootFile(path string, pattern string) (string, error) {
+	if _, err := os.Stat(b.chPath(path)); err == nil {
+		return b.chPath(path), nil
+	}
+	m, err := filepath.Glob(b.chPath(filepath.Join("/boot", pattern)))
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	mtimes := make(map[string]time.Time)
+	for _, v := range m {
+		// the rescue and kdump initramfs are not the default ones
+		if strings.Contains(v, "rescue") || strings.Contains(v, "kdump") {
+			continue
+		}
+		i, err := os.Stat(v)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, v)
+		mtimes[v] = i.ModTime()
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("%s not found", path)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return mtimes[files[i]].After(mtimes[files[j]])
+	})
+	return files[0], nil
+}
+
+// makeLiveRootFS stages the live system files in the iso directory: the root filesystem squashfs image,
+// the kernel and the initramfs. The disk partitions are not mounted by the live system.
+func (b *builder) makeLiveRootFS(ctx context.Context) error {
+	if !b.hasFormat(isoFormat) {
+		return nil
+	}
+	logger(ctx).Infof("creating live squashfs root file system")
+	dir := b.isoDir()
+	sq := filepath.Join(dir, b.liveSquashFS())
+	for _, v := range []string{filepath.Dir(sq), filepath.Join(dir, filepath.Dir(liveKernel))} {
+		if err := os.MkdirAll(v, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	exclude := []string{"boot/*", "etc/fstab", "etc/crypttab"}
+	if b.hasSwapFile() {
+		exclude = append(exclude, strings.TrimPrefix(swapFilePath, "/"))
+	}
+	if err := b.mksquashfs(ctx, sq, exclude...); err != nil {
+		return err
+	}
+	kernel, err := b.bootFile(b.config.Kernel, "vmlinuz-*")
+	if err != nil {
+		return err
+	}
+	initrd, err := b.bootFile(b.config.Initrd, ifElse(b.osRelease.ID == ReleaseCentOS || b.osRelease.ID == ReleaseRocky || b.osRelease.ID == ReleaseAlmaLinux, "initramfs-*.img", "initrd.img-*"))
+	if err != nil {
+		return err
+	}
+	if err := copyFile(kernel, filepath.Join(dir, liveKernel)); err != nil {
+		return err
+	}
+	return copyFile(initrd, filepath.Join(dir, liveInitrd))
+}
+
+// makeISO writes the hybrid iso, booting from a cd or from a usb stick, with isolinux on bios and with grub on efi.
+func (b *builder) makeISO(ctx context.Context, path string) error {
+	dir := b.isoDir()
+	defer os.RemoveAll(dir)
+	cmdline := b.liveCmdline()
+	args := []string{"-as", "mkisofs", "-iso-level", "3", "-full-iso9660-filenames", "-joliet", "-rational-rock", "-volid", isoLabel}
+	if b.arch == archAMD64 {
+		logger(ctx).Infof("setting up isolinux bootloader")
+		mbr, err := isolinuxFile("isohdpfx.bin")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "isolinux"), os.ModePerm); err != nil {
+			return err
+		}
+		for _, v := range []string{"isolinux.bin", "ldlinux.c32"} {
+			p, err := isolinuxFile(v)
+			if err != nil {
+				return err
+			}
+			if err := copyFile(p, filepath.Join(dir, "isolinux", v)); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, "isolinux", "isolinux.cfg"), []byte(fmt.Sprintf(isolinuxCfg, liveKernel, cmdline)), perm); err != nil {
+			return err
+		}
+		args = append(args,
+			"-isohybrid-mbr", mbr,
+			"-eltorito-boot", "isolinux/isolinux.bin", "-eltorito-catalog", "isolinux/boot.cat",
+			"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table",
+			"-eltorito-alt-boot",
+		)
+	}
+	logger(ctx).Infof("setting up grub efi bootloader")
+	if err := b.makeISOEFI(ctx, dir, cmdline); err != nil {
+		return err
+	}
+	args = append(args, "-e", "EFI/efiboot.img", "-no-emul-boot")
+	if b.arch == archAMD64 {
+		args = append(args, "-isohybrid-gpt-basdat")
+	}
+	logger(ctx).Infof("creating iso image")
+	return exec.Run(ctx, "xorriso", append(args, "-output", path, dir)...)
+}
+
+// makeISOEFI writes the grub configuration and the efi system partition image holding the standalone grub efi binary.
+func (b *builder) makeISOEFI(ctx context.Context, dir, cmdline string) error {
+	target, name := "x86_64-efi", "BOOTX64.EFI"
+	if b.arch == archARM64 {
+		target, name = "arm64-efi", "BOOTAA64.EFI"
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "boot", "grub"), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "boot", "grub", "grub.cfg"), []byte(fmt.Sprintf(isoGrubCfg, liveKernel, cmdline, liveInitrd)), perm); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "efi")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	cfg := filepath.Join(tmp, "grub.cfg")
+	if err := os.WriteFile(cfg, []byte(isoGrubEFICfg), perm); err != nil {
+		return err
+	}
+	bin := filepath.Join(tmp, name)
+	if err := exec.Run(ctx, "grub-mkstandalone", "--format="+target, "--output="+bin, "--locales=", "--fonts=", "boot/grub/grub.cfg="+cfg); err != nil {
+		return err
+	}
+	i, err := os.Stat(bin)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "EFI"), os.ModePerm); err != nil {
+		return err
+	}
+	img := filepath.Join(dir, "EFI", "efiboot.img")
+	// the fat image holds the efi binary and the filesystem metadata
+	args := append(b.mkfsIDArgs(string(BootFSFat32), "iso/efi"), "-C", img, fmt.Sprint(i.Size()/1024+1024))
+	if err := exec.Run(ctx, "mkfs.fat", args...); err != nil {
+		return err
+	}
+	if err := exec.Run(ctx, "mmd", "-i", img, "::/EFI", "::/EFI/BOOT"); err != nil {
+		return err
+	}
+	return exec.Run(ctx, "mcopy", "-i", img, bin, "::/EFI/BOOT/"+name)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
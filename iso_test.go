@@ -0,0 +1,81 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveCmdline(t *testing.T) {
+	tests := []struct {
+		name     string
+		release  OSRelease
+		squashfs string
+		want     []string
+	}{
+		{
+			name:     "ubuntu",
+			release:  OSRelease{ID: ReleaseUbuntu, VersionID: "22.04"},
+			squashfs: "/live/filesystem.squashfs",
+			want:     []string{"initrd=/live/initrd.img", "rootfstype=squashfs", "boot=live", "quiet"},
+		},
+		{
+			name:     "centos",
+			release:  OSRelease{ID: ReleaseCentOS, VersionID: "8"},
+			squashfs: "/LiveOS/squashfs.img",
+			want:     []string{"initrd=/live/initrd.img", "root=live:CDLABEL=D2VM_LIVE", "rd.live.image", "rd.live.overlay.overlayfs=1", "quiet"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.release.Config()
+			require.NoError(t, err)
+			b := &builder{osRelease: tt.release, config: config, cmdLineExtra: "quiet"}
+			assert.Equal(t, tt.squashfs, b.liveSquashFS())
+			fields := strings.Fields(b.liveCmdline())
+			for _, v := range tt.want {
+				assert.Contains(t, fields, v)
+			}
+		})
+	}
+}
+
+func TestLiveDockerfile(t *testing.T) {
+	for r, module := range map[OSRelease]string{
+		{ID: ReleaseUbuntu, VersionID: "22.04"}: "live-boot",
+		{ID: ReleaseDebian, VersionID: "12"}:    "live-boot",
+		{ID: ReleaseCentOS, VersionID: "8"}:     "--add dmsquash-live",
+	} {
+		t.Run(string(r.ID), func(t *testing.T) {
+			for _, live := range []bool{false, true} {
+				var opts []ConvertOption
+				if live {
+					opts = append(opts, WithFormats(isoFormat))
+				}
+				d, err := NewDockerfile(r, "img", "", NetworkManagerNone, false, false, false, opts...)
+				require.NoError(t, err)
+				var b strings.Builder
+				require.NoError(t, d.Render(&b))
+				assert.Equal(t, live, strings.Contains(b.String(), module))
+			}
+		})
+	}
+	_, err := NewDockerfile(OSRelease{ID: ReleaseAlpine, VersionID: "3.18"}, "img", "", "", false, false, false, WithFormats(isoFormat))
+	assert.Error(t, err)
+}
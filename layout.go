@@ -0,0 +1,397 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"go.uber.org/multierr"
+	"gopkg.in/yaml.v3"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+const layoutFSFat32 = "fat32"
+
+// Layout describes the disk partitions.
+// The root partition is always created and uses the disk space left by the other partitions.
+// A /boot partition splits the boot partition from the root partition, the other partitions are
+// created after the root partition and mounted in the root filesystem, so that the matching image
+// subtree lands on its own partition.
+type Layout struct {
+	Partitions []LayoutPartition `json:"partitions" yaml:"partitions"`
+}
+
+type LayoutPartition struct {
+	// Mount is the partition mount point: / for the root partition, /boot for the boot partition.
+	Mount string `json:"mount" yaml:"mount"`
+	// Size is the partition size, e.g. 2G. It cannot be set for the root partition.
+	Size datasize.ByteSize `json:"size,omitempty" yaml:"size,omitempty"`
+	// FS is the partition filesystem: ext4, xfs, btrfs or fat32, defaults to ext4.
+	FS string `json:"fs,omitempty" yaml:"fs,omitempty"`
+	// Label is the filesystem label.
+	Label string `json:"label,omitempty" yaml:"label,omitempty"`
+	// Options are the mount options, defaults to the filesystem defaults.
+	Options string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// ParseLayout parses a YAML or JSON layout specification.
+func ParseLayout(b []byte) (Layout, error) {
+	var l Layout
+	if err := yaml.Unmarshal(b, &l); err != nil {
+		return Layout{}, fmt.Errorf("invalid layout: %w", err)
+	}
+	return l, l.Validate()
+}
+
+// LoadLayout reads the YAML or JSON layout specification from path.
+func LoadLayout(path string) (Layout, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Layout{}, err
+	}
+	return ParseLayout(b)
+}
+
+func (l Layout) IsZero() bool {
+	return len(l.Partitions) == 0
+}
+
+func (l Layout) Validate() error {
+	mounts := make(map[string]struct{})
+	for _, v := range l.Partitions {
+		if !path.IsAbs(v.Mount) || path.Clean(v.Mount) != v.Mount {
+			return fmt.Errorf("invalid layout partition mount point: %q must be a clean absolute path", v.Mount)
+		}
+		if _, ok := mounts[v.Mount]; ok {
+			return fmt.Errorf("invalid layout: duplicated %s partition", v.Mount)
+		}
+		mounts[v.Mount] = struct{}{}
+		if strings.ContainsAny(v.Options, " \t\n") || strings.ContainsAny(v.Label, "\t\n") {
+			return fmt.Errorf("invalid layout partition %s: options and label must not contain whitespaces", v.Mount)
+		}
+		switch v.Mount {
+		case "/":
+			if v.Size != 0 {
+				return fmt.Errorf("invalid layout: the root partition size cannot be set, it uses the remaining disk space")
+			}
+			if v.FS != "" {
+				if err := RootFS(v.FS).Validate(); err != nil {
+					return err
+				}
+			}
+		case "/boot":
+			if v.FS != "" {
+				if err := BootFS(v.FS).Validate(); err != nil {
+					return err
+				}
+			}
+			if v.Label != "" || v.Options != "" {
+				return fmt.Errorf("invalid layout: the boot partition label and options cannot be set")
+			}
+		default:
+			if v.Size < datasize.MB {
+				return fmt.Errorf("invalid layout partition %s: size must be at least 1MiB", v.Mount)
+			}
+			if fs := v.fs(); fs != layoutFSFat32 && !RootFS(fs).IsSupported() {
+				return fmt.Errorf("invalid layout partition %s: invalid filesystem: %s valid filesystems are: ext4, xfs, btrfs, fat32", v.Mount, fs)
+			}
+		}
+	}
+	return nil
+}
+
+func (l Layout) partition(mount string) (LayoutPartition, bool) {
+	for _, v := range l.Partitions {
+		if v.Mount == mount {
+			return v, true
+		}
+	}
+	return LayoutPartition{}, false
+}
+
+// mounts returns the mount points of the partitions created after the root partition.
+func (l Layout) mounts() []string {
+	var mounts []string
+	for _, v := range l.Partitions {
+		if v.Mount != "/" && v.Mount != "/boot" {
+			mounts = append(mounts, v.Mount)
+		}
+	}
+	return mounts
+}
+
+func (p LayoutPartition) fs() string {
+	if p.FS == "" {
+		return RootFSExt4.String()
+	}
+	return p.FS
+}
+
+func (p LayoutPartition) isFat() bool {
+	return p.fs() == layoutFSFat32
+}
+
+// minSize returns the smallest partition size able to hold data bytes in inodes files.
+func (p LayoutPartition) minSize(data, inodes uint64) uint64 {
+	if p.isFat() {
+		// fat32 needs at least 65525 clusters
+		return max(div(data, 0.95)+mib, 33*mib)
+	}
+	return RootFS(p.fs()).minSize(data, inodes, RootFSOptions{})
+}
+
+// layoutPart is a partition created after the root partition.
+type layoutPart struct {
+	LayoutPartition
+	num int
+	// start and end are the partition boundaries in MiB
+	start uint64
+	end   uint64
+	dev   string
+	uuid  string
+	// fatID is the fat volume id chosen by the rootless build
+	fatID string
+}
+
+// mkfs creates the partition filesystem on dev, with the extra mkfs arguments.
+func (p *layoutPart) mkfs(ctx context.Context, dev string, extra ...string) error {
+	if p.isFat() {
+		args := []string{"-F32"}
+		if p.Label != "" {
+			args = append(args, "-n", p.Label)
+		}
+		return exec.Run(ctx, "mkfs.fat", append(append(args, extra...), dev)...)
+	}
+	fs := RootFS(p.fs())
+	args := append(RootFSOptions{Label: p.Label}.args(fs), extra...)
+	return exec.Run(ctx, fs.mkfs(), append(args, dev)...)
+}
+
+func (p *layoutPart) fstab() string {
+	fs, opts, pass := p.fs(), p.Options, 0
+	if p.isFat() {
+		fs = BootFSFat32.linux()
+	}
+	if opts == "" {
+		opts = ifElse(p.isFat(), "umask=0077", "defaults")
+	}
+	if RootFS(fs).IsExt() {
+		pass = 2
+	}
+	return fmt.Sprintf("UUID=%s %s %s %s 0 %d\n", p.uuid, p.Mount, fs, opts, pass)
+}
+
+// setupLayout applies the layout to the builder. It must be called once the disk size is known.
+func (b *builder) setupLayout() error {
+	var parts []*layoutPart
+	for i, v := range b.layout.mounts() {
+		p, _ := b.layout.partition(v)
+		parts = append(parts, &layoutPart{LayoutPartition: p, num: b.rootPartNum() + 1 + i})
+	}
+	// the partitions following the root partition are allocated from the end of the disk,
+	// before the verity, overlay and swap partitions and the GPT backup header
+	end := b.size/mib - 1
+	if b.hasOverlayPart() {
+		end = b.overlayStartMiB()
+	} else if b.hasSwapPart() {
+		end = b.swapStartMiB()
+	}
+	if b.hasVerityPart() {
+		end = b.setupVerity(end)
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		parts[i].end = end
+		parts[i].start = end - roundUp(uint64(parts[i].Size), mib)/mib
+		end = parts[i].start
+	}
+	if (len(parts) != 0 || b.hasVerityPart()) && end <= b.bootSize {
+		return fmt.Errorf("the disk is too small for the layout partitions")
+	}
+	b.layoutParts = parts
+	return nil
+}
+
+// rootEndMiB returns the root partition end, or 0 if it is the last partition.
+func (b *builder) rootEndMiB() uint64 {
+	if len(b.layoutParts) != 0 {
+		return b.layoutParts[0].start
+	}
+	if b.hasVerityPart() {
+		return b.verityStart
+	}
+	if b.hasOverlayPart() {
+		return b.overlayStartMiB()
+	}
+	if b.hasSwapPart() {
+		return b.swapStartMiB()
+	}
+	return 0
+}
+
+// mountOrder returns the layout partitions sorted by mount point, parents first.
+func (b *builder) mountOrder() []*layoutPart {
+	parts := append([]*layoutPart{}, b.layoutParts...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Mount < parts[j].Mount
+	})
+	return parts
+}
+
+func (b *builder) mountLayout(ctx context.Context) error {
+	for _, v := range b.mountOrder() {
+		logger(ctx).Infof("creating %s file system", v.Mount)
+		v.dev = b.partPath(v.num)
+		if err := v.mkfs(ctx, v.dev, b.mkfsIDArgs(v.fs(), "layout"+v.Mount)...); err != nil {
+			return err
+		}
+		p := b.chPath(v.Mount)
+		if err := os.MkdirAll(p, os.ModePerm); err != nil {
+			return err
+		}
+		if err := exec.Run(ctx, "mount", v.dev, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builder) unmountLayout(ctx context.Context) error {
+	var merr error
+	parts := b.mountOrder()
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i].dev == "" {
+			continue
+		}
+		merr = multierr.Append(merr, exec.Run(ctx, "umount", b.chPath(parts[i].Mount)))
+	}
+	return merr
+}
+
+func (b *builder) resolveLayoutUUIDs(ctx context.Context) (err error) {
+	for _, v := range b.layoutParts {
+		if v.uuid, err = diskUUID(ctx, v.dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builder) layoutFstab() string {
+	var sb strings.Builder
+	for _, v := range b.mountOrder() {
+		sb.WriteString(v.fstab())
+	}
+	return sb.String()
+}
+
+// prepareLayoutRootless chooses the layout filesystems UUIDs.
+func (b *builder) prepareLayoutRootless() (err error) {
+	for _, v := range b.layoutParts {
+		if !v.isFat() {
+			v.uuid = b.newUUID("layout" + v.Mount)
+			continue
+		}
+		if v.fatID, v.uuid, err = b.fatVolumeID("layout" + v.Mount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// populateLayoutRootless creates the layout filesystems in the disk image from their staging
+// directories, children first, and empties the directories so that their content does not land
+// in the parent filesystem.
+func (b *builder) populateLayoutRootless(ctx context.Context, parts map[int]partition) error {
+	order := b.mountOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		v := order[i]
+		part, ok := parts[v.num]
+		if !ok {
+			return fmt.Errorf("%s partition %d not found", v.Mount, v.num)
+		}
+		logger(ctx).Infof("creating %s file system", v.Mount)
+		dir := b.chPath(v.Mount)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		if v.isFat() {
+			args := []string{"-F32", "-i", v.fatID, "--offset", strconv.FormatUint(part.offset/512, 10)}
+			if v.Label != "" {
+				args = append(args, "-n", v.Label)
+			}
+			if err := exec.Run(ctx, "mkfs.fat", append(args, b.diskRaw, strconv.FormatUint(part.size/1024, 10))...); err != nil {
+				return err
+			}
+			if err := mcopyDir(ctx, b.diskRaw, part.offset, dir); err != nil {
+				return err
+			}
+		} else {
+			args := append([]string{"-F", "-U", v.uuid, "-d", dir}, b.ext4Extended("layout"+v.Mount, fmt.Sprintf("offset=%d", part.offset))...)
+			args = append(args, RootFSOptions{Label: v.Label}.args(RootFSExt4)...)
+			if err := b.fakeroot(ctx, "mkfs.ext4", append(args, b.diskRaw, fmt.Sprintf("%dk", part.size/1024))...); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateLayout checks the layout partitions against the builder options.
+func (b *builder) validateLayout() error {
+	n := b.rootPartNum() + len(b.layout.mounts())
+	for _, v := range []bool{b.hasVerityPart(), b.hasOverlayPart(), b.hasSwapPart()} {
+		if v {
+			n++
+		}
+	}
+	if b.partitionTable.IsMSDOS() && n > 4 {
+		return fmt.Errorf("msdos partition table supports up to 4 partitions, use gpt instead")
+	}
+	if len(b.layout.mounts()) == 0 {
+		return nil
+	}
+	if b.luksPassword != "" {
+		return fmt.Errorf("layout partitions are not supported with luks encryption")
+	}
+	for _, v := range b.layout.mounts() {
+		p, _ := b.layout.partition(v)
+		if b.rootless && !p.isFat() && !RootFS(p.fs()).IsExt() {
+			return fmt.Errorf("rootless build only supports ext4 and fat32 layout partitions")
+		}
+		if !b.rootFS.IsBtrfs() {
+			continue
+		}
+		for _, s := range btrfsSubvolumes {
+			if s.path == v {
+				return fmt.Errorf("layout partition %s conflicts with the btrfs %s subvolume", v, s.name)
+			}
+		}
+	}
+	return nil
+}
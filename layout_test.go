@@ -0,0 +1,70 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLayout(t *testing.T) {
+	want := Layout{Partitions: []LayoutPartition{
+		{Mount: "/boot", FS: "fat32", Size: 200 * datasize.MB},
+		{Mount: "/", FS: "xfs", Label: "root"},
+		{Mount: "/var", Size: 2 * datasize.GB, Options: "noatime"},
+		{Mount: "/srv/data", Size: 512 * datasize.MB, FS: "btrfs"},
+	}}
+	yml := `
+partitions:
+- mount: /boot
+  fs: fat32
+  size: 200M
+- mount: /
+  fs: xfs
+  label: root
+- mount: /var
+  size: 2G
+  options: noatime
+- mount: /srv/data
+  size: 512M
+  fs: btrfs
+`
+	l, err := ParseLayout([]byte(yml))
+	require.NoError(t, err)
+	assert.Equal(t, want, l)
+	assert.Equal(t, []string{"/var", "/srv/data"}, l.mounts())
+
+	b, err := json.Marshal(l)
+	require.NoError(t, err)
+	l, err = ParseLayout(b)
+	require.NoError(t, err)
+	assert.Equal(t, want, l)
+
+	for _, v := range []string{
+		`{"partitions": [{"mount": "/", "size": "1G"}]}`,
+		`{"partitions": [{"mount": "/var"}]}`,
+		`{"partitions": [{"mount": "var", "size": "1G"}]}`,
+		`{"partitions": [{"mount": "/var", "size": "1G"}, {"mount": "/var", "size": "1G"}]}`,
+		`{"partitions": [{"mount": "/var", "size": "1G", "fs": "ntfs"}]}`,
+		`{"partitions": [{"mount": "/boot", "fs": "xfs"}]}`,
+	} {
+		_, err := ParseLayout([]byte(v))
+		assert.Error(t, err, v)
+	}
+}
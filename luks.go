@@ -0,0 +1,266 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// LuksUnlock is where the key file unlocking the root partition at boot is stored.
+type LuksUnlock string
+
+const (
+	// LuksUnlockInitramfs embeds the key file in the initramfs.
+	LuksUnlockInitramfs LuksUnlock = "initramfs"
+	// LuksUnlockBoot stores the key file on the boot partition.
+	LuksUnlockBoot LuksUnlock = "boot"
+)
+
+const (
+	// luksKeyPath is the path of the key file embedded in the debian, ubuntu and centos root filesystem and initramfs
+	luksKeyPath = "/etc/cryptsetup-keys.d/root.key"
+	// luksAlpineKeyPath is the key file path expected by alpine's initramfs cryptkey option
+	luksAlpineKeyPath = "/crypto_keyfile.bin"
+	// luksBootKeyPath is the path of the key file in the boot partition
+	luksBootKeyPath = "/root.key"
+	// luksKeySize is the size of the generated key files
+	luksKeySize = 4096
+)
+
+var luksPBKDFs = []string{"pbkdf2", "argon2i", "argon2id"}
+
+func (u LuksUnlock) String() string {
+	return string(u)
+}
+
+func (u LuksUnlock) IsInitramfs() bool {
+	return u == LuksUnlockInitramfs
+}
+
+func (u LuksUnlock) IsBoot() bool {
+	return u == LuksUnlockBoot
+}
+
+func (u LuksUnlock) IsSupported() bool {
+	return u.IsInitramfs() || u.IsBoot()
+}
+
+func (u LuksUnlock) Validate() error {
+	if !u.IsSupported() {
+		return fmt.Errorf("invalid luks unlock: %s valid values are: initramfs, boot", u)
+	}
+	return nil
+}
+
+// LuksOptions configures the LUKS encryption of the root partition, beside its passphrase.
+type LuksOptions struct {
+	// RecoveryPassword is an additional passphrase, stored in its own key slot.
+	RecoveryPassword string
+	// KeyFile is the path of a key file, stored in its own key slot. It is generated
+	// by Convert if Unlock is set and KeyFile is not.
+	KeyFile string
+	// Unlock stores the key file in the initramfs or in the boot partition,
+	// so that the root partition is unlocked at boot without typing the passphrase.
+	Unlock LuksUnlock
+	// Cipher is the encryption cipher, e.g. aes-xts-plain64, defaults to the cryptsetup default.
+	Cipher string
+	// KeySize is the encryption key size in bits, defaults to the cryptsetup default.
+	KeySize int
+	// PBKDF is the key slots password based key derivation function: pbkdf2, argon2i or argon2id,
+	// defaults to the cryptsetup default.
+	PBKDF string
+	// PBKDFMemory is the argon2 memory cost in KiB.
+	PBKDFMemory uint64
+	// IterTime is the number of milliseconds spent in the key derivation function.
+	IterTime uint64
+}
+
+func (o LuksOptions) IsZero() bool {
+	return o == LuksOptions{}
+}
+
+func (o LuksOptions) Validate() error {
+	if o.Unlock != "" {
+		if err := o.Unlock.Validate(); err != nil {
+			return err
+		}
+	}
+	if o.KeySize%8 != 0 {
+		return fmt.Errorf("luks key size must be a multiple of 8 bits")
+	}
+	if o.PBKDF != "" {
+		valid := false
+		for _, v := range luksPBKDFs {
+			if valid = v == o.PBKDF; valid {
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid luks pbkdf: %s valid pbkdfs are: pbkdf2, argon2i, argon2id", o.PBKDF)
+		}
+	}
+	if o.PBKDFMemory != 0 && o.PBKDF == "pbkdf2" {
+		return fmt.Errorf("luks pbkdf memory cost is only supported by argon2i and argon2id")
+	}
+	return nil
+}
+
+// pbkdfArgs returns the cryptsetup key slots arguments.
+func (o LuksOptions) pbkdfArgs() []string {
+	var args []string
+	if o.PBKDF != "" {
+		args = append(args, "--pbkdf", o.PBKDF)
+	}
+	if o.PBKDFMemory != 0 {
+		args = append(args, "--pbkdf-memory", strconv.FormatUint(o.PBKDFMemory, 10))
+	}
+	if o.IterTime != 0 {
+		args = append(args, "--iter-time", strconv.FormatUint(o.IterTime, 10))
+	}
+	return args
+}
+
+// formatArgs returns the cryptsetup luksFormat arguments.
+func (o LuksOptions) formatArgs() []string {
+	var args []string
+	if o.Cipher != "" {
+		args = append(args, "--cipher", o.Cipher)
+	}
+	if o.KeySize != 0 {
+		args = append(args, "--key-size", strconv.Itoa(o.KeySize))
+	}
+	return append(args, o.pbkdfArgs()...)
+}
+
+// generateLuksKey writes a random key file to path.
+func generateLuksKey(path string) error {
+	b := make([]byte, luksKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0400)
+}
+
+// addLuksKeys adds the recovery passphrase and the key file to the root partition key slots,
+// unlocked with the passphrase stored in key.
+func (b *builder) addLuksKeys(ctx context.Context, key string) error {
+	if b.luksOpts.RecoveryPassword != "" {
+		logger(ctx).Infof("adding luks recovery passphrase")
+		f, err := os.CreateTemp("", "key")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString(b.luksOpts.RecoveryPassword); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := b.luksAddKey(ctx, key, f.Name()); err != nil {
+			return err
+		}
+	}
+	if b.luksOpts.KeyFile == "" {
+		return nil
+	}
+	logger(ctx).Infof("adding luks key file")
+	return b.luksAddKey(ctx, key, b.luksOpts.KeyFile)
+}
+
+func (b *builder) luksAddKey(ctx context.Context, key, newKey string) error {
+	args := append([]string{"luksAddKey", "--batch-mode", "--key-file", key}, b.luksOpts.pbkdfArgs()...)
+	return exec.Run(ctx, "cryptsetup", append(args, b.cryptPart, newKey)...)
+}
+
+// installLuksKey copies the key file to the boot partition.
+func (b *builder) installLuksKey() error {
+	if !b.luksOpts.Unlock.IsBoot() {
+		return nil
+	}
+	k, err := os.ReadFile(b.luksOpts.KeyFile)
+	if err != nil {
+		return err
+	}
+	return b.chWriteFile("/boot"+luksBootKeyPath, string(k), 0400)
+}
+
+// luksCrypttab returns the crypttab entry of the encrypted root partition.
+func (b *builder) luksCrypttab() string {
+	key := "none"
+	switch b.luksOpts.Unlock {
+	case LuksUnlockInitramfs:
+		key = luksKeyPath
+	case LuksUnlockBoot:
+		key = fmt.Sprintf("%s:UUID=%s", luksBootKeyPath, b.bootUUID)
+	}
+	return fmt.Sprintf("root UUID=%s %s luks\n", b.cryptUUID, key)
+}
+
+// luksKeyCmdline returns the kernel parameters used by the centos initramfs to find the key file.
+func (b *builder) luksKeyCmdline() string {
+	switch b.luksOpts.Unlock {
+	case LuksUnlockInitramfs:
+		return "rd.luks.key=" + luksKeyPath
+	case LuksUnlockBoot:
+		return fmt.Sprintf("rd.luks.key=%s:UUID=%s", luksBootKeyPath, b.bootUUID)
+	default:
+		return ""
+	}
+}
+
+// luksCryptopts returns the debian and ubuntu initramfs cryptopts key options.
+func (b *builder) luksCryptopts() string {
+	switch b.luksOpts.Unlock {
+	case LuksUnlockInitramfs:
+		// the key file content is passed to cryptsetup as is
+		return "key=" + luksKeyPath + ",keyscript=/bin/cat"
+	case LuksUnlockBoot:
+		return fmt.Sprintf("key=/dev/disk/by-uuid/%s:%s,keyscript=/lib/cryptsetup/scripts/passdev", b.bootUUID, luksBootKeyPath)
+	default:
+		return "key=none"
+	}
+}
+
+func (b *builder) validateLuks() error {
+	if !b.isLuksEnabled() {
+		if !b.luksOpts.IsZero() {
+			return fmt.Errorf("luks options require a luks password")
+		}
+		return nil
+	}
+	if err := b.luksOpts.Validate(); err != nil {
+		return err
+	}
+	if b.luksOpts.Unlock != "" && b.luksOpts.KeyFile == "" {
+		return fmt.Errorf("luks unlock requires a key file")
+	}
+	if b.luksOpts.KeyFile != "" {
+		if _, err := os.Stat(b.luksOpts.KeyFile); err != nil {
+			return fmt.Errorf("luks key file: %w", err)
+		}
+	}
+	if b.luksOpts.Unlock.IsBoot() && b.osRelease.ID == ReleaseAlpine {
+		return fmt.Errorf("luks key file on the boot partition is not supported on %s, use initramfs", b.osRelease.ID)
+	}
+	return nil
+}
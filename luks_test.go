@@ -0,0 +1,53 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLuksOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    LuksOptions
+		args    []string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{
+			name: "all",
+			opts: LuksOptions{Cipher: "aes-xts-plain64", KeySize: 512, PBKDF: "argon2id", PBKDFMemory: 65536, IterTime: 1000},
+			args: []string{"--cipher", "aes-xts-plain64", "--key-size", "512", "--pbkdf", "argon2id", "--pbkdf-memory", "65536", "--iter-time", "1000"},
+		},
+		{name: "unlock", opts: LuksOptions{Unlock: LuksUnlockBoot}},
+		{name: "invalid unlock", opts: LuksOptions{Unlock: "tpm"}, wantErr: true},
+		{name: "invalid key size", opts: LuksOptions{KeySize: 255}, wantErr: true},
+		{name: "invalid pbkdf", opts: LuksOptions{PBKDF: "scrypt"}, wantErr: true},
+		{name: "pbkdf2 memory", opts: LuksOptions{PBKDF: "pbkdf2", PBKDFMemory: 1024}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.args, tt.opts.formatArgs())
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// microVMRoot is the root filesystem image device, the first virtio block device of Firecracker and cloud-hypervisor.
+const microVMRoot = "/dev/vda"
+
+// MicroVMPaths returns the paths of the microVM artifacts written by Convert for the output path:
+// the kernel, the initramfs, the root filesystem image and the Firecracker configuration, named after the output file.
+func MicroVMPaths(output string) []string {
+	o := &convertOptions{output: output, outputKind: OutputKindMicroVM}
+	return o.artifacts(filepath.Dir(output))
+}
+
+func microVMFiles(base string) []string {
+	return []string{base + ".vmlinuz", base + ".initrd.img", base + ".ext4", base + ".json"}
+}
+
+// firecrackerConfig is the Firecracker configuration file, also describing the cloud-hypervisor kernel, initramfs,
+// command line and disk arguments.
+type firecrackerConfig struct {
+	BootSource firecrackerBootSource `json:"boot-source"`
+	Drives     []firecrackerDrive    `json:"drives"`
+}
+
+type firecrackerBootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	InitrdPath      string `json:"initrd_path"`
+	BootArgs        string `json:"boot_args"`
+}
+
+type firecrackerDrive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+func (b *builder) validateMicroVM() error {
+	if !b.outputKind.IsMicroVM() {
+		return nil
+	}
+	if !b.rootFS.IsExt() {
+		return fmt.Errorf("microvm output requires an ext4 root filesystem")
+	}
+	if b.luksPassword != "" {
+		return fmt.Errorf("microvm output is not supported with luks encryption")
+	}
+	if b.readOnly.IsEnabled() || b.verity.IsEnabled() {
+		return fmt.Errorf("microvm output is not supported with a read-only root filesystem")
+	}
+	if b.hasSwapPart() {
+		return fmt.Errorf("microvm output does not support swap partition, use a swap file")
+	}
+	return nil
+}
+
+// microVMCmdline returns the microVM kernel command line, generated from the distribution Config:
+// the root filesystem is the whole first virtio block device, and the console is the serial port.
+func (b *builder) microVMCmdline(name string) string {
+	c := b.config
+	c.Initrd = filepath.Base(microVMFiles(name)[1])
+	c.RootFS = RootFSExt4
+	// the virtual machine exits on reboot and panic
+	return c.Cmdline(RootPath(microVMRoot), "reboot=k", "panic=1", b.cmdLineExtra)
+}
+
+// microVMFstab returns the microVM fstab: the partitions of the disk image are all part of the root filesystem image.
+func (b *builder) microVMFstab() string {
+	fstab := fmt.Sprintf("%s / %s %s 0 1\n", microVMRoot, RootFSExt4, b.rootMountOptions("defaults"))
+	if b.hasSwapFile() {
+		fstab += b.swapFstab()
+	}
+	return fstab
+}
+
+// makeMicroVMRootFS writes the microVM artifacts but the configuration in the workdir, named after the disk image:
+// the partitionless root filesystem image, holding the mounted partitions content, the kernel and the initramfs.
+func (b *builder) makeMicroVMRootFS(ctx context.Context) error {
+	if !b.outputKind.IsMicroVM() {
+		return nil
+	}
+	files := microVMFiles(b.diskOut)
+	kernel, err := b.bootFile(b.config.Kernel, "vmlinuz-*")
+	if err != nil {
+		return err
+	}
+	initrd, err := b.bootFile(b.config.Initrd, ifElse(b.osRelease.ID == ReleaseCentOS || b.osRelease.ID == ReleaseRocky || b.osRelease.ID == ReleaseAlmaLinux, "initramfs-*.img", "initrd.img-*"))
+	if err != nil {
+		return err
+	}
+	if err := copyFile(kernel, files[0]); err != nil {
+		return err
+	}
+	if err := copyFile(initrd, files[1]); err != nil {
+		return err
+	}
+	// the disk image is not written: its fstab is replaced with the microVM one
+	if err := b.chWriteFile("/etc/fstab", b.microVMFstab(), perm); err != nil {
+		return err
+	}
+	if err := b.clampTimestamps(ctx, b.chPath("/etc/fstab")); err != nil {
+		return err
+	}
+	logger(ctx).Infof("creating microvm root file system")
+	args := append([]string{"-F", "-U", b.rootUUID, "-d", b.mntPoint}, b.ext4Extended("microvm")...)
+	args = append(args, b.rootFSOpts.args(RootFSExt4)...)
+	args = append(args, files[2], fmt.Sprintf("%dk", b.size/1024))
+	// the rootless staging directory ownership is only known by fakeroot
+	if b.rootless {
+		return b.fakeroot(ctx, "mkfs.ext4", args...)
+	}
+	return exec.Run(ctx, "mkfs.ext4", args...)
+}
+
+// makeMicroVM writes the Firecracker configuration, the other artifacts being written before the root filesystem is unmounted.
+// The artifacts paths are relative to the configuration directory.
+func (b *builder) makeMicroVM(ctx context.Context) error {
+	logger(ctx).Infof("writing microvm configuration")
+	files := microVMFiles(b.diskOut)
+	c := firecrackerConfig{
+		BootSource: firecrackerBootSource{
+			KernelImagePath: filepath.Base(files[0]),
+			InitrdPath:      filepath.Base(files[1]),
+			BootArgs:        strings.TrimSpace(b.microVMCmdline(filepath.Base(b.diskOut))),
+		},
+		Drives: []firecrackerDrive{{DriveID: "rootfs", PathOnHost: filepath.Base(files[2]), IsRootDevice: true}},
+	}
+	out, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(files[3], append(out, '\n'), perm)
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMicroVMPaths(t *testing.T) {
+	assert.Equal(t, []string{"out/vm.vmlinuz", "out/vm.initrd.img", "out/vm.ext4", "out/vm.json"}, MicroVMPaths("out/vm"))
+	assert.Equal(t, []string{"vm.vmlinuz", "vm.initrd.img", "vm.ext4", "vm.json"}, MicroVMPaths("vm.json"))
+	assert.Equal(t, []string{"disk0.vmlinuz", "disk0.initrd.img", "disk0.ext4", "disk0.json"}, MicroVMPaths("disk0.qcow2"))
+}
+
+func TestMicroVM(t *testing.T) {
+	r := OSRelease{ID: ReleaseDebian, VersionID: "12"}
+	config, err := r.Config()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	b := &builder{osRelease: r, config: config, rootFS: RootFSExt4, outputKind: OutputKindMicroVM, diskOut: filepath.Join(dir, "vm"), cmdLineExtra: "quiet"}
+	require.NoError(t, b.validateMicroVM())
+
+	fields := strings.Fields(b.microVMCmdline("vm"))
+	for _, v := range []string{"root=/dev/vda", "rootfstype=ext4", "initrd=vm.initrd.img", "console=ttyS0,115200n8", "reboot=k", "panic=1", "quiet"} {
+		assert.Contains(t, fields, v)
+	}
+	assert.Equal(t, "/dev/vda / ext4 defaults 0 1\n", b.microVMFstab())
+
+	require.NoError(t, b.makeMicroVM(context.Background()))
+	data, err := os.ReadFile(filepath.Join(dir, "vm.json"))
+	require.NoError(t, err)
+	var c firecrackerConfig
+	require.NoError(t, json.Unmarshal(data, &c))
+	assert.Equal(t, "vm.vmlinuz", c.BootSource.KernelImagePath)
+	assert.Equal(t, "vm.initrd.img", c.BootSource.InitrdPath)
+	assert.Contains(t, c.BootSource.BootArgs, "root=/dev/vda")
+	assert.Equal(t, []firecrackerDrive{{DriveID: "rootfs", PathOnHost: "vm.ext4", IsRootDevice: true}}, c.Drives)
+
+	b.rootFS = RootFSXFS
+	assert.Error(t, b.validateMicroVM())
+	b.rootFS = RootFSExt4
+	b.swapType, b.swapSize = SwapPartition, 1024
+	assert.Error(t, b.validateMicroVM())
+	b.swapType = SwapFile
+	assert.NoError(t, b.validateMicroVM())
+	assert.Equal(t, "/dev/vda / ext4 defaults 0 1\n/swapfile none swap sw 0 0\n", b.microVMFstab())
+}
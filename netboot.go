@@ -0,0 +1,239 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// NetbootRoot is the way the network booted system mounts its root filesystem.
+type NetbootRoot string
+
+const (
+	// NetbootRootHTTP fetches the root filesystem squashfs image over HTTP and mounts it under a writable overlay in memory.
+	NetbootRootHTTP NetbootRoot = "http"
+	// NetbootRootNFS mounts the root filesystem from an NFS export, where the root filesystem archive is extracted.
+	NetbootRootNFS NetbootRoot = "nfs"
+)
+
+func (r NetbootRoot) String() string {
+	return string(r)
+}
+
+func (r NetbootRoot) IsHTTP() bool {
+	return r == NetbootRootHTTP
+}
+
+func (r NetbootRoot) IsNFS() bool {
+	return r == NetbootRootNFS
+}
+
+func (r NetbootRoot) IsSupported() bool {
+	return r.IsHTTP() || r.IsNFS()
+}
+
+func (r NetbootRoot) Validate() error {
+	if !r.IsSupported() {
+		return fmt.Errorf("invalid netboot root: %s valid roots are: http, nfs", r)
+	}
+	return nil
+}
+
+// NetbootOptions configures the network boot artifacts.
+type NetbootOptions struct {
+	// Root is the root filesystem source, defaults to http.
+	Root NetbootRoot
+	// URL is the base URL the artifacts are served from with http, e.g. http://10.0.0.1/d2vm,
+	// or the NFS export the root filesystem archive is extracted to with nfs, e.g. 10.0.0.1:/srv/d2vm/ubuntu.
+	URL string
+}
+
+func (o NetbootOptions) IsEnabled() bool {
+	return o.Root != ""
+}
+
+func (o NetbootOptions) withDefaults() NetbootOptions {
+	if o.Root == "" {
+		o.Root = NetbootRootHTTP
+	}
+	return o
+}
+
+func (o NetbootOptions) Validate() error {
+	if !o.IsEnabled() {
+		return nil
+	}
+	if err := o.Root.Validate(); err != nil {
+		return err
+	}
+	if o.URL == "" {
+		return fmt.Errorf("netboot %s root requires an url", o.Root)
+	}
+	if o.Root.IsHTTP() && !strings.HasPrefix(o.URL, "http://") && !strings.HasPrefix(o.URL, "https://") {
+		return fmt.Errorf("invalid netboot url: %s: http root requires an http or https url", o.URL)
+	}
+	if o.Root.IsNFS() && (!strings.Contains(o.URL, ":/") || strings.Contains(o.URL, "://")) {
+		return fmt.Errorf("invalid netboot url: %s: nfs root requires an nfs export, e.g. server:/path", o.URL)
+	}
+	return nil
+}
+
+// rootFSExt returns the root filesystem artifact extension: the squashfs image, or the archive to extract on the NFS export.
+func (r NetbootRoot) rootFSExt() string {
+	if r.IsNFS() {
+		return ".tar"
+	}
+	return ".squashfs"
+}
+
+// NetbootPaths returns the paths of the network boot artifacts written by Convert for the output path:
+// the kernel, the initramfs, the root filesystem and the iPXE script, named after the output file.
+func NetbootPaths(output string, root NetbootRoot) []string {
+	o := &convertOptions{output: output, outputKind: OutputKindNetboot, netboot: NetbootOptions{Root: root}}
+	return o.artifacts(filepath.Dir(output))
+}
+
+func netbootFiles(base string, root NetbootRoot) []string {
+	return []string{base + ".vmlinuz", base + ".initrd.img", base + root.rootFSExt(), base + ".ipxe"}
+}
+
+const ipxeScript = `#!ipxe
+kernel %s %s
+initrd %s
+boot
+`
+
+func (b *builder) validateNetboot() error {
+	if !b.outputKind.IsNetboot() {
+		return nil
+	}
+	if err := b.netboot.Validate(); err != nil {
+		return err
+	}
+	if b.osRelease.ID == ReleaseAlpine {
+		return fmt.Errorf("netboot output is not supported on %s", b.osRelease.ID)
+	}
+	if b.luksPassword != "" {
+		return fmt.Errorf("netboot output is not supported with luks encryption")
+	}
+	// the squashfs image is mounted under its own overlay
+	if b.readOnly.IsEnabled() || b.verity.IsEnabled() {
+		return fmt.Errorf("netboot output is not supported with a read-only root filesystem")
+	}
+	return nil
+}
+
+// netbootCmdline returns the network booted system kernel command line, generated from the distribution Config:
+// the initramfs fetches the squashfs image over http, with live-boot on debian and ubuntu, or with the dracut
+// livenet module on centos, or mounts the NFS export.
+func (b *builder) netbootCmdline(name string) string {
+	files := netbootFiles(name, b.netboot.Root)
+	c := b.config
+	// the initramfs name, as loaded by iPXE
+	c.Initrd = filepath.Base(files[1])
+	centos := b.osRelease.ID == ReleaseCentOS || b.osRelease.ID == ReleaseRocky || b.osRelease.ID == ReleaseAlmaLinux
+	if b.netboot.Root.IsNFS() {
+		c.RootFS = "nfs"
+		if centos {
+			return c.Cmdline(RootPath("nfs:"+b.netboot.URL), "ip=dhcp", "rw", b.cmdLineExtra)
+		}
+		return c.Cmdline(RootPath("/dev/nfs"), "nfsroot="+b.netboot.URL, "ip=dhcp", "boot=nfs", "rw", b.cmdLineExtra)
+	}
+	c.RootFS = "squashfs"
+	url := strings.TrimSuffix(b.netboot.URL, "/") + "/" + filepath.Base(files[2])
+	if centos {
+		return c.Cmdline(RootPath("live:"+url), "rd.live.image", "rd.live.overlay.overlayfs=1", "rd.neednet=1", "ip=dhcp", b.cmdLineExtra)
+	}
+	return c.Cmdline(nil, "boot=live", "fetch="+url, b.cmdLineExtra)
+}
+
+// ipxeScript returns the iPXE script booting the kernel and the initramfs: they are fetched from the base url with http,
+// or relatively to the script location with nfs.
+func (b *builder) ipxeScript(name string) string {
+	files := netbootFiles(name, b.netboot.Root)
+	kernel, initrd := filepath.Base(files[0]), filepath.Base(files[1])
+	if b.netboot.Root.IsHTTP() {
+		base := strings.TrimSuffix(b.netboot.URL, "/")
+		kernel, initrd = base+"/"+kernel, base+"/"+initrd
+	}
+	return fmt.Sprintf(ipxeScript, kernel, b.netbootCmdline(name), initrd)
+}
+
+// makeNetbootRootFS writes the network boot artifacts but the iPXE script in the workdir, named after the disk image:
+// the root filesystem, as a squashfs image or as an archive, the kernel and the initramfs.
+func (b *builder) makeNetbootRootFS(ctx context.Context) error {
+	if !b.outputKind.IsNetboot() {
+		return nil
+	}
+	files := netbootFiles(b.diskOut, b.netboot.Root)
+	exclude := []string{"boot/*", "etc/fstab", "etc/crypttab"}
+	if b.hasSwapFile() {
+		exclude = append(exclude, strings.TrimPrefix(swapFilePath, "/"))
+	}
+	if b.netboot.Root.IsNFS() {
+		logger(ctx).Infof("archiving netboot root file system")
+		if err := b.tarRootFS(ctx, files[2], exclude...); err != nil {
+			return err
+		}
+	} else {
+		logger(ctx).Infof("creating netboot squashfs root file system")
+		if err := b.mksquashfs(ctx, files[2], exclude...); err != nil {
+			return err
+		}
+	}
+	kernel, err := b.bootFile(b.config.Kernel, "vmlinuz-*")
+	if err != nil {
+		return err
+	}
+	initrd, err := b.bootFile(b.config.Initrd, ifElse(b.osRelease.ID == ReleaseCentOS || b.osRelease.ID == ReleaseRocky || b.osRelease.ID == ReleaseAlmaLinux, "initramfs-*.img", "initrd.img-*"))
+	if err != nil {
+		return err
+	}
+	if err := copyFile(kernel, files[0]); err != nil {
+		return err
+	}
+	return copyFile(initrd, files[1])
+}
+
+// makeNetboot writes the iPXE script, the other artifacts being written before the root filesystem is unmounted.
+func (b *builder) makeNetboot(ctx context.Context) error {
+	logger(ctx).Infof("writing ipxe script")
+	files := netbootFiles(b.diskOut, b.netboot.Root)
+	return os.WriteFile(files[3], []byte(b.ipxeScript(filepath.Base(b.diskOut))), perm)
+}
+
+// tarRootFS archives the staged root filesystem to dst, without the excluded paths, relative to the root.
+// The archive keeps the files ownership, permissions and extended attributes, to be extracted as is on the NFS export.
+func (b *builder) tarRootFS(ctx context.Context, dst string, exclude ...string) error {
+	args := []string{"--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls"}
+	if b.reproducible.IsEnabled() {
+		args = append(args, "--sort=name")
+	}
+	for _, v := range exclude {
+		args = append(args, "--exclude=./"+v)
+	}
+	args = append(args, "-C", b.mntPoint, "-cf", dst, ".")
+	// the rootless staging directory ownership is only known by fakeroot
+	if b.rootless {
+		return b.fakeroot(ctx, "tar", args...)
+	}
+	return exec.Run(ctx, "tar", args...)
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetbootPaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		root   NetbootRoot
+		want   []string
+	}{
+		{name: "http", output: "out/ubuntu", root: NetbootRootHTTP, want: []string{"out/ubuntu.vmlinuz", "out/ubuntu.initrd.img", "out/ubuntu.squashfs", "out/ubuntu.ipxe"}},
+		{name: "nfs", output: "out/ubuntu", root: NetbootRootNFS, want: []string{"out/ubuntu.vmlinuz", "out/ubuntu.initrd.img", "out/ubuntu.tar", "out/ubuntu.ipxe"}},
+		{name: "ipxe extension", output: "ubuntu.ipxe", want: []string{"ubuntu.vmlinuz", "ubuntu.initrd.img", "ubuntu.squashfs", "ubuntu.ipxe"}},
+		{name: "format extension", output: "disk0.qcow2", root: NetbootRootHTTP, want: []string{"disk0.vmlinuz", "disk0.initrd.img", "disk0.squashfs", "disk0.ipxe"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, NetbootPaths(tt.output, tt.root))
+		})
+	}
+}
+
+func TestNetbootOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    NetbootOptions
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "http", opts: NetbootOptions{Root: NetbootRootHTTP, URL: "http://10.0.0.1/d2vm"}},
+		{name: "nfs", opts: NetbootOptions{Root: NetbootRootNFS, URL: "10.0.0.1:/srv/d2vm"}},
+		{name: "no url", opts: NetbootOptions{Root: NetbootRootHTTP}, wantErr: true},
+		{name: "http nfs export", opts: NetbootOptions{Root: NetbootRootHTTP, URL: "10.0.0.1:/srv/d2vm"}, wantErr: true},
+		{name: "nfs http url", opts: NetbootOptions{Root: NetbootRootNFS, URL: "http://10.0.0.1/d2vm"}, wantErr: true},
+		{name: "invalid root", opts: NetbootOptions{Root: "tftp", URL: "tftp://10.0.0.1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNetbootCmdline(t *testing.T) {
+	ubuntu := OSRelease{ID: ReleaseUbuntu, VersionID: "22.04"}
+	centos := OSRelease{ID: ReleaseCentOS, VersionID: "8"}
+	tests := []struct {
+		name    string
+		release OSRelease
+		opts    NetbootOptions
+		want    []string
+		ipxe    []string
+	}{
+		{
+			name:    "ubuntu http",
+			release: ubuntu,
+			opts:    NetbootOptions{Root: NetbootRootHTTP, URL: "http://10.0.0.1/d2vm/"},
+			want:    []string{"initrd=vm.initrd.img", "boot=live", "fetch=http://10.0.0.1/d2vm/vm.squashfs", "rootfstype=squashfs", "quiet"},
+			ipxe:    []string{"kernel http://10.0.0.1/d2vm/vm.vmlinuz ", "initrd http://10.0.0.1/d2vm/vm.initrd.img\n"},
+		},
+		{
+			name:    "ubuntu nfs",
+			release: ubuntu,
+			opts:    NetbootOptions{Root: NetbootRootNFS, URL: "10.0.0.1:/srv/d2vm"},
+			want:    []string{"initrd=vm.initrd.img", "root=/dev/nfs", "nfsroot=10.0.0.1:/srv/d2vm", "ip=dhcp", "boot=nfs", "rw", "quiet"},
+			ipxe:    []string{"kernel vm.vmlinuz ", "initrd vm.initrd.img\n"},
+		},
+		{
+			name:    "centos http",
+			release: centos,
+			opts:    NetbootOptions{Root: NetbootRootHTTP, URL: "http://10.0.0.1/d2vm"},
+			want:    []string{"root=live:http://10.0.0.1/d2vm/vm.squashfs", "rd.live.image", "rd.neednet=1", "ip=dhcp", "quiet"},
+		},
+		{
+			name:    "centos nfs",
+			release: centos,
+			opts:    NetbootOptions{Root: NetbootRootNFS, URL: "10.0.0.1:/srv/d2vm"},
+			want:    []string{"root=nfs:10.0.0.1:/srv/d2vm", "ip=dhcp", "rw", "quiet"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.release.Config()
+			require.NoError(t, err)
+			b := &builder{osRelease: tt.release, config: config, netboot: tt.opts, cmdLineExtra: "quiet"}
+			fields := strings.Fields(b.netbootCmdline("vm"))
+			for _, v := range tt.want {
+				assert.Contains(t, fields, v)
+			}
+			s := b.ipxeScript("vm")
+			assert.True(t, strings.HasPrefix(s, "#!ipxe\n"))
+			for _, v := range tt.ipxe {
+				assert.Contains(t, s, v)
+			}
+		})
+	}
+}
+
+func TestNetbootDockerfile(t *testing.T) {
+	tests := []struct {
+		release OSRelease
+		root    NetbootRoot
+		want    string
+	}{
+		{release: OSRelease{ID: ReleaseUbuntu, VersionID: "22.04"}, root: NetbootRootHTTP, want: "live-boot"},
+		{release: OSRelease{ID: ReleaseDebian, VersionID: "12"}, root: NetbootRootNFS, want: `echo "nfs" >> /etc/initramfs-tools/modules`},
+		{release: OSRelease{ID: ReleaseCentOS, VersionID: "8"}, root: NetbootRootHTTP, want: "--add livenet"},
+		{release: OSRelease{ID: ReleaseCentOS, VersionID: "8"}, root: NetbootRootNFS, want: "--add nfs"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.release.ID)+"-"+tt.root.String(), func(t *testing.T) {
+			for _, root := range []NetbootRoot{"", tt.root} {
+				var opts []ConvertOption
+				if root != "" {
+					opts = append(opts, WithOutputKind(OutputKindNetboot), WithNetbootOptions(NetbootOptions{Root: root}))
+				}
+				d, err := NewDockerfile(tt.release, "img", "", NetworkManagerNone, false, false, false, opts...)
+				require.NoError(t, err)
+				var b strings.Builder
+				require.NoError(t, d.Render(&b))
+				assert.Equal(t, root != "", strings.Contains(b.String(), tt.want))
+			}
+		})
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"strings"
 
 	"github.com/joho/godotenv"
-	"github.com/sirupsen/logrus"
 
 	"go.linka.cloud/d2vm/pkg/docker"
 )
@@ -70,13 +69,18 @@ type OSRelease struct {
 }
 
 func (r OSRelease) SupportsLUKS() bool {
+	return r.SupportsLUKSContext(context.Background())
+}
+
+// SupportsLUKSContext is SupportsLUKS logging the version parsing errors to the context logger.
+func (r OSRelease) SupportsLUKSContext(ctx context.Context) bool {
 	switch r.ID {
 	case ReleaseUbuntu:
 		return r.VersionID >= "20.04"
 	case ReleaseDebian:
 		v, err := strconv.Atoi(r.VersionID)
 		if err != nil {
-			logrus.Warnf("%s: failed to parse version id: %v", r.Version, err)
+			logger(ctx).Warnf("%s: failed to parse version id: %v", r.Version, err)
 			return false
 		}
 		return v >= 10
@@ -0,0 +1,59 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"fmt"
+)
+
+// OutputKind is the kind of artifacts written by the conversion.
+type OutputKind string
+
+const (
+	// OutputKindDisk writes the disk images, in the output formats.
+	OutputKindDisk OutputKind = "disk"
+	// OutputKindNetboot writes the network boot artifacts: the kernel, the initramfs, the root filesystem and an iPXE script.
+	OutputKindNetboot OutputKind = "netboot"
+	// OutputKindMicroVM writes the microVM direct kernel boot artifacts: the kernel, the initramfs,
+	// a partitionless root filesystem image and a Firecracker configuration.
+	OutputKindMicroVM OutputKind = "microvm"
+)
+
+func (k OutputKind) String() string {
+	return string(k)
+}
+
+func (k OutputKind) IsDisk() bool {
+	return k == OutputKindDisk || k == ""
+}
+
+func (k OutputKind) IsNetboot() bool {
+	return k == OutputKindNetboot
+}
+
+func (k OutputKind) IsMicroVM() bool {
+	return k == OutputKindMicroVM
+}
+
+func (k OutputKind) IsSupported() bool {
+	return k.IsDisk() || k.IsNetboot() || k.IsMicroVM()
+}
+
+func (k OutputKind) Validate() error {
+	if !k.IsSupported() {
+		return fmt.Errorf("invalid output kind: %s valid kinds are: disk, netboot, microvm", k)
+	}
+	return nil
+}
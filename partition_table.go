@@ -0,0 +1,75 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"fmt"
+
+	"github.com/c2h5oh/datasize"
+)
+
+type PartitionTable string
+
+const (
+	PartitionTableMSDOS PartitionTable = "msdos"
+	PartitionTableGPT   PartitionTable = "gpt"
+)
+
+// msdosMaxSize is the largest disk an msdos partition table can address with 512 bytes sectors.
+const msdosMaxSize = 2 * uint64(datasize.TB)
+
+// GPT partition type GUIDs, see https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+const (
+	gptTypeESP          = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	gptTypeXBOOTLDR     = "BC13C2FF-59E6-4262-A352-B275FD6F7172"
+	gptTypeRootX86_64   = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+	gptTypeRootARM64    = "B921B045-1DF0-41C3-AF44-4C6F280D3FAE"
+	gptTypeLinuxGeneric = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	gptTypeSwap         = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+)
+
+func (p PartitionTable) String() string {
+	return string(p)
+}
+
+func (p PartitionTable) IsGPT() bool {
+	return p == PartitionTableGPT
+}
+
+func (p PartitionTable) IsMSDOS() bool {
+	return p == PartitionTableMSDOS
+}
+
+func (p PartitionTable) IsSupported() bool {
+	return p.IsGPT() || p.IsMSDOS()
+}
+
+func (p PartitionTable) Validate() error {
+	if !p.IsSupported() {
+		return fmt.Errorf("invalid partition table: %s valid partition tables are: msdos, gpt", p)
+	}
+	return nil
+}
+
+func gptRootType(arch string) string {
+	switch arch {
+	case archAMD64:
+		return gptTypeRootX86_64
+	case archARM64:
+		return gptTypeRootARM64
+	default:
+		return gptTypeLinuxGeneric
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionTable(t *testing.T) {
+	tests := []struct {
+		table   PartitionTable
+		gpt     bool
+		msdos   bool
+		wantErr bool
+	}{
+		{table: PartitionTableGPT, gpt: true},
+		{table: PartitionTableMSDOS, msdos: true},
+		{table: "", wantErr: true},
+		{table: "mbr", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table.String(), func(t *testing.T) {
+			assert.Equal(t, tt.gpt, tt.table.IsGPT())
+			assert.Equal(t, tt.msdos, tt.table.IsMSDOS())
+			assert.Equal(t, !tt.wantErr, tt.table.IsSupported())
+			if tt.wantErr {
+				assert.Error(t, tt.table.Validate())
+			} else {
+				assert.NoError(t, tt.table.Validate())
+			}
+		})
+	}
+}
+
+func TestGPTRootType(t *testing.T) {
+	assert.Equal(t, gptTypeRootX86_64, gptRootType(archAMD64))
+	assert.Equal(t, gptTypeRootARM64, gptRootType(archARM64))
+	assert.Equal(t, gptTypeLinuxGeneric, gptRootType("riscv64"))
+}
+
+func TestPartitionNumbers(t *testing.T) {
+	tests := []struct {
+		name string
+		b    builder
+		boot int
+		root int
+	}{
+		{name: "msdos", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}}, boot: 1, root: 1},
+		{name: "msdos split boot", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}, splitBoot: true}, boot: 1, root: 2},
+		// grub and grub-bios embed their core image in a dedicated partition
+		{name: "gpt grub", b: builder{partitionTable: PartitionTableGPT, bootloader: grub{}}, boot: 2, root: 2},
+		{name: "gpt grub-bios split boot", b: builder{partitionTable: PartitionTableGPT, bootloader: grubBios{}, splitBoot: true}, boot: 2, root: 3},
+		{name: "gpt grub-efi", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}}, boot: 1, root: 1},
+		{name: "gpt grub-efi split boot", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true}, boot: 1, root: 2},
+		{name: "gpt syslinux split boot", b: builder{partitionTable: PartitionTableGPT, bootloader: syslinux{}, splitBoot: true}, boot: 1, root: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.boot, tt.b.bootPartNum())
+			assert.Equal(t, tt.root, tt.b.rootPartNum())
+		})
+	}
+}
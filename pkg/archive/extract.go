@@ -0,0 +1,335 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+const (
+	paxXattr = "SCHILY.xattr."
+	// rhtSELinux is the pax record used by Red Hat's tar to store SELinux labels
+	rhtSELinux = "RHT.security.selinux"
+)
+
+type Option func(o *options)
+
+type options struct {
+	progress     func(bytes int64)
+	noSameOwner  bool
+	ignoreXattrs bool
+
+	log *logrus.Entry
+	// denied records the extended attributes the user is not allowed to set, so they are only reported once
+	denied map[string]struct{}
+}
+
+// WithProgress registers a function called with the total number of bytes
+// of the archive read so far, after each extracted entry.
+func WithProgress(fn func(bytes int64)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithNoSameOwner extracts the files as the current user instead of the archived owner.
+func WithNoSameOwner() Option {
+	return func(o *options) {
+		o.noSameOwner = true
+	}
+}
+
+// WithIgnoreXattrs does not restore the extended attributes, e.g. when the target filesystem does not support them.
+func WithIgnoreXattrs() Option {
+	return func(o *options) {
+		o.ignoreXattrs = true
+	}
+}
+
+// Extract extracts the tar stream r inside dest, restoring ownership, permissions,
+// extended attributes (including file capabilities and SELinux labels), hardlinks and device nodes.
+// The stream is expected to be already flattened, e.g. the output of mutate.Extract,
+// so whiteout files are not interpreted.
+func Extract(ctx context.Context, r io.Reader, dest string, opts ...Option) error {
+	o := &options{log: exec.Logger(ctx), denied: make(map[string]struct{})}
+	for _, v := range opts {
+		v(o)
+	}
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	// directories metadata must be restored once their content is extracted
+	type dir struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dir
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := securePath(dest, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if path == dest {
+			dirs = append(dirs, dir{path: path, hdr: hdr})
+			continue
+		}
+		if err := extractEntry(tr, hdr, dest, path, o); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dir{path: path, hdr: hdr})
+		}
+		if o.progress != nil {
+			o.progress(cr.n)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreMetadata(dirs[i].path, dirs[i].hdr, o); err != nil {
+			return fmt.Errorf("%s: %w", dirs[i].hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest, path string, o *options) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		// metadata restored once the directory content is extracted
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := securePath(dest, hdr.Linkname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Linkname, err)
+		}
+		// the hardlink shares the metadata of its target
+		return os.Link(target, path)
+	case tar.TypeChar:
+		return mknod(path, hdr, mode|unix.S_IFCHR, o)
+	case tar.TypeBlock:
+		return mknod(path, hdr, mode|unix.S_IFBLK, o)
+	case tar.TypeFifo:
+		return mknod(path, hdr, mode|unix.S_IFIFO, o)
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return fmt.Errorf("unsupported tar entry type: %q", hdr.Typeflag)
+	}
+	return restoreMetadata(path, hdr, o)
+}
+
+func mknod(path string, hdr *tar.Header, mode uint32, o *options) error {
+	if err := unix.Mknod(path, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+		return err
+	}
+	return restoreMetadata(path, hdr, o)
+}
+
+func restoreMetadata(path string, hdr *tar.Header, o *options) error {
+	if !o.noSameOwner {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if !o.ignoreXattrs {
+		if err := setXattrs(path, hdr, o); err != nil {
+			return err
+		}
+	}
+	// chmod must happen after chown as it clears the setuid and setgid bits
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(path, os.FileMode(hdr.Mode&0777)|modeBits(hdr.Mode)); err != nil {
+			return err
+		}
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{toTimespec(hdr.AccessTime, hdr.ModTime), toTimespec(hdr.ModTime, hdr.ModTime)}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func setXattrs(path string, hdr *tar.Header, o *options) error {
+	for k, v := range hdr.PAXRecords {
+		var name string
+		switch {
+		case strings.HasPrefix(k, paxXattr):
+			name = strings.TrimPrefix(k, paxXattr)
+		case k == rhtSELinux:
+			name = "security.selinux"
+		default:
+			continue
+		}
+		if err := unix.Lsetxattr(path, name, []byte(v), 0); err != nil {
+			// not every filesystem supports every namespace, e.g. symlinks do not support user xattrs
+			if errors.Is(err, unix.ENOTSUP) {
+				continue
+			}
+			// the trusted and security namespaces require privileges the user may not have: the attribute is lost
+			if errors.Is(err, unix.EPERM) {
+				if _, ok := o.denied[name]; !ok {
+					o.denied[name] = struct{}{}
+					o.log.Warnf("extended attribute %s cannot be set: %v", name, err)
+				}
+				continue
+			}
+			return fmt.Errorf("set xattr %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func modeBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func toTimespec(t time.Time, fallback time.Time) unix.Timespec {
+	if t.IsZero() {
+		t = fallback
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
+
+// securePath returns the path of name inside dest. The symlinks found in the parent directories
+// are resolved as if dest was the root directory, so that an entry can never be written outside of dest.
+// The last path element is not resolved, as it is the entry itself.
+func securePath(dest, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return dest, nil
+	}
+	parent, err := resolveInRoot(dest, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dest, parent, filepath.Base(name)), nil
+}
+
+// resolveInRoot resolves the symlinks of path, relative to root, the same way they would
+// be resolved after a chroot in root. It returns the resolved path relative to root.
+func resolveInRoot(root, path string) (string, error) {
+	current := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			current = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return current, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	hdr  tar.Header
+	body string
+}
+
+func makeTar(t *testing.T, entries ...entry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, v := range entries {
+		hdr := v.hdr
+		hdr.Size = int64(len(v.body))
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = time.Unix(1700000000, 0)
+		}
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(v.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func TestExtract(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	mtime := time.Unix(1600000000, 0)
+	buf := makeTar(t,
+		entry{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+		entry{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, body: "d2vm"},
+		entry{hdr: tar.Header{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755}, body: "su"},
+		entry{hdr: tar.Header{Name: "usr/bin/sudo", Typeflag: tar.TypeLink, Linkname: "usr/bin/su"}},
+		entry{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+		entry{hdr: tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside}},
+		entry{hdr: tar.Header{Name: "escape/file", Typeflag: tar.TypeReg, Mode: 0644}, body: "inside"},
+		entry{hdr: tar.Header{Name: "../../dotdot", Typeflag: tar.TypeReg, Mode: 0644}, body: "inside"},
+		entry{hdr: tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600}},
+	)
+	var progress int64
+	opts := []Option{WithProgress(func(n int64) { progress = n })}
+	if os.Geteuid() != 0 {
+		opts = append(opts, WithNoSameOwner())
+	}
+	require.NoError(t, Extract(context.Background(), buf, dest, opts...))
+	assert.NotZero(t, progress)
+
+	b, err := os.ReadFile(filepath.Join(dest, "etc", "hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, "d2vm", string(b))
+
+	fi, err := os.Stat(filepath.Join(dest, "etc"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	assert.Equal(t, mtime, fi.ModTime())
+
+	fi, err = os.Stat(filepath.Join(dest, "usr", "bin", "su"))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSetuid)
+	su := fi.Sys().(*syscall.Stat_t)
+	fi, err = os.Stat(filepath.Join(dest, "usr", "bin", "sudo"))
+	require.NoError(t, err)
+	assert.Equal(t, su.Ino, fi.Sys().(*syscall.Stat_t).Ino)
+
+	l, err := os.Readlink(filepath.Join(dest, "bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "usr/bin", l)
+
+	// absolute symlinks are resolved inside the destination directory
+	_, err = os.Stat(filepath.Join(outside, "file"))
+	assert.True(t, os.IsNotExist(err))
+	b, err = os.ReadFile(filepath.Join(dest, outside, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "inside", string(b))
+
+	b, err = os.ReadFile(filepath.Join(dest, "dotdot"))
+	require.NoError(t, err)
+	assert.Equal(t, "inside", string(b))
+
+	fi, err = os.Lstat(filepath.Join(dest, "run", "fifo"))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeNamedPipe)
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// Format is a streaming compression format, named after its file extension.
+type Format string
+
+const (
+	Gzip Format = "gz"
+	XZ   Format = "xz"
+	Zstd Format = "zst"
+)
+
+var formats = []Format{Gzip, XZ, Zstd}
+
+// Formats returns the supported compression formats.
+func Formats() []Format {
+	return formats[:]
+}
+
+// FromPath returns the compression format of the file, found from its extension.
+func FromPath(path string) (Format, bool) {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	for _, v := range formats {
+		if string(v) == ext {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (f Format) String() string {
+	return string(f)
+}
+
+// Command returns the format compression tool.
+func (f Format) Command() string {
+	switch f {
+	case Gzip:
+		return "gzip"
+	case XZ:
+		return "xz"
+	default:
+		return "zstd"
+	}
+}
+
+func (f Format) args(decompress bool) []string {
+	// the compressed stream is written to stdout
+	args := []string{"-c"}
+	if decompress {
+		args = append(args, "-d")
+	}
+	switch f {
+	case XZ:
+		args = append(args, "-T0")
+	case Zstd:
+		args = append(args, "-T0", "-q")
+	}
+	return args
+}
+
+// Compress writes the src file compressed with format f to dst.
+func Compress(ctx context.Context, f Format, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd := exec.CommandContext(ctx, f.Command(), f.args(false)...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: stderr: %s error: %w", f.Command(), stderr.String(), err)
+	}
+	return out.Close()
+}
+
+// Decompress writes the decompressed src file to dst. The compression format is found from the src extension.
+// The zero blocks are not written: dst is a sparse file.
+func Decompress(ctx context.Context, src, dst string) error {
+	f, ok := FromPath(src)
+	if !ok {
+		return fmt.Errorf("%s: unsupported compression format", src)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd := exec.CommandContext(ctx, f.Command(), f.args(true)...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stderr = in, &stderr
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w := &sparseWriter{f: out}
+	if _, err := io.Copy(w, r); err != nil {
+		// the decompressor is blocked writing to the pipe no more read: closing it makes it exit
+		r.Close()
+		cmd.Wait()
+		return fmt.Errorf("write %s: %w", dst, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: stderr: %s error: %w", f.Command(), stderr.String(), err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// sparseBlockSize is the size of the blocks skipped when they only contain zeros.
+const sparseBlockSize = 4096
+
+// sparseWriter writes to a file, seeking over the zero blocks instead of writing them.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) != 0 {
+		// the blocks are aligned on the file offset
+		l := min(len(p), sparseBlockSize-int(w.off%sparseBlockSize))
+		if isZero(p[:l]) {
+			if _, err := w.f.Seek(int64(l), io.SeekCurrent); err != nil {
+				return n, err
+			}
+		} else if _, err := w.f.Write(p[:l]); err != nil {
+			return n, err
+		}
+		w.off += int64(l)
+		n += l
+		p = p[l:]
+	}
+	return n, nil
+}
+
+// Close sets the file size, as the trailing zero blocks were skipped.
+func (w *sparseWriter) Close() error {
+	return w.f.Truncate(w.off)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"bytes"
+	"context"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromPath(t *testing.T) {
+	for path, want := range map[string]Format{
+		"disk0.raw.gz":  Gzip,
+		"disk0.raw.xz":  XZ,
+		"disk0.raw.zst": Zstd,
+		"disk0.qcow2":   "",
+		"disk0":         "",
+	} {
+		f, ok := FromPath(path)
+		assert.Equal(t, want, f, path)
+		assert.Equal(t, want != "", ok, path)
+	}
+}
+
+func TestCompressDecompress(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk0.raw")
+	// a mostly empty disk, with data in the middle of a block and a trailing hole
+	data := make([]byte, 16*sparseBlockSize)
+	copy(data[sparseBlockSize+100:], "d2vm")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	for _, f := range Formats() {
+		t.Run(f.String(), func(t *testing.T) {
+			if _, err := osexec.LookPath(f.Command()); err != nil {
+				t.Skipf("%s not found", f.Command())
+			}
+			ctx := context.Background()
+			c := src + "." + f.String()
+			require.NoError(t, Compress(ctx, f, src, c))
+			out := filepath.Join(dir, "out."+f.String()+".raw")
+			require.NoError(t, Decompress(ctx, c, out))
+			b, err := os.ReadFile(out)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, b))
+			i, err := os.Stat(out)
+			require.NoError(t, err)
+			// only the data block is allocated
+			assert.LessOrEqual(t, i.Sys().(*syscall.Stat_t).Blocks*512, int64(4*sparseBlockSize))
+		})
+	}
+}
+
+func TestDecompressWriteError(t *testing.T) {
+	if _, err := osexec.LookPath(Gzip.Command()); err != nil {
+		t.Skipf("%s not found", Gzip.Command())
+	}
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk0.raw")
+	// larger than the pipe buffer, so that the decompressor blocks if the output is no more read
+	data := bytes.Repeat([]byte("d2vm"), 1<<20)
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, Compress(ctx, Gzip, src, src+".gz"))
+	err := Decompress(ctx, src+".gz", "/dev/full")
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.NoError(t, ctx.Err())
+}
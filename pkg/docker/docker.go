@@ -23,8 +23,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
-
-	"github.com/sirupsen/logrus"
+	"time"
 
 	"go.linka.cloud/d2vm/pkg/exec"
 )
@@ -82,8 +81,13 @@ func Remove(ctx context.Context, tag string) error {
 	return Cmd(ctx, "image", "rm", tag)
 }
 
+// ImageList returns the images matching the tag reference, or all the images if the tag is empty.
 func ImageList(ctx context.Context, tag string) ([]string, error) {
-	o, _, err := CmdOut(ctx, "image", "ls", "--format={{ .Repository }}:{{ .Tag }}", tag)
+	args := []string{"image", "ls", "--format={{ .Repository }}:{{ .Tag }}"}
+	if tag != "" {
+		args = append(args, tag)
+	}
+	o, _, err := CmdOut(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +99,29 @@ func ImageList(ctx context.Context, tag string) ([]string, error) {
 	return imgs, s.Err()
 }
 
+// ImageInfo is the image metadata returned by ImageInspect.
+type ImageInfo struct {
+	// ID is the image configuration digest.
+	ID      string
+	Created time.Time
+}
+
+func ImageInspect(ctx context.Context, tag string) (ImageInfo, error) {
+	o, _, err := CmdOut(ctx, "image", "inspect", "--format={{ .Id }} {{ .Created }}", tag)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	id, created, ok := strings.Cut(strings.TrimSpace(o), " ")
+	if !ok {
+		return ImageInfo{}, fmt.Errorf("unexpected docker image inspect output: %s", o)
+	}
+	i := ImageInfo{ID: id}
+	if i.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return ImageInfo{}, fmt.Errorf("unexpected image creation date: %s", created)
+	}
+	return i, nil
+}
+
 func ImageSave(ctx context.Context, tag, file string) error {
 	return Cmd(ctx, "image", "save", "-o", file, tag)
 }
@@ -116,7 +143,7 @@ func RunInteractiveAndRemove(ctx context.Context, args ...string) error {
 }
 
 func RunAndRemove(ctx context.Context, args ...string) error {
-	logrus.Tracef("running 'docker run --rm %s'", strings.Join(args, " "))
+	exec.Logger(ctx).Tracef("running 'docker run --rm %s'", strings.Join(args, " "))
 	return Cmd(ctx, append([]string{"run", "--rm"}, args...)...)
 }
 
@@ -149,6 +176,12 @@ func RunD2VM(ctx context.Context, image, version, in, out, cmd string, args ...s
 		"-e",
 		// yes... it is kind of a dirty hack
 		fmt.Sprintf("SUDO_UID=%d", os.Getuid()),
+	)
+	// the reproducible builds timestamp is forwarded to the container
+	if _, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		a = append(a, "-e", "SOURCE_DATE_EPOCH")
+	}
+	a = append(a,
 		"-v",
 		fmt.Sprintf("%s:/var/run/docker.sock", dockerSocket()),
 		"-v",
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -28,6 +29,7 @@ var (
 	Run = RunNoOut
 )
 
+// SetDebug sets Run to log the commands output, and enables the standard logger debug level.
 func SetDebug(debug bool) {
 	if debug {
 		Run = RunDebug
@@ -37,16 +39,55 @@ func SetDebug(debug bool) {
 	}
 }
 
+type loggerKey struct{}
+
+// WithLogger returns a context whose commands are logged to the logger, e.g. the logger of a single build.
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger set on the context, or the standard logger.
+func Logger(ctx context.Context) *logrus.Entry {
+	if l, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return l
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+type envKey struct{}
+
+// WithEnv returns a context whose commands run with the additional environment variables.
+func WithEnv(ctx context.Context, env ...string) context.Context {
+	return context.WithValue(ctx, envKey{}, append(append([]string{}, Env(ctx)...), env...))
+}
+
+// Env returns the additional environment variables set on the context.
+func Env(ctx context.Context) []string {
+	env, _ := ctx.Value(envKey{}).([]string)
+	return env
+}
+
+func command(ctx context.Context, c string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c, args...)
+	if env := Env(ctx); len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
 func CommandContext(ctx context.Context, c string, args ...string) *exec.Cmd {
-	logrus.Debugf("$ %s %s", c, strings.Join(args, " "))
-	return exec.CommandContext(ctx, c, args...)
+	Logger(ctx).Debugf("$ %s %s", c, strings.Join(args, " "))
+	return command(ctx, c, args...)
 }
 
 func RunDebug(ctx context.Context, c string, args ...string) error {
-	logrus.Debugf("$ %s %s", c, strings.Join(args, " "))
-	cmd := exec.CommandContext(ctx, c, args...)
-	cmd.Stdout = logrus.StandardLogger().WriterLevel(logrus.DebugLevel)
-	cmd.Stderr = logrus.StandardLogger().WriterLevel(logrus.DebugLevel)
+	l := Logger(ctx)
+	l.Debugf("$ %s %s", c, strings.Join(args, " "))
+	cmd := command(ctx, c, args...)
+	w := l.WriterLevel(logrus.DebugLevel)
+	defer w.Close()
+	cmd.Stdout = w
+	cmd.Stderr = w
 	return cmd.Run()
 }
 
@@ -59,7 +100,7 @@ func RunNoOut(ctx context.Context, c string, args ...string) error {
 }
 
 func RunOut(ctx context.Context, c string, args ...string) (stdout, stderr string, err error) {
-	cmd := exec.CommandContext(ctx, c, args...)
+	cmd := command(ctx, c, args...)
 	var stdo, stde bytes.Buffer
 	cmd.Stdout = &stdo
 	cmd.Stderr = &stde
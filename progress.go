@@ -0,0 +1,177 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// Conversion phases, reported in the progress events only: hooks cannot be registered for them.
+const (
+	// PhaseInspect inspects the docker image to find its distribution.
+	PhaseInspect Phase = "inspect"
+	// PhaseDockerBuild builds the kernel enabled docker image.
+	PhaseDockerBuild Phase = "docker-build"
+	// PhaseMeasure measures the image content to compute the disk size.
+	PhaseMeasure Phase = "measure"
+	// PhaseOutput writes the disk image to the output path.
+	PhaseOutput Phase = "output"
+)
+
+type EventType string
+
+const (
+	// EventPhaseStart is emitted when a phase starts.
+	EventPhaseStart EventType = "phase-start"
+	// EventPhaseEnd is emitted when a phase ends, with its duration and its error if it failed.
+	EventPhaseEnd EventType = "phase-end"
+	// EventExtract reports the number of bytes of the image extracted so far.
+	EventExtract EventType = "extract"
+	// EventConvert reports the disk image format conversion percentage.
+	EventConvert EventType = "convert"
+	// EventDone is emitted when the conversion ends, with its total duration and its error if it failed.
+	EventDone EventType = "done"
+)
+
+// Event is a progress event emitted during the conversion.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Phase   Phase     `json:"phase,omitempty"`
+	Bytes   uint64    `json:"bytes,omitempty"`
+	Percent float64   `json:"percent,omitempty"`
+	// Format is the disk image format of the convert events.
+	Format   string        `json:"format,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// ProgressFunc receives the progress events. It is called synchronously and should return quickly.
+type ProgressFunc func(e Event)
+
+// progressInterval is the minimum interval between two extract or convert events
+const progressInterval = time.Second
+
+func (fn ProgressFunc) emit(e Event) {
+	if fn == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	fn(e)
+}
+
+// synchronized returns a ProgressFunc that can be called from several goroutines.
+func (fn ProgressFunc) synchronized() ProgressFunc {
+	if fn == nil {
+		return nil
+	}
+	var mu sync.Mutex
+	return func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn(e)
+	}
+}
+
+// withFormat returns a ProgressFunc setting the events format.
+func (fn ProgressFunc) withFormat(format string) ProgressFunc {
+	if fn == nil {
+		return nil
+	}
+	return func(e Event) {
+		e.Format = format
+		fn(e)
+	}
+}
+
+// phase runs f, surrounded by the phase start and end events.
+func (fn ProgressFunc) phase(phase Phase, f func() error) error {
+	fn.emit(Event{Type: EventPhaseStart, Phase: phase})
+	start := time.Now()
+	err := f()
+	e := Event{Type: EventPhaseEnd, Phase: phase, Duration: time.Since(start)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	fn.emit(e)
+	return err
+}
+
+var qemuImgProgressRegexp = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// qemuImgConvert runs qemu-img convert, reporting the conversion percentage.
+func qemuImgConvert(ctx context.Context, progress ProgressFunc, args ...string) error {
+	if progress == nil {
+		return exec.Run(ctx, "qemu-img", append([]string{"convert"}, args...)...)
+	}
+	args = append([]string{"convert", "-p"}, args...)
+	cmd := exec.CommandContext(ctx, "qemu-img", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	emitQemuImgProgress(stdout, progress)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("qemu-img %s: stderr: %s error: %w", strings.Join(args, " "), stderr.String(), err)
+	}
+	return nil
+}
+
+// emitQemuImgProgress reads the qemu-img convert progress output, and emits the conversion percentage
+// at most once per progress interval, and once completed.
+func emitQemuImgProgress(r io.Reader, progress ProgressFunc) {
+	s := bufio.NewScanner(r)
+	// qemu-img rewrites the progress line using carriage returns
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) != 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	var last time.Time
+	for s.Scan() {
+		m := qemuImgProgressRegexp.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		p, err := strconv.ParseFloat(m[1], 64)
+		if err != nil || (p < 100 && time.Since(last) < progressInterval) {
+			continue
+		}
+		last = time.Now()
+		progress.emit(Event{Type: EventConvert, Phase: PhaseConvert, Percent: p})
+	}
+}
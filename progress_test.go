@@ -0,0 +1,101 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressPhase(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		format string
+		want   []Event
+	}{
+		{
+			name: "success",
+			want: []Event{{Type: EventPhaseStart, Phase: PhaseConvert}, {Type: EventPhaseEnd, Phase: PhaseConvert}},
+		},
+		{
+			name: "failure",
+			err:  errors.New("failed"),
+			want: []Event{{Type: EventPhaseStart, Phase: PhaseConvert}, {Type: EventPhaseEnd, Phase: PhaseConvert, Error: "failed"}},
+		},
+		{
+			name:   "format",
+			format: "qcow2",
+			want:   []Event{{Type: EventPhaseStart, Phase: PhaseConvert, Format: "qcow2"}, {Type: EventPhaseEnd, Phase: PhaseConvert, Format: "qcow2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []Event
+			fn := ProgressFunc(func(e Event) {
+				events = append(events, e)
+			})
+			if tt.format != "" {
+				fn = fn.withFormat(tt.format)
+			}
+			err := fn.phase(PhaseConvert, func() error {
+				// the phase function runs between the start and end events
+				require.Len(t, events, 1)
+				return tt.err
+			})
+			assert.Equal(t, tt.err, err)
+			require.Len(t, events, len(tt.want))
+			for i := range events {
+				assert.False(t, events[i].Time.IsZero())
+				events[i].Time, events[i].Duration = time.Time{}, 0
+			}
+			assert.Equal(t, tt.want, events)
+		})
+	}
+	// the events are dropped without progress function
+	var fn ProgressFunc
+	assert.NoError(t, fn.withFormat("raw").phase(PhaseConvert, func() error { return nil }))
+}
+
+func TestQemuImgProgress(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []float64
+	}{
+		{name: "empty"},
+		{name: "no progress", output: "qemu-img: warning: unsupported option\n"},
+		{name: "single", output: "    (42.50/100%)\n", want: []float64{42.5}},
+		{name: "integer", output: "    (7/100%)", want: []float64{7}},
+		// the percentages are throttled, but the completion
+		{name: "rewritten", output: "    (0.00/100%)\r    (25.01/100%)\r    (50.02/100%)\r    (100.00/100%)\r\n", want: []float64{0, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []float64
+			emitQemuImgProgress(strings.NewReader(tt.output), func(e Event) {
+				assert.Equal(t, EventConvert, e.Type)
+				assert.Equal(t, PhaseConvert, e.Phase)
+				got = append(got, e.Percent)
+			})
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
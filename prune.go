@@ -0,0 +1,385 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/multierr"
+
+	"go.linka.cloud/d2vm/pkg/docker"
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+const (
+	// buildStateFile is the build state record, written in the build work directory
+	buildStateFile = "state.json"
+	// cryptPrefix is the device mapper name prefix of the encrypted root partitions opened during the builds
+	cryptPrefix = "d2vm-"
+)
+
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// buildState records the host resources held by a build, so that they can be released by Prune
+// when the build process was killed before releasing them.
+type buildState struct {
+	// BootID, PID and StartTime identify the build process: the pid may be reused after it exited, or after a reboot
+	BootID    string `json:"bootID"`
+	PID       int    `json:"pid"`
+	StartTime uint64 `json:"startTime"`
+	// Image is the docker image tagged with the build uuid
+	Image       string `json:"image,omitempty"`
+	LoopDevice  string `json:"loopDevice,omitempty"`
+	CryptDevice string `json:"cryptDevice,omitempty"`
+}
+
+// buildsDir returns the directory holding the builds work directories, named after the builds uuid.
+func buildsDir() string {
+	return filepath.Join(os.TempDir(), "d2vm")
+}
+
+func newBuildState() (buildState, error) {
+	pid := os.Getpid()
+	start, err := processStartTime(pid)
+	if err != nil {
+		return buildState{}, err
+	}
+	b, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return buildState{}, err
+	}
+	return buildState{BootID: strings.TrimSpace(string(b)), PID: pid, StartTime: start}, nil
+}
+
+// readBuildState reads the build state record in the work directory.
+func readBuildState(dir string) (buildState, error) {
+	var s buildState
+	b, err := os.ReadFile(filepath.Join(dir, buildStateFile))
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("%s: %w", filepath.Join(dir, buildStateFile), err)
+	}
+	return s, nil
+}
+
+// updateBuildState updates the build state record in the work directory, creating it for the current process if needed.
+func updateBuildState(dir string, fn func(s *buildState)) error {
+	s, err := readBuildState(dir)
+	if os.IsNotExist(err) {
+		s, err = newBuildState()
+	}
+	if err != nil {
+		return err
+	}
+	fn(&s)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// the record is replaced atomically, so that a killed build never leaves a truncated one
+	tmp := filepath.Join(dir, buildStateFile+".tmp")
+	if err := os.WriteFile(tmp, b, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, buildStateFile))
+}
+
+// running reports whether the build process is still running.
+func (s buildState) running() bool {
+	b, err := os.ReadFile(bootIDPath)
+	if err != nil || strings.TrimSpace(string(b)) != s.BootID {
+		return false
+	}
+	start, err := processStartTime(s.PID)
+	return err == nil && start == s.StartTime
+}
+
+// processStartTime returns the process start time in clock ticks after boot, read from /proc/<pid>/stat.
+func processStartTime(pid int) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// the command name may hold spaces and parentheses: the fields are counted after its closing one
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat content", pid)
+	}
+	// the start time is the 22nd field, the fields after the command name start with the 3rd one
+	f := strings.Fields(string(b[i+1:]))
+	if len(f) < 20 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat content", pid)
+	}
+	return strconv.ParseUint(f[19], 10, 64)
+}
+
+type pruner struct {
+	dryRun bool
+	dir    string
+	// held holds the loop and crypt devices and the docker images held by the running builds
+	held map[string]bool
+	// stale holds the work directories of the builds which are no more running
+	stale []string
+	// records holds the state records of the builds which are no more running, by build uuid
+	records map[string]buildState
+}
+
+// resource is a host resource left by the build with the uuid.
+type resource struct {
+	build string
+	name  string
+}
+
+// Prune releases the host resources left by the builds killed before releasing them: the mounts under their
+// work directory, the encrypted root partitions mappings, the loop devices and their partitions mappings,
+// the docker images tagged with their uuid and their work directories.
+// Only the resources of the builds found no more running are released, the encrypted mappings being the ones named
+// in their state record: the builds started since are kept, and each state record is read again before releasing
+// the build resources.
+// The builds running in the d2vm container are not visible outside the container: Prune must not run along with them.
+func Prune(ctx context.Context, dryRun bool) error {
+	p, err := newPruner(ctx, buildsDir(), dryRun)
+	if err != nil {
+		return err
+	}
+	return p.prune(ctx)
+}
+
+func newPruner(ctx context.Context, dir string, dryRun bool) (*pruner, error) {
+	p := &pruner{dryRun: dryRun, dir: dir, held: make(map[string]bool), records: make(map[string]buildState)}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, v := range entries {
+		if !v.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, v.Name())
+		s, err := readBuildState(path)
+		if err != nil && !os.IsNotExist(err) {
+			logger(ctx).Warnf("%v: considering the build as no more running", err)
+		}
+		if err != nil || !s.running() {
+			p.stale = append(p.stale, path)
+			p.records[v.Name()] = s
+			continue
+		}
+		for _, r := range []string{s.Image, s.LoopDevice, s.CryptDevice} {
+			if r != "" {
+				p.held[r] = true
+			}
+		}
+	}
+	return p, nil
+}
+
+func (p *pruner) prune(ctx context.Context) error {
+	mounts, err := p.staleMounts()
+	if err != nil {
+		return err
+	}
+	var merr error
+	busy := make(map[string]bool)
+	for _, v := range mounts {
+		if err := p.run(ctx, v.build, "unmounting "+v.name, "umount", v.name); err != nil {
+			merr = multierr.Append(merr, err)
+			busy[v.build] = true
+		}
+	}
+	crypts, err := p.staleCryptDevices()
+	if err != nil {
+		return multierr.Append(merr, err)
+	}
+	for _, v := range crypts {
+		merr = multierr.Append(merr, p.run(ctx, v.build, "closing encrypted device "+v.name, "cryptsetup", "close", v.name))
+	}
+	loops, err := p.staleLoopDevices()
+	if err != nil {
+		return multierr.Append(merr, err)
+	}
+	for _, v := range loops {
+		if err := p.run(ctx, v.build, "removing "+v.name+" partitions mappings", "kpartx", "-d", v.name); err != nil {
+			merr = multierr.Append(merr, err)
+			continue
+		}
+		merr = multierr.Append(merr, p.run(ctx, v.build, "detaching loop device "+v.name, "losetup", "-d", v.name))
+	}
+	imgs, err := p.staleImages(ctx)
+	if err != nil {
+		return multierr.Append(merr, err)
+	}
+	for _, v := range imgs {
+		merr = multierr.Append(merr, p.run(ctx, v, "removing docker image "+v, "docker", "image", "rm", v))
+	}
+	for _, v := range p.stale {
+		// the work directory is never removed while something may still be mounted in it
+		if busy[filepath.Base(v)] || !p.stillStale(ctx, filepath.Base(v)) {
+			continue
+		}
+		if p.dryRun {
+			logger(ctx).Infof("[dry-run] removing work directory %s", v)
+			continue
+		}
+		logger(ctx).Infof("removing work directory %s", v)
+		merr = multierr.Append(merr, os.RemoveAll(v))
+	}
+	return merr
+}
+
+// run runs the command releasing a resource of the build, unless the build is running again.
+func (p *pruner) run(ctx context.Context, build, msg, c string, args ...string) error {
+	if !p.stillStale(ctx, build) {
+		return nil
+	}
+	if p.dryRun {
+		logger(ctx).Infof("[dry-run] %s", msg)
+		return nil
+	}
+	logger(ctx).Info(msg)
+	return exec.Run(ctx, c, args...)
+}
+
+// stillStale reads the build state record again, right before releasing one of its resources:
+// a build without state record when the pruner was created may have written it since.
+func (p *pruner) stillStale(ctx context.Context, build string) bool {
+	s, err := readBuildState(filepath.Join(p.dir, build))
+	if err == nil && s.running() {
+		logger(ctx).Warnf("build %s is running, keeping its resources", build)
+		return false
+	}
+	return true
+}
+
+// isStale reports whether the build with the uuid was no more running when the pruner was created.
+func (p *pruner) isStale(build string) bool {
+	_, ok := p.records[build]
+	return ok
+}
+
+// buildUUID returns the uuid of the build owning the path under the builds directory, or an empty string.
+func (p *pruner) buildUUID(path string) string {
+	rel, err := filepath.Rel(p.dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	id, _, _ := strings.Cut(rel, string(filepath.Separator))
+	return id
+}
+
+// staleMounts returns the mount points under the work directories of the builds which are no more running,
+// the nested ones first.
+func (p *pruner) staleMounts() ([]resource, error) {
+	b, err := os.ReadFile(procMounts)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []resource
+	for _, l := range strings.Split(string(b), "\n") {
+		f := strings.Fields(l)
+		if len(f) < 2 {
+			continue
+		}
+		if id := p.buildUUID(f[1]); p.isStale(id) {
+			mounts = append(mounts, resource{build: id, name: f[1]})
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i].name) > len(mounts[j].name)
+	})
+	return mounts, nil
+}
+
+// staleCryptDevices returns the encrypted root partitions mappings still open, recorded by the builds no more running.
+func (p *pruner) staleCryptDevices() ([]resource, error) {
+	m, err := filepath.Glob(filepath.Join(sysBlockDir, "dm-*", "dm", "name"))
+	if err != nil {
+		return nil, err
+	}
+	open := make(map[string]bool)
+	for _, v := range m {
+		b, err := os.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+		open[strings.TrimSpace(string(b))] = true
+	}
+	var crypts []resource
+	for id, s := range p.records {
+		if name := s.CryptDevice; strings.HasPrefix(name, cryptPrefix) && open[name] && !p.held[name] {
+			crypts = append(crypts, resource{build: id, name: name})
+		}
+	}
+	sort.Slice(crypts, func(i, j int) bool {
+		return crypts[i].name < crypts[j].name
+	})
+	return crypts, nil
+}
+
+// staleLoopDevices returns the loop devices backed by a file under the work directory of a build no more running.
+func (p *pruner) staleLoopDevices() ([]resource, error) {
+	m, err := filepath.Glob(filepath.Join(sysBlockDir, "loop*", "loop", "backing_file"))
+	if err != nil {
+		return nil, err
+	}
+	var devs []resource
+	for _, v := range m {
+		b, err := os.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+		file := strings.TrimSuffix(strings.TrimSpace(string(b)), " (deleted)")
+		dev := "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(v)))
+		if id := p.buildUUID(file); p.isStale(id) && !p.held[dev] {
+			devs = append(devs, resource{build: id, name: dev})
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].name < devs[j].name
+	})
+	return devs, nil
+}
+
+// staleImages returns the docker images tagged with the uuid of a build no more running.
+func (p *pruner) staleImages(ctx context.Context) ([]string, error) {
+	imgs, err := docker.ImageList(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return p.staleImageRefs(imgs), nil
+}
+
+// staleImageRefs returns the repositories of the images references tagged with the uuid of a build no more running.
+// The images kept after the builds, with the keep-cache option, have no work directory left and are never returned.
+func (p *pruner) staleImageRefs(imgs []string) []string {
+	var stale []string
+	for _, v := range imgs {
+		repo, tag, _ := strings.Cut(v, ":")
+		if tag != "latest" || !p.isStale(repo) || p.held[repo] {
+			continue
+		}
+		stale = append(stale, repo)
+	}
+	return stale
+}
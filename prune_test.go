@@ -0,0 +1,100 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruner(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), perm))
+	}
+	write("boot_id", "2b5c0d2e-5d9b-4d5e-9f4e-2f4bb8a8d1c0\n")
+	defer func(s, m, b string) { sysBlockDir, procMounts, bootIDPath = s, m, b }(sysBlockDir, procMounts, bootIDPath)
+	sysBlockDir, procMounts, bootIDPath = filepath.Join(dir, "sys"), filepath.Join(dir, "mounts"), filepath.Join(dir, "boot_id")
+
+	builds := filepath.Join(dir, "builds")
+	running, killed, unknown := filepath.Join(builds, "running"), filepath.Join(builds, "killed"), filepath.Join(builds, "unknown")
+	require.NoError(t, os.MkdirAll(unknown, os.ModePerm))
+	require.NoError(t, os.MkdirAll(killed, os.ModePerm))
+	require.NoError(t, os.MkdirAll(running, os.ModePerm))
+	require.NoError(t, updateBuildState(running, func(s *buildState) {
+		s.Image, s.LoopDevice, s.CryptDevice = "e4b8a2f4-8a0e-4f6e-9d55-1c0c8d2c8f3a", "/dev/loop0", "d2vm-a-root"
+	}))
+	// the killed build pid was reused by the current process
+	require.NoError(t, updateBuildState(killed, func(s *buildState) {
+		s.StartTime++
+		s.LoopDevice, s.CryptDevice = "/dev/loop1", "d2vm-b-root"
+	}))
+	s, err := readBuildState(running)
+	require.NoError(t, err)
+	assert.True(t, s.running())
+	s, err = readBuildState(killed)
+	require.NoError(t, err)
+	assert.False(t, s.running())
+
+	write("sys/loop0/loop/backing_file", filepath.Join(running, "disk0.d2vm.raw")+"\n")
+	write("sys/loop1/loop/backing_file", filepath.Join(killed, "disk0.d2vm.raw")+" (deleted)\n")
+	write("sys/loop2/loop/backing_file", "/var/lib/images/disk.img\n")
+	write("sys/dm-0/dm/name", "d2vm-a-root\n")
+	write("sys/dm-1/dm/name", "d2vm-b-root\n")
+	write("sys/dm-2/dm/name", "loop1p1\n")
+	// not named in a state record
+	write("sys/dm-3/dm/name", "d2vm-c-root\n")
+	write("mounts", "/dev/sda1 / ext4 rw 0 0\n"+
+		"/dev/mapper/loop0p1 "+filepath.Join(running, "mnt")+" ext4 rw 0 0\n"+
+		"/dev/mapper/d2vm-b-root "+filepath.Join(killed, "mnt")+" ext4 rw 0 0\n"+
+		"/dev/mapper/loop1p1 "+filepath.Join(killed, "mnt", "boot")+" vfat rw 0 0\n")
+
+	p, err := newPruner(context.Background(), builds, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{killed, unknown}, p.stale)
+
+	// the build started after the pruner creation is not stale
+	late := filepath.Join(builds, "late")
+	require.NoError(t, os.MkdirAll(late, os.ModePerm))
+	write("sys/loop3/loop/backing_file", filepath.Join(late, "disk0.d2vm.raw")+"\n")
+	b, err := os.ReadFile(procMounts)
+	require.NoError(t, err)
+	write("mounts", string(b)+"/dev/mapper/loop3p1 "+filepath.Join(late, "mnt")+" ext4 rw 0 0\n")
+
+	mounts, err := p.staleMounts()
+	require.NoError(t, err)
+	assert.Equal(t, []resource{{build: "killed", name: filepath.Join(killed, "mnt", "boot")}, {build: "killed", name: filepath.Join(killed, "mnt")}}, mounts)
+	crypts, err := p.staleCryptDevices()
+	require.NoError(t, err)
+	assert.Equal(t, []resource{{build: "killed", name: "d2vm-b-root"}}, crypts)
+	loops, err := p.staleLoopDevices()
+	require.NoError(t, err)
+	assert.Equal(t, []resource{{build: "killed", name: "/dev/loop1"}}, loops)
+
+	assert.True(t, p.stillStale(context.Background(), "unknown"))
+	// the unknown build wrote its state record after the pruner creation
+	require.NoError(t, updateBuildState(unknown, func(s *buildState) {}))
+	assert.False(t, p.stillStale(context.Background(), "unknown"))
+	assert.True(t, p.stillStale(context.Background(), "killed"))
+	// the image kept with the keep-cache option by a finished build has no work directory
+	imgs := p.staleImageRefs([]string{"killed:latest", "e4b8a2f4-8a0e-4f6e-9d55-1c0c8d2c8f3a:latest", "0a4f5c3e-7b1d-4e8a-9c2f-6d3b8e1a5f70:latest", "unknown:v1", "ubuntu:22.04"})
+	assert.Equal(t, []string{"killed"}, imgs)
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// Overlay is the storage of the read-only root filesystem overlayfs writable layer.
+type Overlay string
+
+const (
+	// OverlayTmpfs stores the writable layer in memory: the changes are lost on reboot.
+	OverlayTmpfs Overlay = "tmpfs"
+	// OverlayPartition stores the writable layer on a dedicated ext4 partition.
+	OverlayPartition Overlay = "partition"
+)
+
+const (
+	// rootFSSquashFS is the root filesystem type passed to the kernel when the root partition holds a squashfs image
+	rootFSSquashFS RootFS = "squashfs"
+	// overlayMinSize is the smallest overlay partition mkfs.ext4 accepts
+	overlayMinSize = 8 * mib
+)
+
+func (o Overlay) String() string {
+	return string(o)
+}
+
+func (o Overlay) IsTmpfs() bool {
+	return o == OverlayTmpfs
+}
+
+func (o Overlay) IsPartition() bool {
+	return o == OverlayPartition
+}
+
+func (o Overlay) IsSupported() bool {
+	return o.IsTmpfs() || o.IsPartition()
+}
+
+func (o Overlay) Validate() error {
+	if !o.IsSupported() {
+		return fmt.Errorf("invalid overlay: %s valid overlays are: tmpfs, partition", o)
+	}
+	return nil
+}
+
+// ReadOnlyRoot configures the read-only root filesystem: the initramfs mounts the root partition read-only
+// as the lower layer of an overlayfs, whose writable layer is stored on a tmpfs or on a dedicated partition.
+// The lower and writable layers are available in /media/root-ro and /media/root-rw.
+type ReadOnlyRoot struct {
+	// Overlay is the writable layer storage. The root filesystem is read-only when it is set.
+	Overlay Overlay
+	// Size is the overlay partition size, or the tmpfs maximum size, which defaults to half of the memory.
+	Size uint64
+	// SquashFS stores the root filesystem as a compressed squashfs image in the root partition.
+	SquashFS bool
+}
+
+func (r ReadOnlyRoot) IsEnabled() bool {
+	return r.Overlay != ""
+}
+
+func (r ReadOnlyRoot) Validate() error {
+	if !r.IsEnabled() {
+		if r.SquashFS || r.Size != 0 {
+			return fmt.Errorf("squashfs and overlay size require a read-only root filesystem")
+		}
+		return nil
+	}
+	if err := r.Overlay.Validate(); err != nil {
+		return err
+	}
+	if r.Overlay.IsPartition() && r.Size < overlayMinSize {
+		return fmt.Errorf("overlay partition size must be at least %s", datasize.ByteSize(overlayMinSize).HR())
+	}
+	return nil
+}
+
+func (b *builder) hasOverlayPart() bool {
+	return b.readOnly.Overlay.IsPartition()
+}
+
+// overlayPartNum returns the overlay partition number: it follows the layout partitions.
+func (b *builder) overlayPartNum() int {
+	return b.rootPartNum() + len(b.layout.mounts()) + ifElse(b.hasVerityPart(), 2, 1)
+}
+
+func (b *builder) overlaySizeMiB() uint64 {
+	return roundUp(b.readOnly.Size, mib) / mib
+}
+
+// overlayStartMiB returns the overlay partition offset: it is allocated from the end of the disk,
+// before the swap partition and the GPT backup header.
+func (b *builder) overlayStartMiB() uint64 {
+	end := b.size/mib - 1
+	if b.hasSwapPart() {
+		end = b.swapStartMiB()
+	}
+	return end - b.overlaySizeMiB()
+}
+
+func (b *builder) makeOverlay(ctx context.Context) (err error) {
+	if !b.hasOverlayPart() {
+		return nil
+	}
+	logger(ctx).Infof("creating overlay partition")
+	b.overlayPart = b.partPath(b.overlayPartNum())
+	return exec.Run(ctx, "mkfs.ext4", append(b.mkfsIDArgs(RootFSExt4.String(), "overlay"), b.overlayPart)...)
+}
+
+func (b *builder) makeOverlayRootless(ctx context.Context, parts map[int]partition) error {
+	if !b.hasOverlayPart() {
+		return nil
+	}
+	part, ok := parts[b.overlayPartNum()]
+	if !ok {
+		return fmt.Errorf("overlay partition %d not found", b.overlayPartNum())
+	}
+	logger(ctx).Infof("creating overlay partition")
+	args := append([]string{"-F", "-U", b.overlayUUID}, b.ext4Extended("overlay", fmt.Sprintf("offset=%d", part.offset))...)
+	return exec.Run(ctx, "mkfs.ext4", append(args, b.diskRaw, fmt.Sprintf("%dk", part.size/1024))...)
+}
+
+// makeSquashFS compresses the staged root filesystem and writes it to the root partition.
+// The boot and layout partitions mount points are kept empty.
+func (b *builder) makeSquashFS(ctx context.Context) error {
+	if !b.readOnly.SquashFS {
+		return nil
+	}
+	parts, err := imgPartitions(ctx, b.diskRaw)
+	if err != nil {
+		return err
+	}
+	root, ok := parts[b.rootPartNum()]
+	if !ok {
+		return fmt.Errorf("root partition %d not found", b.rootPartNum())
+	}
+	logger(ctx).Infof("creating squashfs root file system")
+	p := filepath.Join(filepath.Dir(b.mntPoint), "root.squashfs")
+	defer os.Remove(p)
+	exclude := []string{"boot/*"}
+	for _, v := range b.layout.mounts() {
+		exclude = append(exclude, strings.TrimPrefix(v, "/")+"/*")
+	}
+	if err := b.mksquashfs(ctx, p, exclude...); err != nil {
+		return err
+	}
+	i, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	b.squashFSSize = uint64(i.Size())
+	if b.squashFSSize > root.size {
+		return fmt.Errorf("squashfs root image (%s) does not fit in the root partition (%s)", datasize.ByteSize(i.Size()).HR(), datasize.ByteSize(root.size).HR())
+	}
+	if b.rootless {
+		return exec.Run(ctx, "dd", "if="+p, "of="+b.diskRaw, "bs=1M", fmt.Sprintf("seek=%d", root.offset/mib), "conv=notrunc")
+	}
+	return exec.Run(ctx, "dd", "if="+p, "of="+b.rootDev(), "bs=1M", "conv=notrunc")
+}
+
+// mksquashfs compresses the staged root filesystem to dst, without the excluded paths, relative to the root.
+func (b *builder) mksquashfs(ctx context.Context, dst string, exclude ...string) error {
+	args := []string{b.mntPoint, dst, "-noappend", "-no-progress", "-wildcards"}
+	for _, v := range exclude {
+		args = append(args, "-e", v)
+	}
+	// the rootless staging directory ownership is only known by fakeroot
+	if b.rootless {
+		return b.fakeroot(ctx, "mksquashfs", args...)
+	}
+	return exec.Run(ctx, "mksquashfs", args...)
+}
+
+// overlayCmdline returns the kernel parameters configuring the initramfs root overlay.
+func (b *builder) overlayCmdline() string {
+	if !b.readOnly.IsEnabled() {
+		return ""
+	}
+	// alpine's initramfs supports the tmpfs overlay natively
+	if b.osRelease.ID == ReleaseAlpine {
+		if b.readOnly.Size == 0 {
+			return "overlaytmpfs"
+		}
+		return fmt.Sprintf("overlaytmpfs overlaytmpfsflags=mode=0755,rw,size=%d", b.readOnly.Size)
+	}
+	if b.hasOverlayPart() {
+		return "d2vm.overlay=UUID=" + b.overlayUUID
+	}
+	if b.readOnly.Size == 0 {
+		return "d2vm.overlay=tmpfs"
+	}
+	return fmt.Sprintf("d2vm.overlay=tmpfs d2vm.overlay.size=%d", b.readOnly.Size)
+}
+
+func (b *builder) validateReadOnly() error {
+	if !b.readOnly.IsEnabled() {
+		return nil
+	}
+	if b.osRelease.ID == ReleaseAlpine && (b.hasOverlayPart() || b.readOnly.SquashFS) {
+		return fmt.Errorf("%s only supports a tmpfs overlay on an ext4 root filesystem", b.osRelease.ID)
+	}
+	if b.hasSwapFile() {
+		return fmt.Errorf("swap file is not supported with a read-only root filesystem, use a swap partition")
+	}
+	if !b.readOnly.SquashFS {
+		return nil
+	}
+	if !b.splitBoot {
+		return fmt.Errorf("squashfs root filesystem requires split boot")
+	}
+	if b.isLuksEnabled() {
+		return fmt.Errorf("squashfs root filesystem is not supported with luks encryption")
+	}
+	if !b.rootFS.IsExt() {
+		return fmt.Errorf("squashfs root filesystem cannot be used with a %s root filesystem", b.rootFS)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayCmdline(t *testing.T) {
+	ubuntu := OSRelease{ID: ReleaseUbuntu, VersionID: "22.04"}
+	alpine := OSRelease{ID: ReleaseAlpine, VersionID: "3.18"}
+	tests := []struct {
+		name     string
+		release  OSRelease
+		readOnly ReadOnlyRoot
+		want     string
+	}{
+		{name: "disabled", release: ubuntu},
+		{name: "alpine", release: alpine, readOnly: ReadOnlyRoot{Overlay: OverlayTmpfs}, want: "overlaytmpfs"},
+		{name: "alpine sized", release: alpine, readOnly: ReadOnlyRoot{Overlay: OverlayTmpfs, Size: 64 * mib}, want: "overlaytmpfs overlaytmpfsflags=mode=0755,rw,size=67108864"},
+		{name: "tmpfs", release: ubuntu, readOnly: ReadOnlyRoot{Overlay: OverlayTmpfs}, want: "d2vm.overlay=tmpfs"},
+		{name: "tmpfs sized", release: ubuntu, readOnly: ReadOnlyRoot{Overlay: OverlayTmpfs, Size: 64 * mib}, want: "d2vm.overlay=tmpfs d2vm.overlay.size=67108864"},
+		{name: "partition", release: ubuntu, readOnly: ReadOnlyRoot{Overlay: OverlayPartition, Size: 64 * mib}, want: "d2vm.overlay=UUID=overlay-uuid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &builder{osRelease: tt.release, readOnly: tt.readOnly, overlayUUID: "overlay-uuid"}
+			assert.Equal(t, tt.want, b.overlayCmdline())
+		})
+	}
+}
+
+func TestValidateReadOnly(t *testing.T) {
+	ubuntu := OSRelease{ID: ReleaseUbuntu, VersionID: "22.04"}
+	alpine := OSRelease{ID: ReleaseAlpine, VersionID: "3.18"}
+	tmpfs := ReadOnlyRoot{Overlay: OverlayTmpfs}
+	squashfs := ReadOnlyRoot{Overlay: OverlayTmpfs, SquashFS: true}
+	tests := []struct {
+		name    string
+		b       builder
+		wantErr string
+	}{
+		{name: "disabled", b: builder{osRelease: ubuntu, swapType: SwapFile, swapSize: mib}},
+		{name: "tmpfs", b: builder{osRelease: ubuntu, readOnly: tmpfs, rootFS: RootFSExt4}},
+		{name: "alpine tmpfs", b: builder{osRelease: alpine, readOnly: tmpfs, rootFS: RootFSExt4}},
+		{name: "alpine partition", b: builder{osRelease: alpine, readOnly: ReadOnlyRoot{Overlay: OverlayPartition, Size: 64 * mib}}, wantErr: "only supports a tmpfs overlay"},
+		{name: "alpine squashfs", b: builder{osRelease: alpine, readOnly: squashfs, splitBoot: true}, wantErr: "only supports a tmpfs overlay"},
+		{name: "swap file", b: builder{osRelease: ubuntu, readOnly: tmpfs, swapType: SwapFile, swapSize: mib}, wantErr: "swap file is not supported"},
+		{name: "swap partition", b: builder{osRelease: ubuntu, readOnly: tmpfs, swapType: SwapPartition, swapSize: mib}},
+		{name: "squashfs", b: builder{osRelease: ubuntu, readOnly: squashfs, splitBoot: true, rootFS: RootFSExt4}},
+		{name: "squashfs without split boot", b: builder{osRelease: ubuntu, readOnly: squashfs, rootFS: RootFSExt4}, wantErr: "requires split boot"},
+		{name: "squashfs with luks", b: builder{osRelease: ubuntu, readOnly: squashfs, splitBoot: true, rootFS: RootFSExt4, luksPassword: "root"}, wantErr: "not supported with luks"},
+		{name: "squashfs with btrfs", b: builder{osRelease: ubuntu, readOnly: squashfs, splitBoot: true, rootFS: RootFSBtrfs}, wantErr: "btrfs root filesystem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.b.validateReadOnly()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestOverlayPartNum(t *testing.T) {
+	layout := Layout{Partitions: []LayoutPartition{{Mount: "/"}, {Mount: "/var"}, {Mount: "/home"}}}
+	tests := []struct {
+		name string
+		b    builder
+		want int
+	}{
+		{name: "msdos", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}}, want: 2},
+		{name: "msdos split boot", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}, splitBoot: true}, want: 3},
+		{name: "gpt grub", b: builder{partitionTable: PartitionTableGPT, bootloader: grub{}}, want: 3},
+		{name: "gpt grub-efi split boot", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true}, want: 3},
+		// the overlay partition follows the layout and the verity hash partitions
+		{name: "layout", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, layout: layout}, want: 5},
+		{name: "verity", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, verity: VerityPartition}, want: 4},
+		{name: "layout and verity", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, layout: layout, verity: VerityPartition}, want: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.b.readOnly = ReadOnlyRoot{Overlay: OverlayPartition, Size: 64 * mib}
+			assert.Equal(t, tt.want, tt.b.overlayPartNum())
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// SourceDateEpochEnv is the environment variable holding the reproducible builds timestamp,
+// see https://reproducible-builds.org/specs/source-date-epoch/
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// Reproducible makes the disk image only depend on the source image and the build options:
+// the UUIDs and hash seeds are derived from Seed instead of being random,
+// and the files timestamps are clamped to Epoch.
+type Reproducible struct {
+	// Seed is usually the source image digest. The build is not reproducible when empty.
+	Seed string
+	// Epoch is the timestamp of the files modified by the build.
+	Epoch time.Time
+}
+
+func (r Reproducible) IsEnabled() bool {
+	return r.Seed != ""
+}
+
+// env returns the environment variables setting the timestamps used by the filesystems tools.
+func (r Reproducible) env() []string {
+	s := strconv.FormatInt(r.Epoch.Unix(), 10)
+	return []string{SourceDateEpochEnv + "=" + s, "E2FSPROGS_FAKE_TIME=" + s}
+}
+
+// SourceDateEpoch returns the SOURCE_DATE_EPOCH timestamp, or def if it is not set.
+func SourceDateEpoch(def time.Time) (time.Time, error) {
+	v, ok := os.LookupEnv(SourceDateEpochEnv)
+	if !ok || v == "" {
+		return def, nil
+	}
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %s", SourceDateEpochEnv, v)
+	}
+	return time.Unix(s, 0).UTC(), nil
+}
+
+// seed returns the bytes derived from the seed for name.
+func (b *builder) seed(name string) []byte {
+	s := sha256.Sum256([]byte(b.reproducible.Seed + "/" + name))
+	return s[:]
+}
+
+// newUUID returns the named filesystem or partition UUID: it is random, but in reproducible builds.
+func (b *builder) newUUID(name string) string {
+	if !b.reproducible.IsEnabled() {
+		return uuid.New().String()
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(b.reproducible.Seed+"/"+name)).String()
+}
+
+// mkfsIDArgs returns the mkfs arguments choosing the named filesystem UUID, and ext4 hash seed,
+// in reproducible builds. The filesystems tools choose random ones otherwise.
+func (b *builder) mkfsIDArgs(fs, name string) []string {
+	if !b.reproducible.IsEnabled() {
+		return nil
+	}
+	switch fs {
+	case string(BootFSFat32):
+		// the volume id cannot fail to be derived from the seed
+		id, _, _ := b.fatVolumeID(name)
+		return []string{"-i", id}
+	case string(RootFSXFS):
+		return []string{"-m", "uuid=" + b.newUUID(name)}
+	case string(RootFSExt4):
+		return append([]string{"-U", b.newUUID(name)}, b.ext4Extended(name)...)
+	default:
+		// btrfs and swap
+		return []string{"-U", b.newUUID(name)}
+	}
+}
+
+// ext4Extended returns the mkfs.ext4 extended options, with the directories hash seed derived from name
+// in reproducible builds.
+func (b *builder) ext4Extended(name string, opts ...string) []string {
+	if b.reproducible.IsEnabled() {
+		opts = append(opts, "hash_seed="+b.newUUID(name+"/hash-seed"))
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return []string{"-E", strings.Join(opts, ",")}
+}
+
+// seedPartitionTable replaces the disk and partitions identifiers chosen by parted.
+func (b *builder) seedPartitionTable(ctx context.Context) error {
+	if !b.reproducible.IsEnabled() {
+		return nil
+	}
+	if b.partitionTable.IsMSDOS() {
+		return exec.Run(ctx, "sfdisk", "--disk-id", b.diskRaw, fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(b.seed("disk"))))
+	}
+	parts, err := imgPartitions(ctx, b.diskRaw)
+	if err != nil {
+		return err
+	}
+	var nums []int
+	for k := range parts {
+		nums = append(nums, k)
+	}
+	sort.Ints(nums)
+	args := []string{"--disk-guid=" + b.newUUID("disk")}
+	for _, v := range nums {
+		args = append(args, fmt.Sprintf("--partition-guid=%d:%s", v, b.newUUID(fmt.Sprintf("partition%d", v))))
+	}
+	return exec.Run(ctx, "sgdisk", append(args, b.diskRaw)...)
+}
+
+// verityArgs returns the veritysetup format arguments replacing the random superblock UUID and salt.
+func (b *builder) verityArgs() []string {
+	if !b.reproducible.IsEnabled() {
+		return nil
+	}
+	return []string{"--uuid=" + b.newUUID("verity"), "--salt=" + hex.EncodeToString(b.seed("verity/salt"))}
+}
+
+// clampTimestamps sets the timestamps of the files under dir modified after the epoch to the epoch.
+func (b *builder) clampTimestamps(ctx context.Context, dir string) error {
+	if !b.reproducible.IsEnabled() {
+		return nil
+	}
+	logger(ctx).Infof("clamping %s files timestamps", dir)
+	epoch := "@" + strconv.FormatInt(b.reproducible.Epoch.Unix(), 10)
+	return exec.Run(ctx, "find", dir, "-newermt", epoch, "-exec", "touch", "--no-dereference", "--date="+epoch, "{}", "+")
+}
+
+func (b *builder) validateReproducible() error {
+	if !b.reproducible.IsEnabled() {
+		return nil
+	}
+	if b.isLuksEnabled() {
+		// the volume key must stay random
+		return fmt.Errorf("luks encryption is not supported in reproducible build")
+	}
+	return nil
+}
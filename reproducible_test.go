@@ -0,0 +1,47 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReproducibleIDs(t *testing.T) {
+	random := &builder{}
+	assert.Nil(t, random.mkfsIDArgs(RootFSExt4.String(), "root"))
+	assert.Equal(t, []string{"-E", "offset=1024"}, random.ext4Extended("root", "offset=1024"))
+	assert.NotEqual(t, random.newUUID("root"), random.newUUID("root"))
+
+	b := &builder{reproducible: Reproducible{Seed: "sha256:0123"}}
+	other := &builder{reproducible: Reproducible{Seed: "sha256:4567"}}
+	assert.Equal(t, b.newUUID("root"), b.newUUID("root"))
+	assert.NotEqual(t, b.newUUID("root"), b.newUUID("boot"))
+	assert.NotEqual(t, b.newUUID("root"), other.newUUID("root"))
+
+	id, blkid, err := b.fatVolumeID("boot")
+	assert.NoError(t, err)
+	assert.Len(t, id, 8)
+	assert.Equal(t, id[:4]+"-"+id[4:], blkid)
+	assert.Equal(t, []string{"-i", id}, b.mkfsIDArgs(BootFSFat32.String(), "boot"))
+
+	u := b.newUUID("root")
+	assert.Equal(t, []string{"-U", u, "-E", "hash_seed=" + b.newUUID("root/hash-seed")}, b.mkfsIDArgs(RootFSExt4.String(), "root"))
+	assert.Equal(t, []string{"-m", "uuid=" + u}, b.mkfsIDArgs(RootFSXFS.String(), "root"))
+	assert.Equal(t, []string{"-U", u}, b.mkfsIDArgs(RootFSBtrfs.String(), "root"))
+	// the extended options are merged as mkfs.ext4 only keeps the last -E
+	assert.Equal(t, []string{"-E", "offset=1024,hash_seed=" + b.newUUID("root/hash-seed")}, b.ext4Extended("root", "offset=1024"))
+}
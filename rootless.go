@@ -0,0 +1,232 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// The rootless build path assembles the disk image without loop devices, device mapper nor mounts:
+// the rootfs is extracted in a staging directory under fakeroot, then the partitions' filesystems
+// are created directly inside the raw image file at their offsets (mkfs.ext4 -d, mkfs.fat + mcopy)
+// and the bootloader is installed in the image file.
+
+type partition struct {
+	num    int
+	offset uint64
+	size   uint64
+}
+
+// imgPartitions returns the partitions of the disk image file, as reported by parted.
+func imgPartitions(ctx context.Context, disk string) (map[int]partition, error) {
+	o, _, err := exec.RunOut(ctx, "parted", "-m", "-s", disk, "unit", "B", "print")
+	if err != nil {
+		return nil, err
+	}
+	return parsePartedPartitions(o)
+}
+
+// parsePartedPartitions parses the partitions of the machine readable parted print output, in bytes.
+func parsePartedPartitions(o string) (map[int]partition, error) {
+	var err error
+	parts := make(map[int]partition)
+	// the first two lines are the unit and the disk description
+	lines := strings.Split(strings.TrimSpace(o), "\n")
+	for _, l := range lines[min(len(lines), 2):] {
+		f := strings.Split(strings.TrimSuffix(l, ";"), ":")
+		if len(f) < 4 {
+			return nil, fmt.Errorf("unexpected parted output: %s", l)
+		}
+		var p partition
+		if p.num, err = strconv.Atoi(f[0]); err != nil {
+			return nil, fmt.Errorf("unexpected parted partition number: %s", f[0])
+		}
+		if p.offset, err = strconv.ParseUint(strings.TrimSuffix(f[1], "B"), 10, 64); err != nil {
+			return nil, fmt.Errorf("unexpected parted partition start: %s", f[1])
+		}
+		if p.size, err = strconv.ParseUint(strings.TrimSuffix(f[3], "B"), 10, 64); err != nil {
+			return nil, fmt.Errorf("unexpected parted partition size: %s", f[3])
+		}
+		parts[p.num] = p
+	}
+	return parts, nil
+}
+
+// fatVolumeID returns the named fat volume id, formatted for mkfs.fat and as reported by blkid.
+// It is random, but in reproducible builds.
+func (b *builder) fatVolumeID(name string) (id string, blkid string, err error) {
+	v := make([]byte, 4)
+	if b.reproducible.IsEnabled() {
+		copy(v, b.seed(name))
+	} else if _, err := rand.Read(v); err != nil {
+		return "", "", err
+	}
+	id = strings.ToUpper(hex.EncodeToString(v))
+	return id, id[:4] + "-" + id[4:], nil
+}
+
+func (b *builder) fakeroot(ctx context.Context, c string, args ...string) error {
+	return exec.Run(ctx, "fakeroot", b.fakerootArgs(c, args...)...)
+}
+
+// fakerootArgs returns the fakeroot arguments running the command, sharing the ownership state between the calls.
+func (b *builder) fakerootArgs(c string, args ...string) []string {
+	state := filepath.Join(filepath.Dir(b.mntPoint), "fakeroot.state")
+	fargs := []string{"-s", state}
+	if _, err := os.Stat(state); err == nil {
+		fargs = append(fargs, "-i", state)
+	}
+	return append(append(fargs, "--", c), args...)
+}
+
+func (b *builder) prepareRootless(ctx context.Context) (err error) {
+	logger(ctx).Infof("preparing rootfs staging directory")
+	if err := os.MkdirAll(filepath.Join(b.mntPoint, "boot"), os.ModePerm); err != nil {
+		return err
+	}
+	// there is no block device to ask the filesystems UUIDs to, so we choose them ourselves
+	b.rootUUID = b.newUUID("root")
+	if b.hasSwapPart() {
+		b.swapUUID = b.newUUID("swap")
+	}
+	if b.hasOverlayPart() {
+		b.overlayUUID = b.newUUID("overlay")
+	}
+	if b.readOnly.SquashFS {
+		if b.rootPartUUID, err = b.partUUID(ctx, b.rootPartNum()); err != nil {
+			return err
+		}
+	}
+	if err := b.prepareLayoutRootless(); err != nil {
+		return err
+	}
+	b.bootFATID, b.bootUUID, err = b.fatVolumeID("boot")
+	return err
+}
+
+func (b *builder) copyRootFSRootless(ctx context.Context) error {
+	logger(ctx).Infof("copying rootfs to staging directory")
+	r := b.img.tarball()
+	defer r.Close()
+	// the image filesystem is streamed to tar, without any intermediate archive file
+	cmd := exec.CommandContext(ctx, "fakeroot", b.fakerootArgs("tar", "xpf", "-", "--numeric-owner", "-C", b.mntPoint)...)
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("fakeroot tar: stderr: %s error: %w", stderr.String(), err)
+	}
+	return nil
+}
+
+func (b *builder) populateImgRootless(ctx context.Context) error {
+	parts, err := imgPartitions(ctx, b.diskRaw)
+	if err != nil {
+		return err
+	}
+	boot, ok := parts[b.bootPartNum()]
+	if !ok {
+		return fmt.Errorf("boot partition %d not found", b.bootPartNum())
+	}
+	root, ok := parts[b.rootPartNum()]
+	if !ok {
+		return fmt.Errorf("root partition %d not found", b.rootPartNum())
+	}
+	b.bootOffset = boot.offset
+
+	if err := b.makeSwapRootless(ctx, parts); err != nil {
+		return err
+	}
+	if err := b.makeOverlayRootless(ctx, parts); err != nil {
+		return err
+	}
+	if err := b.populateLayoutRootless(ctx, parts); err != nil {
+		return err
+	}
+
+	logger(ctx).Infof("creating boot file system")
+	bootDir := filepath.Join(b.mntPoint, "boot")
+	if err := exec.Run(ctx, "mkfs.fat", "-F32", "-i", b.bootFATID, "--offset", strconv.FormatUint(boot.offset/512, 10), b.diskRaw, strconv.FormatUint(boot.size/1024, 10)); err != nil {
+		return err
+	}
+	if err := mcopyDir(ctx, b.diskRaw, boot.offset, bootDir); err != nil {
+		return err
+	}
+	// the boot partition content must not be duplicated in the root filesystem
+	if err := os.RemoveAll(bootDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(bootDir, 0755); err != nil {
+		return err
+	}
+
+	if b.readOnly.SquashFS {
+		return b.makeSquashFS(ctx)
+	}
+	logger(ctx).Infof("creating root file system")
+	args := append([]string{"-F", "-U", b.rootUUID, "-d", b.mntPoint}, b.ext4Extended("root", fmt.Sprintf("offset=%d", root.offset))...)
+	args = append(args, b.rootFSOpts.args(b.rootFS)...)
+	return b.fakeroot(ctx, "mkfs.ext4", append(args, b.diskRaw, fmt.Sprintf("%dk", root.size/1024))...)
+}
+
+// mcopyDir copies the content of dir to the root of the fat filesystem found at offset in the disk image img.
+func mcopyDir(ctx context.Context, img string, offset uint64, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	// the files modification times are preserved for reproducible builds
+	args := []string{"-s", "-m", "-i", fmt.Sprintf("%s@@%d", img, offset)}
+	for _, v := range entries {
+		args = append(args, filepath.Join(dir, v.Name()))
+	}
+	return exec.Run(ctx, "mcopy", append(args, "::/")...)
+}
+
+func (b *builder) installBootloaderRootless(ctx context.Context) error {
+	logger(ctx).Infof("installing bootloader")
+	bl, ok := b.bootloader.(RootlessBootloader)
+	if !ok {
+		return fmt.Errorf("bootloader does not support rootless installation")
+	}
+	return bl.SetupImage(ctx, b.diskRaw, b.bootOffset, b.cmdline(ctx))
+}
+
+func (b *builder) cleanUpRootless(ctx context.Context) error {
+	// the staging directory may contain read-only directories we would not be able to remove
+	if _, err := os.Stat(b.mntPoint); err != nil {
+		return nil
+	}
+	if err := exec.Run(ctx, "chmod", "-R", "u+rwX", b.mntPoint); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(b.mntPoint); err != nil {
+		return err
+	}
+	return os.MkdirAll(b.mntPoint, os.ModePerm)
+}
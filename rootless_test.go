@@ -0,0 +1,162 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePartedPartitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    map[int]partition
+		wantErr bool
+	}{
+		{
+			name: "msdos",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+1:1048576B:1073741823B:1072693248B:ext4::boot;
+`,
+			want: map[int]partition{1: {num: 1, offset: 1048576, size: 1072693248}},
+		},
+		{
+			name: "gpt",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:gpt::;
+1:1048576B:2097151B:1048576B::bios:bios_grub;
+2:2097152B:1073724927B:1071627776B:ext4:root:;
+`,
+			want: map[int]partition{
+				1: {num: 1, offset: 1048576, size: 1048576},
+				2: {num: 2, offset: 2097152, size: 1071627776},
+			},
+		},
+		{
+			name: "split boot",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+1:1048576B:105906175B:104857600B:fat32::boot, esp;
+2:105906176B:1073741823B:967835648B:ext4::;
+`,
+			want: map[int]partition{
+				1: {num: 1, offset: 1048576, size: 104857600},
+				2: {num: 2, offset: 105906176, size: 967835648},
+			},
+		},
+		{
+			name: "no partitions",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+`,
+			want: map[int]partition{},
+		},
+		{
+			name: "missing fields",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+1:1048576B:1073741823B;
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid number",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+one:1048576B:1073741823B:1072693248B:ext4::;
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid start",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+1:1.0MB:1073741823B:1072693248B:ext4::;
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid size",
+			output: `BYT;
+/tmp/disk.raw:1073741824B:file:512:512:msdos::;
+1:1048576B:1073741823B:-1B:ext4::;
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePartedPartitions(tt.output)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCopyRootFSRootless(t *testing.T) {
+	if _, err := exec.LookPath("fakeroot"); err != nil {
+		t.Skip("fakeroot not found")
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "home/user/file", Typeflag: tar.TypeReg, Mode: 0600, Uid: 1000, Gid: 1000, Size: 4}))
+	_, err := tw.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+	img, err := mutate.AppendLayers(empty.Image, l)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	b := &builder{img: &image{img: img}, mntPoint: filepath.Join(dir, "root")}
+	require.NoError(t, os.Mkdir(b.mntPoint, 0755))
+	require.NoError(t, b.copyRootFSRootless(context.Background()))
+
+	data, err := os.ReadFile(filepath.Join(b.mntPoint, "home/user/file"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	// the image ownership is only recorded in the fakeroot state
+	o, err := exec.Command("fakeroot", b.fakerootArgs("stat", "-c", "%u:%g", filepath.Join(b.mntPoint, "home/user/file"))...).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "1000:1000", strings.TrimSpace(string(o)))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, v := range entries {
+		assert.NotEqual(t, ".tar", filepath.Ext(v.Name()), "the image must be streamed")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is a JSON schema, limited to the keywords describing the build file.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 []string           `json:"type,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+// schemaEnums are the values of the enumerated types.
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(NetworkManager("")):   {string(NetworkManagerNone), string(NetworkManagerIfupdown2), string(NetworkManagerNetplan)},
+	reflect.TypeOf(BootFS("")):           {string(BootFSExt4), string(BootFSFat32)},
+	reflect.TypeOf(PartitionTable("")):   {string(PartitionTableMSDOS), string(PartitionTableGPT)},
+	reflect.TypeOf(RootFS("")):           {string(RootFSExt4), string(RootFSXFS), string(RootFSBtrfs)},
+	reflect.TypeOf(SwapType("")):         {string(SwapPartition), string(SwapFile)},
+	reflect.TypeOf(Overlay("")):          {string(OverlayTmpfs), string(OverlayPartition)},
+	reflect.TypeOf(Verity("")):           {string(VerityPartition), string(VerityAppended)},
+	reflect.TypeOf(LuksUnlock("")):       {string(LuksUnlockInitramfs), string(LuksUnlockBoot)},
+	reflect.TypeOf(QCOW2Compression("")): {string(QCOW2CompressionZlib), string(QCOW2CompressionZstd)},
+	reflect.TypeOf(NIC("")):              {string(NICE1000), string(NICE1000e), string(NICVmxnet3), string(NICVirtio)},
+	reflect.TypeOf(VagrantProvider("")):  {string(VagrantProviderLibvirt), string(VagrantProviderVirtualBox)},
+	reflect.TypeOf(OutputKind("")):       {string(OutputKindDisk), string(OutputKindNetboot), string(OutputKindMicroVM)},
+	reflect.TypeOf(NetbootRoot("")):      {string(NetbootRootHTTP), string(NetbootRootNFS)},
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// BuildFileSchema returns the build file JSON schema.
+func BuildFileSchema() *Schema {
+	s := schemaOf(reflect.TypeOf(BuildFile{}))
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.Title = "d2vm build file"
+	return s
+}
+
+func schemaOf(t reflect.Type) *Schema {
+	if reflect.PointerTo(t).Implements(textUnmarshaler) {
+		// sizes are either a number of bytes or a human readable size
+		return &Schema{Type: []string{"string", "integer"}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return &Schema{Type: []string{"string"}, Enum: schemaEnums[t]}
+	case reflect.Bool:
+		return &Schema{Type: []string{"boolean"}}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &Schema{Type: []string{"integer"}}
+	case reflect.Float64:
+		return &Schema{Type: []string{"number"}}
+	case reflect.Slice:
+		return &Schema{Type: []string{"array"}, Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: []string{"object"}, AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: []string{"object"}, Properties: make(map[string]*Schema), AdditionalProperties: false}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if opts == "inline" {
+				for k, v := range schemaOf(f.Type).Properties {
+					s.Properties[k] = v
+				}
+				continue
+			}
+			s.Properties[name] = schemaOf(f.Type)
+		}
+		return s
+	default:
+		panic(fmt.Sprintf("unsupported schema type: %s", t))
+	}
+}
+
+func (s *Schema) allows(typ string) bool {
+	for _, v := range s.Type {
+		if v == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// validate validates the YAML node against the schema.
+func (s *Schema) validate(n *yaml.Node, path string) error {
+	if n.Kind == yaml.AliasNode {
+		return s.validate(n.Alias, path)
+	}
+	at := func(format string, args ...any) error {
+		return fmt.Errorf("line %d: %s: %s", n.Line, strings.TrimPrefix(path, "."), fmt.Sprintf(format, args...))
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return nil
+	}
+	switch {
+	case s.allows("object"):
+		if n.Kind != yaml.MappingNode {
+			return at("expected an object")
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			p, ok := s.Properties[k.Value]
+			if !ok {
+				a, isSchema := s.AdditionalProperties.(*Schema)
+				if !isSchema {
+					return fmt.Errorf("line %d: %s: unknown field", k.Line, strings.TrimPrefix(path+"."+k.Value, "."))
+				}
+				p = a
+			}
+			if err := p.validate(v, path+"."+k.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case s.allows("array"):
+		if n.Kind != yaml.SequenceNode {
+			return at("expected an array")
+		}
+		for i, v := range n.Content {
+			if err := s.Items.validate(v, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if n.Kind != yaml.ScalarNode {
+		return at("expected %s", strings.Join(s.Type, " or "))
+	}
+	switch {
+	case s.allows("string"):
+	case s.allows("integer") && n.Tag == "!!int":
+	case s.allows("number") && (n.Tag == "!!int" || n.Tag == "!!float"):
+	case s.allows("boolean") && n.Tag == "!!bool":
+	default:
+		return at("expected %s", strings.Join(s.Type, " or "))
+	}
+	if len(s.Enum) == 0 {
+		return nil
+	}
+	for _, v := range s.Enum {
+		if n.Value == v {
+			return nil
+		}
+	}
+	return at("invalid value %q, valid values are: %s", n.Value, strings.Join(s.Enum, ", "))
+}
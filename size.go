@@ -0,0 +1,234 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+)
+
+const (
+	sizeAuto = "auto"
+
+	mib = uint64(datasize.MB)
+	gib = uint64(datasize.GB)
+
+	// fsBlockSize is the block size used to estimate the space used by the rootfs files
+	fsBlockSize = 4096
+	// luksHeaderSize is the default LUKS2 header size
+	luksHeaderSize = 16 * mib
+	// bootloaderSize is the space reserved for the files installed by the bootloader, e.g. grub modules
+	bootloaderSize = 32 * mib
+)
+
+// Size is the size of the disk image.
+type Size struct {
+	// Bytes is the disk size, or the free space added to the computed size when Auto is set.
+	Bytes uint64
+	// Auto computes the smallest disk size able to hold the image.
+	Auto bool
+}
+
+// ParseSize parses a disk size, e.g. 10G, auto or auto+2G.
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	var size Size
+	if strings.HasPrefix(strings.ToLower(s), sizeAuto) {
+		size.Auto = true
+		s = strings.TrimSpace(s[len(sizeAuto):])
+		if s == "" {
+			return size, nil
+		}
+		if !strings.HasPrefix(s, "+") {
+			return Size{}, fmt.Errorf("invalid size: expected auto or auto+<size>, e.g. auto+2G")
+		}
+		s = strings.TrimSpace(strings.TrimPrefix(s, "+"))
+	}
+	if s == "" {
+		return Size{}, fmt.Errorf("invalid size: empty size")
+	}
+	var v datasize.ByteSize
+	if err := v.UnmarshalText([]byte(s)); err != nil {
+		return Size{}, fmt.Errorf("invalid size: %w", err)
+	}
+	size.Bytes = uint64(v)
+	return size, nil
+}
+
+func (s Size) String() string {
+	if !s.Auto {
+		return datasize.ByteSize(s.Bytes).HR()
+	}
+	if s.Bytes == 0 {
+		return sizeAuto
+	}
+	return sizeAuto + "+" + datasize.ByteSize(s.Bytes).HR()
+}
+
+// diskUsage is the space used by the flattened image filesystem.
+type diskUsage struct {
+	// root is the number of bytes used outside /boot
+	root uint64
+	// boot is the number of bytes used in /boot
+	boot uint64
+	// inodes is the number of files, directories and links
+	inodes uint64
+	// mounts is the usage of the layout partitions, by mount point
+	mounts map[string]*mountUsage
+}
+
+type mountUsage struct {
+	bytes  uint64
+	inodes uint64
+}
+
+// mount returns the usage of the deepest mount point containing name, if any.
+func (u diskUsage) mount(name string) *mountUsage {
+	var m string
+	for k := range u.mounts {
+		if isUnder(name, k) && len(k) > len(m) {
+			m = k
+		}
+	}
+	return u.mounts[m]
+}
+
+// isUnder returns whether name is dir or is in dir.
+func isUnder(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// minSize returns the smallest filesystem able to hold data bytes in inodes files.
+// These are estimations based on the mkfs defaults, they are intentionally conservative.
+func (f RootFS) minSize(data, inodes uint64, opts RootFSOptions) uint64 {
+	switch {
+	case f.IsXFS():
+		// xfs allocates inodes dynamically, the log is capped at 64MiB for small filesystems
+		// and mkfs.xfs refuses filesystems smaller than 300MiB
+		return max(div(data+inodes*512+64*mib, 0.95), 300*mib)
+	case f.IsBtrfs():
+		// metadata is duplicated and small files are inlined in the metadata
+		return max(div(data+2*inodes*1024, 0.9)+256*mib, 128*mib)
+	default:
+		ratio := uint64(16384)
+		if opts.InodeRatio != 0 {
+			ratio = opts.InodeRatio
+		}
+		reserved := 5.0
+		if opts.ReservedBlocks != nil {
+			reserved = *opts.ReservedBlocks
+		}
+		// the inode tables use 256 bytes per inode, plus some slack for the bitmaps and the group descriptors
+		free := 1 - reserved/100 - 256/float64(ratio) - 0.02
+		size := div(data+ext4JournalSize(data), free)
+		// there must be enough inodes for the files
+		return max(size, div(inodes*ratio, 0.9))
+	}
+}
+
+// ext4JournalSize mirrors the mke2fs default journal size, based on the filesystem size.
+func ext4JournalSize(size uint64) uint64 {
+	switch {
+	case size < 1*gib:
+		return 16 * mib
+	case size < 2*gib:
+		return 32 * mib
+	case size < 16*gib:
+		return 64 * mib
+	case size < 32*gib:
+		return 128 * mib
+	default:
+		return 1 * gib
+	}
+}
+
+// diskSize measures the image and returns the disk size to use, failing if an explicit size is too small.
+func (b *builder) diskSize(ctx context.Context, size Size) (uint64, error) {
+	logger(ctx).Infof("measuring image size")
+	u, err := b.img.diskUsage(ctx, b.layout.mounts()...)
+	if err != nil {
+		return 0, err
+	}
+	required, err := b.requiredSize(u)
+	if err != nil {
+		return 0, err
+	}
+	logger(ctx).Infof("image uses %s, the disk must be at least %s", datasize.ByteSize(u.root+u.boot).HR(), datasize.ByteSize(required).HR())
+	s := size.Bytes
+	if size.Auto {
+		s = required + roundUp(size.Bytes, mib)
+		logger(ctx).Infof("using a %s disk", datasize.ByteSize(s).HR())
+	} else if s < required {
+		return 0, fmt.Errorf("disk size %s is too small for the image: at least %s is required, use a larger size or auto", datasize.ByteSize(s).HR(), datasize.ByteSize(required).HR())
+	}
+	if b.partitionTable.IsMSDOS() && s > msdosMaxSize {
+		return 0, fmt.Errorf("msdos partition table does not support disks larger than %s, use gpt instead", datasize.ByteSize(msdosMaxSize).HR())
+	}
+	return s, nil
+}
+
+// requiredSize returns the smallest disk size able to hold the image, rounded up to the MiB.
+func (b *builder) requiredSize(u diskUsage) (uint64, error) {
+	// the first partition starts at 1MiB, after the bios boot partition if any
+	start := ifElse(b.hasBIOSBootPart(), 2*mib, mib)
+	if b.splitBoot && u.boot+bootloaderSize > b.bootSize*mib-start {
+		return 0, fmt.Errorf("boot partition size is too small: the image /boot uses %s, use a larger boot size", datasize.ByteSize(u.boot).HR())
+	}
+	data := u.root
+	if !b.splitBoot {
+		data += u.boot + bootloaderSize
+	}
+	if b.hasSwapFile() {
+		data += b.swapSizeMiB() * mib
+	}
+	size := b.rootFS.minSize(data, u.inodes, b.rootFSOpts)
+	if b.verity.IsEnabled() {
+		// the hash tree partition is sized for the whole disk space left to the root partition:
+		// keep an extra MiB for the rounding
+		size += roundUp(verityHashSize(size), mib) + mib
+	}
+	if b.luksPassword != "" {
+		size += luksHeaderSize
+	}
+	// the root partition starts at the end of the boot partition, which ends at bootSize
+	size += ifElse(b.splitBoot, b.bootSize*mib, start)
+	for k, v := range u.mounts {
+		p, _ := b.layout.partition(k)
+		if need := p.minSize(v.bytes, v.inodes); uint64(p.Size) < need {
+			return 0, fmt.Errorf("%s partition size is too small: the image %s uses %s, at least %s is required", k, k, datasize.ByteSize(v.bytes).HR(), datasize.ByteSize(need).HR())
+		}
+		size += roundUp(uint64(p.Size), mib)
+	}
+	if b.hasOverlayPart() {
+		size += b.overlaySizeMiB() * mib
+	}
+	if b.hasSwapPart() {
+		size += b.swapSizeMiB() * mib
+	}
+	// the GPT backup header is stored at the end of the disk
+	size += mib
+	return roundUp(size, mib), nil
+}
+
+func div(v uint64, f float64) uint64 {
+	return uint64(float64(v) / f)
+}
+
+func roundUp(v, to uint64) uint64 {
+	return (v + to - 1) / to * to
+}
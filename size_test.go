@@ -0,0 +1,84 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Size
+		wantErr bool
+	}{
+		{in: "10G", want: Size{Bytes: 10 * gib}},
+		{in: "512M", want: Size{Bytes: 512 * mib}},
+		{in: "auto", want: Size{Auto: true}},
+		{in: "AUTO", want: Size{Auto: true}},
+		{in: "auto+2G", want: Size{Bytes: 2 * gib, Auto: true}},
+		{in: "auto + 500M", want: Size{Bytes: 500 * mib, Auto: true}},
+		{in: "auto2G", wantErr: true},
+		{in: "auto+", wantErr: true},
+		{in: "ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRequiredSize(t *testing.T) {
+	u := diskUsage{root: 900 * mib, boot: 60 * mib, inodes: 30000}
+	b := &builder{rootFS: RootFSExt4, partitionTable: PartitionTableMSDOS, bootSize: 100}
+	single, err := b.requiredSize(u)
+	require.NoError(t, err)
+	assert.Zero(t, single%mib)
+	assert.Greater(t, single, u.root+u.boot)
+
+	b.splitBoot = true
+	split, err := b.requiredSize(u)
+	require.NoError(t, err)
+	assert.Greater(t, split, u.root+b.bootSize*mib)
+
+	b.luksPassword = "root"
+	luks, err := b.requiredSize(u)
+	require.NoError(t, err)
+	assert.Equal(t, split+luksHeaderSize, luks)
+
+	b.swapType, b.swapSize = SwapPartition, 512*mib
+	swap, err := b.requiredSize(u)
+	require.NoError(t, err)
+	assert.Equal(t, luks+512*mib, swap)
+
+	b.readOnly = ReadOnlyRoot{Overlay: OverlayPartition, Size: 256 * mib}
+	overlay, err := b.requiredSize(u)
+	require.NoError(t, err)
+	assert.Equal(t, swap+256*mib, overlay)
+
+	b.bootSize = 50
+	_, err = b.requiredSize(u)
+	assert.Error(t, err)
+}
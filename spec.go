@@ -0,0 +1,531 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// BuildFileName is the default build file name.
+	BuildFileName = "d2vm.yaml"
+	// defaultBootSize is the default boot partition size in MB
+	defaultBootSize = 100
+)
+
+// ConvertSpec is the serializable form of the conversion options.
+// Its keys are the d2vm convert and build flags names.
+type ConvertSpec struct {
+	// Output is the output image path, its extension determines the image format.
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+	// Formats are the output images formats, written next to the output image with the format extension.
+	Formats []string `json:"formats,omitempty" yaml:"formats,omitempty"`
+	// OutputKind is the kind of artifacts to write: disk, netboot or microvm, defaults to disk.
+	OutputKind OutputKind `json:"output-kind,omitempty" yaml:"output-kind,omitempty"`
+	// NetbootRoot is the netboot root filesystem source: http or nfs, defaults to http.
+	NetbootRoot NetbootRoot `json:"netboot-root,omitempty" yaml:"netboot-root,omitempty"`
+	// NetbootURL is the base URL of the netboot artifacts with http, or the NFS export with nfs.
+	NetbootURL string `json:"netboot-url,omitempty" yaml:"netboot-url,omitempty"`
+	// QCOW2Compression compresses the qcow2 image clusters: zlib or zstd.
+	QCOW2Compression QCOW2Compression `json:"qcow2-compression,omitempty" yaml:"qcow2-compression,omitempty"`
+	// ApplianceCPUs is the number of virtual CPUs of the ova, ovf and box appliances, defaults to 1.
+	ApplianceCPUs uint `json:"appliance-cpus,omitempty" yaml:"appliance-cpus,omitempty"`
+	// ApplianceMemory is the memory size in MiB of the ova, ovf and box appliances, defaults to 1024.
+	ApplianceMemory uint64 `json:"appliance-memory,omitempty" yaml:"appliance-memory,omitempty"`
+	// ApplianceNIC is the network adapter type of the ova, ovf and box appliances, defaults to e1000.
+	ApplianceNIC NIC `json:"appliance-nic,omitempty" yaml:"appliance-nic,omitempty"`
+	// VagrantProvider is the provider of the .box Vagrant box: libvirt or virtualbox, defaults to libvirt.
+	VagrantProvider VagrantProvider `json:"vagrant-provider,omitempty" yaml:"vagrant-provider,omitempty"`
+	// Size is the disk size, e.g. 10G, auto or auto+2G, defaults to 10G.
+	Size string `json:"size,omitempty" yaml:"size,omitempty"`
+	// Password is the root user password.
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	// CmdLineExtra are extra kernel command line arguments.
+	CmdLineExtra string `json:"append-to-cmdline,omitempty" yaml:"append-to-cmdline,omitempty"`
+	// NetworkManager is the network manager to install, defaults to the distribution one.
+	NetworkManager NetworkManager `json:"network-manager,omitempty" yaml:"network-manager,omitempty"`
+	// BootLoader is the bootloader name, defaults to syslinux on amd64 and grub-efi on arm64.
+	BootLoader string `json:"bootloader,omitempty" yaml:"bootloader,omitempty"`
+	// Raw converts the image as is, without installing the kernel.
+	Raw bool `json:"raw,omitempty" yaml:"raw,omitempty"`
+
+	// SplitBoot splits the boot partition from the root partition.
+	SplitBoot bool `json:"split-boot,omitempty" yaml:"split-boot,omitempty"`
+	// BootSize is the boot partition size in MB, defaults to 100.
+	BootSize uint64 `json:"boot-size,omitempty" yaml:"boot-size,omitempty"`
+	// BootFS is the boot partition filesystem.
+	BootFS BootFS `json:"boot-fs,omitempty" yaml:"boot-fs,omitempty"`
+	// PartitionTable is the disk partition table.
+	PartitionTable PartitionTable `json:"partition-table,omitempty" yaml:"partition-table,omitempty"`
+
+	// RootFS is the root partition filesystem.
+	RootFS RootFS `json:"root-fs,omitempty" yaml:"root-fs,omitempty"`
+	// RootFSLabel is the root filesystem label.
+	RootFSLabel string `json:"root-fs-label,omitempty" yaml:"root-fs-label,omitempty"`
+	// RootFSInodeRatio is the root filesystem bytes-per-inode ratio, ext4 only.
+	RootFSInodeRatio uint64 `json:"root-fs-inode-ratio,omitempty" yaml:"root-fs-inode-ratio,omitempty"`
+	// RootFSReservedBlocks is the percentage of the root filesystem blocks reserved for the super-user, ext4 only.
+	RootFSReservedBlocks *float64 `json:"root-fs-reserved-blocks,omitempty" yaml:"root-fs-reserved-blocks,omitempty"`
+	// RootFSFeatures are the root filesystem features to enable, or to disable when prefixed with '^', ext4 only.
+	RootFSFeatures []string `json:"root-fs-features,omitempty" yaml:"root-fs-features,omitempty"`
+
+	// SwapSize is the swap size, no swap is added if not set.
+	SwapSize datasize.ByteSize `json:"swap-size,omitempty" yaml:"swap-size,omitempty"`
+	// SwapType is the swap type, defaults to partition.
+	SwapType SwapType `json:"swap-type,omitempty" yaml:"swap-type,omitempty"`
+
+	// Layout is the partitions layout.
+	Layout *Layout `json:"layout,omitempty" yaml:"layout,omitempty"`
+
+	// ReadOnly mounts the root filesystem read-only. It is enabled by Overlay, SquashFS and Verity.
+	ReadOnly bool `json:"read-only,omitempty" yaml:"read-only,omitempty"`
+	// Overlay is the read-only root filesystem writable layer storage, defaults to tmpfs.
+	Overlay Overlay `json:"overlay,omitempty" yaml:"overlay,omitempty"`
+	// OverlaySize is the overlay partition size, or the overlay tmpfs maximum size.
+	OverlaySize datasize.ByteSize `json:"overlay-size,omitempty" yaml:"overlay-size,omitempty"`
+	// SquashFS stores the read-only root filesystem as a squashfs image.
+	SquashFS bool `json:"squashfs,omitempty" yaml:"squashfs,omitempty"`
+	// Verity protects the read-only root partition with dm-verity.
+	Verity Verity `json:"verity,omitempty" yaml:"verity,omitempty"`
+
+	// LuksPassword encrypts the root partition with LUKS.
+	LuksPassword string `json:"luks-password,omitempty" yaml:"luks-password,omitempty"`
+	// LuksRecoveryPassword is an additional LUKS passphrase.
+	LuksRecoveryPassword string `json:"luks-recovery-password,omitempty" yaml:"luks-recovery-password,omitempty"`
+	// LuksKeyFile is a key file added to the LUKS key slots.
+	LuksKeyFile string `json:"luks-key-file,omitempty" yaml:"luks-key-file,omitempty"`
+	// LuksUnlock unlocks the root partition at boot with the key file.
+	LuksUnlock LuksUnlock `json:"luks-unlock,omitempty" yaml:"luks-unlock,omitempty"`
+	// LuksCipher is the LUKS2 encryption cipher.
+	LuksCipher string `json:"luks-cipher,omitempty" yaml:"luks-cipher,omitempty"`
+	// LuksKeySize is the LUKS2 encryption key size in bits.
+	LuksKeySize int `json:"luks-key-size,omitempty" yaml:"luks-key-size,omitempty"`
+	// LuksPBKDF is the LUKS2 key slots key derivation function.
+	LuksPBKDF string `json:"luks-pbkdf,omitempty" yaml:"luks-pbkdf,omitempty"`
+	// LuksPBKDFMemory is the LUKS2 argon2 memory cost in KiB.
+	LuksPBKDFMemory uint64 `json:"luks-pbkdf-memory,omitempty" yaml:"luks-pbkdf-memory,omitempty"`
+	// LuksIterTime is the LUKS2 key derivation time in milliseconds.
+	LuksIterTime uint64 `json:"luks-iter-time,omitempty" yaml:"luks-iter-time,omitempty"`
+
+	// Rootless builds the image without root privileges.
+	Rootless bool `json:"rootless,omitempty" yaml:"rootless,omitempty"`
+	// Reproducible derives the image UUIDs and hash seeds from the source image digest.
+	Reproducible bool `json:"reproducible,omitempty" yaml:"reproducible,omitempty"`
+	// KeepCache keeps the docker images after the build.
+	KeepCache bool `json:"keep-cache,omitempty" yaml:"keep-cache,omitempty"`
+	// Platform is the image platform, linux/amd64 or linux/arm64, defaults to the host platform.
+	Platform string `json:"platform,omitempty" yaml:"platform,omitempty"`
+	// Pull always pulls the docker image.
+	Pull bool `json:"pull,omitempty" yaml:"pull,omitempty"`
+
+	// Hostname is the image hostname.
+	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	// DNS are the image DNS servers.
+	DNS []string `json:"dns,omitempty" yaml:"dns,omitempty"`
+	// DNSSearch are the image DNS search domains.
+	DNSSearch []string `json:"dns-search,omitempty" yaml:"dns-search,omitempty"`
+	// ExtraHosts are the image /etc/hosts entries: the IP addresses by host name.
+	ExtraHosts map[string]string `json:"add-host,omitempty" yaml:"add-host,omitempty"`
+}
+
+func (s ConvertSpec) applianceOptions() ApplianceOptions {
+	return ApplianceOptions{CPUs: s.ApplianceCPUs, Memory: s.ApplianceMemory, NIC: s.ApplianceNIC, VagrantProvider: s.VagrantProvider}
+}
+
+func (s ConvertSpec) netbootOptions() NetbootOptions {
+	return NetbootOptions{Root: s.NetbootRoot, URL: s.NetbootURL}
+}
+
+func (s ConvertSpec) luksOptions() LuksOptions {
+	return LuksOptions{
+		RecoveryPassword: s.LuksRecoveryPassword,
+		KeyFile:          s.LuksKeyFile,
+		Unlock:           s.LuksUnlock,
+		Cipher:           s.LuksCipher,
+		KeySize:          s.LuksKeySize,
+		PBKDF:            s.LuksPBKDF,
+		PBKDFMemory:      s.LuksPBKDFMemory,
+		IterTime:         s.LuksIterTime,
+	}
+}
+
+func (s ConvertSpec) readOnlyRoot() ReadOnlyRoot {
+	if !s.ReadOnly && s.Overlay == "" && !s.SquashFS && s.Verity == "" {
+		return ReadOnlyRoot{}
+	}
+	return ReadOnlyRoot{Overlay: ifElse(s.Overlay == "", OverlayTmpfs, s.Overlay), Size: uint64(s.OverlaySize), SquashFS: s.SquashFS}
+}
+
+// WithDefaults returns the spec with the size, boot size, platform and bootloader defaults set, and with the settings
+// required by the other ones enabled: the fat32 boot filesystem of the efi bootloaders and of the rootless builds,
+// and the split boot.
+func (s ConvertSpec) WithDefaults() ConvertSpec {
+	s.Size = ifElse(s.Size == "", "10G", s.Size)
+	s.BootSize = ifElse[uint64](s.BootSize == 0, defaultBootSize, s.BootSize)
+	switch s.Platform {
+	case "":
+		s.Platform = Arch
+	case "linux/aarch64":
+		s.Platform = "linux/arm64"
+	}
+	if s.BootLoader == "" {
+		s.BootLoader = ifElse(s.Platform == "linux/arm64", "grub-efi", "syslinux")
+	}
+	efi := s.BootLoader == "grub" || s.BootLoader == "grub-efi"
+	if s.BootFS == "" && (efi || s.Rootless) {
+		s.BootFS = BootFSFat32
+	}
+	if s.Verity != "" || s.SquashFS || s.LuksPassword != "" || s.BootFS != "" || efi || (s.BootLoader == "syslinux" && s.RootFS != "" && s.RootFS != RootFSExt4) {
+		s.SplitBoot = true
+	}
+	return s
+}
+
+// Validate checks the spec settings, and their combinations once the defaults are set.
+func (s ConvertSpec) Validate() error {
+	s = s.WithDefaults()
+	switch s.Platform {
+	case "linux/amd64":
+	case "linux/arm64":
+		if s.BootLoader != "grub-efi" {
+			return fmt.Errorf("unsupported bootloader for platform %s: %s, only grub-efi is supported", s.Platform, s.BootLoader)
+		}
+	default:
+		return fmt.Errorf("unexpected platform: %s, supported platforms: linux/amd64, linux/arm64", s.Platform)
+	}
+	for _, v := range s.Formats {
+		if err := validateFormat(strings.ToLower(v)); err != nil {
+			return err
+		}
+	}
+	if s.Size != "" {
+		if _, err := ParseSize(s.Size); err != nil {
+			return err
+		}
+	}
+	if s.QCOW2Compression != "" {
+		if err := s.QCOW2Compression.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := s.applianceOptions().Validate(); err != nil {
+		return err
+	}
+	if s.OutputKind != "" {
+		if err := s.OutputKind.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.OutputKind.IsNetboot() {
+		if err := s.netbootOptions().withDefaults().Validate(); err != nil {
+			return err
+		}
+	} else if s.netbootOptions() != (NetbootOptions{}) {
+		return fmt.Errorf("netboot options require the netboot output kind")
+	}
+	if s.NetworkManager != "" {
+		if err := s.NetworkManager.Validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := BootloaderByName(s.BootLoader); err != nil {
+		return err
+	}
+	if s.BootFS != "" {
+		if err := s.BootFS.Validate(); err != nil {
+			return err
+		}
+	}
+	if (s.BootLoader == "grub" || s.BootLoader == "grub-efi") && !s.BootFS.IsFat() {
+		return fmt.Errorf("grub-efi bootloader only supports fat32 boot filesystem")
+	}
+	if s.PartitionTable != "" {
+		if err := s.PartitionTable.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.RootFS != "" {
+		if err := s.RootFS.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.SwapType != "" {
+		if err := s.SwapType.Validate(); err != nil {
+			return err
+		}
+		if s.SwapSize == 0 {
+			return fmt.Errorf("swap type is set but swap size is not")
+		}
+	}
+	if s.Layout != nil {
+		if err := s.Layout.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Verity != "" {
+		if err := s.Verity.Validate(); err != nil {
+			return err
+		}
+		if s.LuksPassword != "" {
+			return fmt.Errorf("dm-verity is not supported with luks encryption")
+		}
+	}
+	r := s.readOnlyRoot()
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.IsEnabled() && s.SwapType.IsFile() {
+		return fmt.Errorf("read-only root filesystem does not support swap file")
+	}
+	if s.Rootless {
+		switch {
+		case s.LuksPassword != "":
+			return fmt.Errorf("luks encryption is not supported in rootless mode")
+		case s.Verity != "":
+			return fmt.Errorf("dm-verity is not supported in rootless mode")
+		case s.BootLoader != "syslinux":
+			return fmt.Errorf("unsupported bootloader in rootless mode: %s, only syslinux is supported", s.BootLoader)
+		case !s.BootFS.IsFat():
+			return fmt.Errorf("rootless mode only supports fat32 boot filesystem")
+		case s.RootFS != "" && s.RootFS != RootFSExt4:
+			return fmt.Errorf("rootless mode only supports ext4 root filesystem")
+		case s.SwapType.IsFile():
+			return fmt.Errorf("rootless mode does not support swap file")
+		}
+	}
+	if s.LuksPassword == "" && s.luksOptions() != (LuksOptions{}) {
+		return fmt.Errorf("luks options require a luks password")
+	}
+	if s.LuksPassword != "" && s.Reproducible {
+		return fmt.Errorf("luks encryption is not supported in reproducible build")
+	}
+	return s.luksOptions().Validate()
+}
+
+// Options returns the conversion options, with the spec defaults set and the settings required by the spec ones enabled.
+func (s ConvertSpec) Options() ([]ConvertOption, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	s = s.WithDefaults()
+	var opts []ConvertOption
+	if s.Size != "" {
+		size, _ := ParseSize(s.Size)
+		if size.Auto {
+			opts = append(opts, WithAutoSize(size.Bytes))
+		} else {
+			opts = append(opts, WithSize(size.Bytes))
+		}
+	}
+	var layout Layout
+	if s.Layout != nil {
+		layout = *s.Layout
+	}
+	return append(opts,
+		WithOutput(s.Output),
+		WithFormats(s.Formats...),
+		WithOutputKind(s.OutputKind),
+		WithNetbootOptions(s.netbootOptions()),
+		WithQCOW2Compression(s.QCOW2Compression),
+		WithApplianceOptions(s.applianceOptions()),
+		WithPassword(s.Password),
+		WithCmdLineExtra(s.CmdLineExtra),
+		WithNetworkManager(s.NetworkManager),
+		WithBootLoader(s.BootLoader),
+		WithRaw(s.Raw),
+		WithSplitBoot(s.SplitBoot),
+		WithBootSize(s.BootSize),
+		WithBootFS(s.BootFS),
+		WithPartitionTable(s.PartitionTable),
+		WithRootFS(s.RootFS),
+		WithRootFSOptions(RootFSOptions{Label: s.RootFSLabel, InodeRatio: s.RootFSInodeRatio, ReservedBlocks: s.RootFSReservedBlocks, Features: s.RootFSFeatures}),
+		WithSwap(s.SwapType, uint64(s.SwapSize)),
+		WithLayout(layout),
+		WithReadOnlyRoot(s.readOnlyRoot()),
+		WithVerity(s.Verity),
+		WithLuksPassword(s.LuksPassword),
+		WithLuksOptions(s.luksOptions()),
+		WithRootless(s.Rootless),
+		WithReproducible(s.Reproducible),
+		WithKeepCache(s.KeepCache),
+		WithPlatform(s.Platform),
+		WithPull(s.Pull),
+		WithHostname(s.Hostname),
+		WithDNS(s.DNS),
+		WithDNSSearch(s.DNSSearch),
+		WithExtraHosts(s.ExtraHosts),
+	), nil
+}
+
+// Target is a build file target: the docker image converted by d2vm convert,
+// or the docker build context of d2vm build, and its conversion spec.
+type Target struct {
+	// Image is the docker image converted by d2vm convert.
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	// Context is the docker build context directory of d2vm build, defaults to the build file directory.
+	Context string `json:"context,omitempty" yaml:"context,omitempty"`
+	// File is the Dockerfile path of d2vm build, defaults to the context directory Dockerfile.
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// BuildArgs are the d2vm build docker build-time variables.
+	BuildArgs []string `json:"build-arg,omitempty" yaml:"build-arg,omitempty"`
+
+	ConvertSpec `yaml:",inline"`
+}
+
+// BuildFile is the d2vm.yaml build file. The top-level settings are the defaults of the named targets,
+// or the single target when the file has no named targets.
+type BuildFile struct {
+	Target `yaml:",inline"`
+	// Targets are the named targets settings, overriding the top-level ones.
+	Targets map[string]Target `json:"targets,omitempty" yaml:"targets,omitempty"`
+
+	// dir is the build file directory, the relative paths are resolved from
+	dir string
+	// node is the parsed build file, used to merge the targets with the defaults
+	node *yaml.Node
+}
+
+// ParseBuildFile parses a YAML or JSON build file, and validates it against the build file schema.
+func ParseBuildFile(b []byte) (BuildFile, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return BuildFile{}, fmt.Errorf("invalid build file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return BuildFile{}, fmt.Errorf("invalid build file: empty document")
+	}
+	if err := BuildFileSchema().validate(doc.Content[0], ""); err != nil {
+		return BuildFile{}, fmt.Errorf("invalid build file: %w", err)
+	}
+	var f BuildFile
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(&f); err != nil {
+		return BuildFile{}, fmt.Errorf("invalid build file: %w", err)
+	}
+	f.node = doc.Content[0]
+	for _, v := range f.TargetNames() {
+		t, err := f.Resolve(v)
+		if err != nil {
+			return BuildFile{}, err
+		}
+		if err := t.Validate(); err != nil {
+			return BuildFile{}, fmt.Errorf("invalid build file: %s: %w", ifElse(v == "", "default target", "target "+v), err)
+		}
+	}
+	return f, nil
+}
+
+// LoadBuildFile reads the build file from path. Its relative paths are resolved from its directory.
+func LoadBuildFile(path string) (BuildFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return BuildFile{}, err
+	}
+	f, err := ParseBuildFile(b)
+	if err != nil {
+		return BuildFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.dir, err = filepath.Abs(filepath.Dir(path)); err != nil {
+		return BuildFile{}, err
+	}
+	return f, nil
+}
+
+// TargetNames returns the sorted targets names, or a single empty name if the file has no named targets.
+func (f BuildFile) TargetNames() []string {
+	if len(f.Targets) == 0 {
+		return []string{""}
+	}
+	var names []string
+	for k := range f.Targets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve returns the target settings merged with the top-level ones. The empty name is the top-level target.
+func (f BuildFile) Resolve(name string) (Target, error) {
+	if _, ok := f.Targets[name]; name != "" && !ok {
+		return Target{}, fmt.Errorf("target %q not found", name)
+	}
+	n := f.node
+	if n == nil {
+		var doc yaml.Node
+		b, err := yaml.Marshal(f)
+		if err != nil {
+			return Target{}, err
+		}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return Target{}, err
+		}
+		n = doc.Content[0]
+	}
+	// the top-level target is decoded first, then overridden by the named target
+	defaults := *n
+	defaults.Content = nil
+	var target *yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value != "targets" {
+			defaults.Content = append(defaults.Content, n.Content[i], n.Content[i+1])
+			continue
+		}
+		for j := 0; j+1 < len(n.Content[i+1].Content); j += 2 {
+			if n.Content[i+1].Content[j].Value == name {
+				target = n.Content[i+1].Content[j+1]
+			}
+		}
+	}
+	var t Target
+	if err := defaults.Decode(&t); err != nil {
+		return Target{}, err
+	}
+	if target != nil {
+		if err := target.Decode(&t); err != nil {
+			return Target{}, err
+		}
+	}
+	if f.dir == "" {
+		return t, nil
+	}
+	t.Context = ifElse(t.Context == "", f.dir, f.path(t.Context))
+	for _, v := range []*string{&t.File, &t.Output, &t.LuksKeyFile} {
+		if *v != "" {
+			*v = f.path(*v)
+		}
+	}
+	return t, nil
+}
+
+// Dir returns the build file directory, the relative paths are resolved from. It is empty for a parsed build file.
+func (f BuildFile) Dir() string {
+	return f.dir
+}
+
+func (f BuildFile) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(f.dir, p)
+}
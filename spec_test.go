@@ -0,0 +1,140 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBuildFile(t *testing.T) {
+	yml := `
+size: auto+1G
+password: root
+split-boot: true
+dns: [1.1.1.1]
+add-host:
+  registry: 10.0.0.1
+targets:
+  ubuntu:
+    image: ubuntu:22.04
+    output: ubuntu.qcow2
+    luks-password: root
+    luks-unlock: initramfs
+  debian:
+    image: debian:12
+    output: debian.qcow2
+    split-boot: false
+    swap-size: 1G
+    dns: [9.9.9.9]
+    add-host:
+      mirror: 10.0.0.2
+    layout:
+      partitions:
+      - mount: /var
+        size: 2G
+`
+	f, err := ParseBuildFile([]byte(yml))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"debian", "ubuntu"}, f.TargetNames())
+
+	u, err := f.Resolve("ubuntu")
+	require.NoError(t, err)
+	assert.Equal(t, Target{Image: "ubuntu:22.04", ConvertSpec: ConvertSpec{
+		Output:       "ubuntu.qcow2",
+		Size:         "auto+1G",
+		Password:     "root",
+		SplitBoot:    true,
+		LuksPassword: "root",
+		LuksUnlock:   LuksUnlockInitramfs,
+		DNS:          []string{"1.1.1.1"},
+		ExtraHosts:   map[string]string{"registry": "10.0.0.1"},
+	}}, u)
+
+	d, err := f.Resolve("debian")
+	require.NoError(t, err)
+	assert.Equal(t, Target{Image: "debian:12", ConvertSpec: ConvertSpec{
+		Output:     "debian.qcow2",
+		Size:       "auto+1G",
+		Password:   "root",
+		SwapSize:   datasize.GB,
+		Layout:     &Layout{Partitions: []LayoutPartition{{Mount: "/var", Size: 2 * datasize.GB}}},
+		DNS:        []string{"9.9.9.9"},
+		ExtraHosts: map[string]string{"registry": "10.0.0.1", "mirror": "10.0.0.2"},
+	}}, d)
+
+	_, err = f.Resolve("alpine")
+	assert.Error(t, err)
+
+	// the Go defined build file resolves as the parsed one
+	f.node = nil
+	u2, err := f.Resolve("ubuntu")
+	require.NoError(t, err)
+	assert.Equal(t, u, u2)
+
+	for _, v := range []string{
+		`unknown: true`,
+		`targets: {ubuntu: {image: ubuntu, sizes: 1G}}`,
+		`root-fs: ext3`,
+		`split-boot: yes please`,
+		`boot-size: 1G`,
+		`dns: 1.1.1.1`,
+		`size: big`,
+		`formats: [qcow2, img]`,
+		`swap-type: file`,
+		`luks-unlock: boot`,
+		`{luks-password: root, reproducible: true}`,
+		`layout: {partitions: [{mount: var, size: 1G}]}`,
+		`output-kind: netboot`,
+		`{output-kind: netboot, netboot-root: nfs, netboot-url: "http://10.0.0.1/d2vm"}`,
+		`netboot-url: "http://10.0.0.1/d2vm"`,
+		`output-kind: pxe`,
+		`platform: linux/riscv64`,
+		`{platform: linux/arm64, bootloader: syslinux}`,
+		`{bootloader: grub-efi, boot-fs: ext4}`,
+		`{verity: partition, luks-password: root}`,
+		`{read-only: true, swap-size: 1G, swap-type: file}`,
+		`{rootless: true, luks-password: root}`,
+		`{rootless: true, bootloader: grub-bios}`,
+		`{rootless: true, root-fs: xfs}`,
+	} {
+		_, err := ParseBuildFile([]byte(v))
+		assert.Error(t, err, v)
+	}
+}
+
+func TestConvertSpecDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		spec ConvertSpec
+		want ConvertSpec
+	}{
+		{name: "none", spec: ConvertSpec{Platform: "linux/amd64"}, want: ConvertSpec{Size: "10G", BootSize: 100, Platform: "linux/amd64", BootLoader: "syslinux"}},
+		{name: "arm64", spec: ConvertSpec{Platform: "linux/aarch64"}, want: ConvertSpec{Size: "10G", BootSize: 100, Platform: "linux/arm64", BootLoader: "grub-efi", BootFS: BootFSFat32, SplitBoot: true}},
+		{name: "rootless", spec: ConvertSpec{Size: "auto", Platform: "linux/amd64", Rootless: true}, want: ConvertSpec{Size: "auto", BootSize: 100, Platform: "linux/amd64", BootLoader: "syslinux", Rootless: true, BootFS: BootFSFat32, SplitBoot: true}},
+		{name: "verity", spec: ConvertSpec{Platform: "linux/amd64", Verity: VerityPartition}, want: ConvertSpec{Size: "10G", BootSize: 100, Platform: "linux/amd64", BootLoader: "syslinux", Verity: VerityPartition, SplitBoot: true}},
+		{name: "luks", spec: ConvertSpec{Platform: "linux/amd64", BootSize: 200, LuksPassword: "root"}, want: ConvertSpec{Size: "10G", BootSize: 200, Platform: "linux/amd64", BootLoader: "syslinux", LuksPassword: "root", SplitBoot: true}},
+		{name: "xfs syslinux", spec: ConvertSpec{Platform: "linux/amd64", RootFS: RootFSXFS}, want: ConvertSpec{Size: "10G", BootSize: 100, Platform: "linux/amd64", BootLoader: "syslinux", RootFS: RootFSXFS, SplitBoot: true}},
+		{name: "xfs grub-bios", spec: ConvertSpec{Platform: "linux/amd64", RootFS: RootFSXFS, BootLoader: "grub-bios"}, want: ConvertSpec{Size: "10G", BootSize: 100, Platform: "linux/amd64", RootFS: RootFSXFS, BootLoader: "grub-bios"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.spec.WithDefaults())
+		})
+	}
+}
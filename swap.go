@@ -0,0 +1,259 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+type SwapType string
+
+const (
+	SwapPartition SwapType = "partition"
+	SwapFile      SwapType = "file"
+)
+
+const (
+	swapFilePath = "/swapfile"
+	// swapCryptName is the device mapper name of the encrypted swap partition
+	swapCryptName = "swap"
+	// swapMinSize is the smallest swap area accepted by mkswap: 10 pages
+	swapMinSize = 40 * 1024
+)
+
+func (s SwapType) String() string {
+	return string(s)
+}
+
+func (s SwapType) IsPartition() bool {
+	return s == SwapPartition
+}
+
+func (s SwapType) IsFile() bool {
+	return s == SwapFile
+}
+
+func (s SwapType) IsSupported() bool {
+	return s.IsPartition() || s.IsFile()
+}
+
+func (s SwapType) Validate() error {
+	if !s.IsSupported() {
+		return fmt.Errorf("invalid swap type: %s valid swap types are: partition, file", s)
+	}
+	return nil
+}
+
+func (b *builder) hasSwap() bool {
+	return b.swapSize != 0
+}
+
+func (b *builder) hasSwapPart() bool {
+	return b.hasSwap() && b.swapType.IsPartition()
+}
+
+func (b *builder) hasSwapFile() bool {
+	return b.hasSwap() && b.swapType.IsFile()
+}
+
+func (b *builder) swapPartNum() int {
+	n := b.rootPartNum() + len(b.layout.mounts()) + 1
+	if b.hasVerityPart() {
+		n++
+	}
+	if b.hasOverlayPart() {
+		n++
+	}
+	return n
+}
+
+// swapSizeMiB returns the swap size rounded up to the MiB, as the partitions are aligned on MiB boundaries.
+func (b *builder) swapSizeMiB() uint64 {
+	return roundUp(b.swapSize, mib) / mib
+}
+
+// swapStartMiB returns the swap partition offset: it is the last partition,
+// leaving the last MiB to the GPT backup header.
+func (b *builder) swapStartMiB() uint64 {
+	return b.size/mib - b.swapSizeMiB() - 1
+}
+
+// makeSwap creates the swap area on the swap partition. The encrypted swap partition is formatted
+// at each boot with a random key, so there is nothing to do beside finding its PARTUUID.
+func (b *builder) makeSwap(ctx context.Context) (err error) {
+	if !b.hasSwapPart() {
+		return nil
+	}
+	b.swapPart = b.partPath(b.swapPartNum())
+	if b.isLuksEnabled() {
+		b.swapPartUUID, err = b.partUUID(ctx, b.swapPartNum())
+		return err
+	}
+	logger(ctx).Infof("creating swap partition")
+	return exec.Run(ctx, "mkswap", append(b.mkfsIDArgs("swap", "swap"), b.swapPart)...)
+}
+
+// partUUID returns the partition n PARTUUID, read from the partition table, as the device mapper
+// partitions created by kpartx are not known as partitions by blkid.
+func (b *builder) partUUID(ctx context.Context, n int) (string, error) {
+	if b.partitionTable.IsGPT() {
+		o, _, err := exec.RunOut(ctx, "sgdisk", "-i", strconv.Itoa(n), b.diskRaw)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range strings.Split(o, "\n") {
+			if id, ok := strings.CutPrefix(v, "Partition unique GUID: "); ok {
+				return strings.ToLower(strings.TrimSpace(id)), nil
+			}
+		}
+		return "", fmt.Errorf("partition %d unique GUID not found", n)
+	}
+	o, _, err := exec.RunOut(ctx, "blkid", "-p", "-s", "PTUUID", "-o", "value", b.diskRaw)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%02d", strings.TrimSpace(o), n), nil
+}
+
+// makeSwapRootless writes the swap area header in the disk image swap partition.
+func (b *builder) makeSwapRootless(ctx context.Context, parts map[int]partition) error {
+	if !b.hasSwapPart() {
+		return nil
+	}
+	swap, ok := parts[b.swapPartNum()]
+	if !ok {
+		return fmt.Errorf("swap partition %d not found", b.swapPartNum())
+	}
+	logger(ctx).Infof("creating swap partition")
+	p := filepath.Join(filepath.Dir(b.mntPoint), "swap.img")
+	if err := block(p, swap.size); err != nil {
+		return err
+	}
+	defer os.Remove(p)
+	if err := exec.Run(ctx, "mkswap", "-U", b.swapUUID, p); err != nil {
+		return err
+	}
+	// the swap area is empty: only its header, stored in the first page, needs to be copied.
+	// 64KiB covers the largest page size.
+	const bs = 64 * 1024
+	return exec.Run(ctx, "dd", "if="+p, "of="+b.diskRaw, fmt.Sprintf("bs=%d", bs), "count=1", fmt.Sprintf("seek=%d", swap.offset/bs), "conv=notrunc")
+}
+
+// makeSwapFile creates the swap file in the root filesystem.
+func (b *builder) makeSwapFile(ctx context.Context) error {
+	if !b.hasSwapFile() {
+		return nil
+	}
+	logger(ctx).Infof("creating swap file")
+	p := b.chPath(swapFilePath)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if b.rootFS.IsBtrfs() {
+		// btrfs swap files must not be copy-on-write nor compressed
+		if err := exec.Run(ctx, "chattr", "+C", p); err != nil {
+			return err
+		}
+	}
+	// swap files must not have holes, so they cannot be allocated with truncate
+	if err := exec.Run(ctx, "dd", "if=/dev/zero", "of="+p, "bs=1M", fmt.Sprintf("count=%d", b.swapSizeMiB())); err != nil {
+		return err
+	}
+	if err := exec.Run(ctx, "mkswap", append(b.mkfsIDArgs("swap", "swapfile"), p)...); err != nil {
+		return err
+	}
+	if !b.supportsResume() {
+		return nil
+	}
+	b.resumeOffset, err = b.swapFileOffset(ctx, p)
+	return err
+}
+
+// swapFileOffset returns the physical offset of the swap file, in pages, as expected by resume_offset.
+func (b *builder) swapFileOffset(ctx context.Context, p string) (uint64, error) {
+	if b.rootFS.IsBtrfs() {
+		o, _, err := exec.RunOut(ctx, "btrfs", "inspect-internal", "map-swapfile", "-r", p)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(o), 10, 64)
+	}
+	o, _, err := exec.RunOut(ctx, "filefrag", "-v", "-b4096", p)
+	if err != nil {
+		return 0, err
+	}
+	return parseFilefragOffset(o)
+}
+
+// parseFilefragOffset returns the physical offset of the first extent of the filefrag -v output.
+func parseFilefragOffset(o string) (uint64, error) {
+	// the first extent line looks like:
+	//   0:        0..   32767:      34816..     67583:  32768:
+	for _, v := range strings.Split(o, "\n") {
+		f := strings.Split(v, ":")
+		if len(f) < 3 || strings.TrimSpace(f[0]) != "0" {
+			continue
+		}
+		start, _, _ := strings.Cut(strings.TrimSpace(f[2]), "..")
+		return strconv.ParseUint(strings.TrimSpace(start), 10, 64)
+	}
+	return 0, fmt.Errorf("swap file physical offset not found: %s", o)
+}
+
+// supportsResume returns whether the kernel can resume from hibernation using the swap:
+// the random key encrypted swap partition cannot be used to resume, and alpine's initramfs
+// does not support it.
+func (b *builder) supportsResume() bool {
+	return b.hasSwap() && !b.isLuksEnabled() && b.osRelease.ID != ReleaseAlpine
+}
+
+func (b *builder) swapFstab() string {
+	switch {
+	case b.hasSwapFile():
+		return fmt.Sprintf("%s none swap sw 0 0\n", swapFilePath)
+	case b.hasSwapPart() && b.isLuksEnabled():
+		return fmt.Sprintf("/dev/mapper/%s none swap sw 0 0\n", swapCryptName)
+	case b.hasSwapPart():
+		return fmt.Sprintf("UUID=%s none swap sw 0 0\n", b.swapUUID)
+	default:
+		return ""
+	}
+}
+
+// swapCrypttab returns the crypttab entry of the encrypted swap partition, formatted at each boot with a random key.
+func (b *builder) swapCrypttab() string {
+	return fmt.Sprintf("%s PARTUUID=%s /dev/urandom swap,cipher=aes-xts-plain64,size=512\n", swapCryptName, b.swapPartUUID)
+}
+
+func (b *builder) resumeCmdline() string {
+	if !b.supportsResume() {
+		return ""
+	}
+	if b.hasSwapFile() {
+		return fmt.Sprintf("resume=UUID=%s resume_offset=%d", b.rootUUID, b.resumeOffset)
+	}
+	return "resume=UUID=" + b.swapUUID
+}
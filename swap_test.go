@@ -0,0 +1,144 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwapFstab(t *testing.T) {
+	tests := []struct {
+		name string
+		b    builder
+		want string
+	}{
+		{name: "no swap", b: builder{swapUUID: "uuid"}},
+		{name: "file", b: builder{swapType: SwapFile, swapSize: mib}, want: "/swapfile none swap sw 0 0\n"},
+		{name: "partition", b: builder{swapType: SwapPartition, swapSize: mib, swapUUID: "uuid"}, want: "UUID=uuid none swap sw 0 0\n"},
+		{name: "encrypted partition", b: builder{swapType: SwapPartition, swapSize: mib, swapUUID: "uuid", luksPassword: "root"}, want: "/dev/mapper/swap none swap sw 0 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.b.swapFstab())
+		})
+	}
+}
+
+func TestResumeCmdline(t *testing.T) {
+	ubuntu := OSRelease{ID: ReleaseUbuntu, VersionID: "22.04"}
+	tests := []struct {
+		name string
+		b    builder
+		want string
+	}{
+		{name: "no swap", b: builder{osRelease: ubuntu, rootUUID: "root", swapUUID: "swap"}},
+		{name: "partition", b: builder{osRelease: ubuntu, swapType: SwapPartition, swapSize: mib, rootUUID: "root", swapUUID: "swap"}, want: "resume=UUID=swap"},
+		{name: "file", b: builder{osRelease: ubuntu, swapType: SwapFile, swapSize: mib, rootUUID: "root", resumeOffset: 34816}, want: "resume=UUID=root resume_offset=34816"},
+		// the random key encrypted swap cannot be resumed from
+		{name: "encrypted partition", b: builder{osRelease: ubuntu, swapType: SwapPartition, swapSize: mib, swapUUID: "swap", luksPassword: "root"}},
+		{name: "alpine", b: builder{osRelease: OSRelease{ID: ReleaseAlpine, VersionID: "3.18"}, swapType: SwapPartition, swapSize: mib, swapUUID: "swap"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.b.resumeCmdline())
+		})
+	}
+}
+
+func TestParseFilefragOffset(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    uint64
+		wantErr bool
+	}{
+		{
+			name: "contiguous",
+			output: `Filesystem type is: ef53
+File size of /swapfile is 134217728 (32768 blocks of 4096 bytes)
+ ext:     logical_offset:        physical_offset: length:   expected: flags:
+   0:        0..   32767:      34816..     67583:  32768:             last,eof
+/swapfile: 1 extent found
+`,
+			want: 34816,
+		},
+		{
+			name: "fragmented",
+			output: `Filesystem type is: ef53
+File size of /swapfile is 134217728 (32768 blocks of 4096 bytes)
+ ext:     logical_offset:        physical_offset: length:   expected: flags:
+   0:        0..   30719:     1050624..   1081343:  30720:            
+   1:    30720..   32767:     1085440..   1087487:   2048:    1081344: last,eof
+/swapfile: 2 extents found
+`,
+			want: 1050624,
+		},
+		{
+			name: "no extent",
+			output: `Filesystem type is: ef53
+File size of /swapfile is 0 (0 blocks of 4096 bytes)
+/swapfile: 0 extents found
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid offset",
+			output: `Filesystem type is: ef53
+ ext:     logical_offset:        physical_offset: length:   expected: flags:
+   0:        0..   32767:      unknown..     67583:  32768:             last,eof
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFilefragOffset(tt.output)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSwapPartNum(t *testing.T) {
+	layout := Layout{Partitions: []LayoutPartition{{Mount: "/"}, {Mount: "/var"}, {Mount: "/home"}}}
+	overlay := ReadOnlyRoot{Overlay: OverlayPartition, Size: 64 * mib}
+	tests := []struct {
+		name string
+		b    builder
+		want int
+	}{
+		{name: "msdos", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}}, want: 2},
+		{name: "msdos split boot", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}, splitBoot: true}, want: 3},
+		{name: "gpt grub", b: builder{partitionTable: PartitionTableGPT, bootloader: grub{}}, want: 3},
+		// the swap partition is the last one
+		{name: "layout", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, layout: layout}, want: 5},
+		{name: "verity", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, verity: VerityPartition}, want: 4},
+		{name: "overlay", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, readOnly: overlay}, want: 4},
+		{name: "all partitions", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, layout: layout, verity: VerityPartition, readOnly: overlay}, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.b.swapType, tt.b.swapSize = SwapPartition, mib
+			assert.Equal(t, tt.want, tt.b.swapPartNum())
+		})
+	}
+}
@@ -19,8 +19,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-
-	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
 
 	"go.linka.cloud/d2vm/pkg/exec"
 )
@@ -55,15 +55,50 @@ func (s syslinux) Validate(_ BootFS) error {
 }
 
 func (s syslinux) Setup(ctx context.Context, dev, root string, cmdline string) error {
-	logrus.Infof("setting up syslinux bootloader")
+	logger(ctx).Infof("setting up syslinux bootloader")
 	if err := exec.Run(ctx, "extlinux", "--install", filepath.Join(root, "boot")); err != nil {
 		return err
 	}
 	if err := os.WriteFile(filepath.Join(root, "boot", "syslinux.cfg"), []byte(fmt.Sprintf(syslinuxCfg, s.c.Kernel, cmdline)), perm); err != nil {
 		return err
 	}
-	logrus.Infof("writing MBR")
-	if err := exec.Run(ctx, "dd", fmt.Sprintf("if=%s", s.mbrBin), fmt.Sprintf("of=%s", dev), "bs=440", "count=1", "conv=notrunc"); err != nil {
+	return s.writeMBR(ctx, dev)
+}
+
+func (s syslinux) SetupImage(ctx context.Context, img string, bootOffset uint64, cmdline string) error {
+	logger(ctx).Infof("setting up syslinux bootloader")
+	f, err := os.CreateTemp("", "syslinux.cfg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(fmt.Sprintf(syslinuxCfg, s.c.Kernel, cmdline)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := exec.Run(ctx, "mcopy", "-o", "-i", fmt.Sprintf("%s@@%d", img, bootOffset), f.Name(), "::/syslinux.cfg"); err != nil {
+		return err
+	}
+	if err := exec.Run(ctx, "syslinux", "--offset", strconv.FormatUint(bootOffset, 10), "--install", img); err != nil {
+		return err
+	}
+	return s.writeMBR(ctx, img)
+}
+
+func (s syslinux) writeMBR(ctx context.Context, dev string) error {
+	mbrBin := s.mbrBin
+	pt, _, err := exec.RunOut(ctx, "blkid", "-p", "-s", "PTTYPE", "-o", "value", dev)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(pt) == PartitionTableGPT.String() {
+		mbrBin = filepath.Join(filepath.Dir(s.mbrBin), "gptmbr.bin")
+	}
+	logger(ctx).Infof("writing MBR")
+	if err := exec.Run(ctx, "dd", fmt.Sprintf("if=%s", mbrBin), fmt.Sprintf("of=%s", dev), "bs=440", "count=1", "conv=notrunc"); err != nil {
 		return err
 	}
 	return nil
@@ -72,7 +107,7 @@ func (s syslinux) Setup(ctx context.Context, dev, root string, cmdline string) e
 type syslinuxProvider struct{}
 
 func (s syslinuxProvider) New(c Config, _ OSRelease, arch string) (Bootloader, error) {
-	if arch != "x86_64" {
+	if arch != archAMD64 {
 		return nil, fmt.Errorf("syslinux is only supported for amd64")
 	}
 	mbrBin := ""
@@ -0,0 +1,5 @@
+#!/bin/sh
+
+# sets up the read-only root filesystem overlay, the hook is sourced by dracut
+
+/sbin/d2vm-overlay "$NEWROOT" || die "d2vm-overlay: failed to set up the root filesystem overlay"
@@ -0,0 +1,21 @@
+#!/bin/bash
+
+# dracut module installing d2vm-overlay, only included when explicitly added
+
+check() {
+  return 255
+}
+
+depends() {
+  return 0
+}
+
+installkernel() {
+  hostonly='' instmods overlay squashfs
+}
+
+install() {
+  inst_script /usr/sbin/d2vm-overlay /sbin/d2vm-overlay
+  inst_multiple cat mkdir modprobe mount sleep
+  inst_hook pre-pivot 10 "$moddir/d2vm-overlay.sh"
+}
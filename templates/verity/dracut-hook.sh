@@ -0,0 +1,6 @@
+#!/bin/sh
+
+# opens the dm-verity protected root partition, the hook is sourced by dracut on each initqueue iteration:
+# the root device is never found if the root partition was modified
+
+[ -e /dev/mapper/root ] || /sbin/d2vm-verity || warn "d2vm-verity: failed to open the dm-verity root device"
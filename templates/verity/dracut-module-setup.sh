@@ -0,0 +1,22 @@
+#!/bin/bash
+
+# dracut module installing d2vm-verity, only included when explicitly added
+
+check() {
+  return 255
+}
+
+depends() {
+  echo dm
+  return 0
+}
+
+installkernel() {
+  hostonly='' instmods dm-verity
+}
+
+install() {
+  inst_script /usr/sbin/d2vm-verity /sbin/d2vm-verity
+  inst_multiple cat modprobe sleep veritysetup
+  inst_hook initqueue/settled 50 "$moddir/d2vm-verity.sh"
+}
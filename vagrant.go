@@ -0,0 +1,156 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// VagrantInsecureKey is the Vagrant insecure public key, replaced by Vagrant with a generated key on the first boot.
+const VagrantInsecureKey = "ssh-rsa AAAAB3NzaC1yc2EAAAABIwAAAQEA6NF8iallvQVp22WDkTkyrtvp9eWW6A8YVr+kz4TjGYe7gHzIw+niNltGEFHzD8+v1I2YJ6oXevct1YeS0o9HZyN1Q9qgCgzUFtdOKLv6IedplqoPkcmF0aYet2PkEDo3MlTBckFXPITAMzF8dJSIFo9D8HfdOV0IAdx4O7PtixWKn5y2hMNG0zQPyUecp4pzC6kivAIhyfHilFR61RGL+GPXQ2MWZWFYbAGjyiYJnAmCP3NOTd0jMZEnDkbUvxhMmBYSdETk1rRgm+R4LOzFUGaHqHDLKLX+FIPKcF96hrucXzcWyLbIbEgE98OHlnVYCzRdK8jlqm8tehUc9c9WhQ== vagrant insecure public key"
+
+// VagrantProvider is the Vagrant provider of the box.
+type VagrantProvider string
+
+const (
+	VagrantProviderLibvirt    VagrantProvider = "libvirt"
+	VagrantProviderVirtualBox VagrantProvider = "virtualbox"
+)
+
+func (p VagrantProvider) String() string {
+	return string(p)
+}
+
+func (p VagrantProvider) IsLibvirt() bool {
+	return p == VagrantProviderLibvirt
+}
+
+func (p VagrantProvider) IsVirtualBox() bool {
+	return p == VagrantProviderVirtualBox
+}
+
+func (p VagrantProvider) IsSupported() bool {
+	return p.IsLibvirt() || p.IsVirtualBox()
+}
+
+func (p VagrantProvider) Validate() error {
+	if !p.IsSupported() {
+		return fmt.Errorf("invalid vagrant provider: %s valid providers are: libvirt, virtualbox", p)
+	}
+	return nil
+}
+
+type vagrantfile struct {
+	ApplianceOptions
+	EFI bool
+}
+
+var vagrantfileTemplate = template.Must(template.New("Vagrantfile").Parse(`Vagrant.configure("2") do |config|
+  # the image does not ship the guest additions nor rsync
+  config.vm.synced_folder ".", "/vagrant", disabled: true
+  config.vm.provider :{{ .VagrantProvider }} do |v|
+{{- if .VagrantProvider.IsLibvirt }}
+    v.driver = "kvm"
+    v.disk_bus = "virtio"
+{{- if .EFI }}
+    # the OVMF firmware path depends on the host distribution
+    v.loader = "/usr/share/OVMF/OVMF_CODE.fd"
+{{- end }}
+{{- else if .EFI }}
+    v.customize ["modifyvm", :id, "--firmware", "efi"]
+{{- end }}
+    v.cpus = {{ .CPUs }}
+    v.memory = {{ .Memory }}
+  end
+end
+`))
+
+func (v vagrantfile) Render(w io.Writer) error {
+	return vagrantfileTemplate.Execute(w, v)
+}
+
+// boxMetadata returns the box metadata.json content.
+func boxMetadata(p VagrantProvider, size uint64) ([]byte, error) {
+	m := map[string]any{"provider": p.String()}
+	if p.IsLibvirt() {
+		m["format"] = "qcow2"
+		// the virtual size is a number of GiB
+		m["virtual_size"] = (size + uint64(datasize.GB) - 1) / uint64(datasize.GB)
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// vagrantfile returns the box default Vagrantfile for the given appliance options.
+func (b *builder) vagrantfile(o ApplianceOptions) vagrantfile {
+	return vagrantfile{ApplianceOptions: o, EFI: b.efiFirmware()}
+}
+
+// makeBox writes the Vagrant box: the metadata, a default Vagrantfile and the disk, a qcow2 image for libvirt,
+// or an ovf appliance for virtualbox, in a tar archive.
+// The archive is not compressed: the qcow2 image only holds the allocated clusters, and the vmdk is compressed.
+func (b *builder) makeBox(ctx context.Context, progress ProgressFunc, path string) error {
+	dir := path + ".d"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	o := b.appliance.withDefaults()
+	var disk []string
+	if o.VagrantProvider.IsVirtualBox() {
+		disk = applianceFiles(filepath.Join(dir, "box.ovf"))
+		if err := b.makeOVF(ctx, progress, disk[0]); err != nil {
+			return err
+		}
+	} else {
+		disk = []string{filepath.Join(dir, "box.img")}
+		args := append([]string{"-O", "qcow2"}, b.qcow2Compression.qemuImgArgs()...)
+		if err := qemuImgConvert(ctx, progress, append(args, b.diskRaw, disk[0])...); err != nil {
+			return err
+		}
+	}
+	metadata, err := boxMetadata(o.VagrantProvider, b.size)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), metadata, perm); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "Vagrantfile"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := b.vagrantfile(o).Render(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	mtime := time.Now()
+	if b.reproducible.IsEnabled() {
+		mtime = b.reproducible.Epoch
+	}
+	logger(ctx).Infof("archiving %s vagrant box", o.VagrantProvider)
+	return tarFiles(path, mtime, append([]string{filepath.Join(dir, "metadata.json"), filepath.Join(dir, "Vagrantfile")}, disk...)...)
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVagrantBoxMetadata(t *testing.T) {
+	b, err := boxMetadata(VagrantProviderLibvirt, 10*uint64(datasize.GB)+1)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"provider": "libvirt", "format": "qcow2", "virtual_size": 11}`, string(b))
+	b, err = boxMetadata(VagrantProviderVirtualBox, 10*uint64(datasize.GB))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"provider": "virtualbox"}`, string(b))
+}
+
+func TestVagrantfile(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, vagrantfile{ApplianceOptions: ApplianceOptions{VagrantProvider: VagrantProviderVirtualBox}.withDefaults(), EFI: true}.Render(&b))
+	assert.Contains(t, b.String(), "config.vm.provider :virtualbox do |v|")
+	assert.Contains(t, b.String(), `"--firmware", "efi"`)
+	assert.Contains(t, b.String(), "v.memory = 1024")
+	b.Reset()
+	require.NoError(t, vagrantfile{ApplianceOptions: ApplianceOptions{CPUs: 2}.withDefaults()}.Render(&b))
+	assert.Contains(t, b.String(), "config.vm.provider :libvirt do |v|")
+	assert.Contains(t, b.String(), "v.cpus = 2")
+	assert.NotContains(t, b.String(), "loader")
+}
+
+func TestBuilderVagrantfile(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		bootloader BootloaderProvider
+		efi        bool
+	}{
+		{name: "grub", bootloader: grubProvider{}},
+		{name: "grub-bios", bootloader: grubBiosProvider{}},
+		{name: "grub-efi", bootloader: grubEFIProvider{}, efi: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := OSRelease{ID: ReleaseUbuntu}
+			bl, err := tt.bootloader.New(Config{}, r, archAMD64)
+			require.NoError(t, err)
+			b := &builder{osRelease: r, arch: archAMD64, bootloader: bl}
+			var w bytes.Buffer
+			require.NoError(t, b.vagrantfile(ApplianceOptions{VagrantProvider: VagrantProviderVirtualBox}.withDefaults()).Render(&w))
+			assert.Equal(t, tt.efi, strings.Contains(w.String(), `"--firmware", "efi"`))
+		})
+	}
+}
+
+func TestVagrantDockerfile(t *testing.T) {
+	for _, r := range []OSRelease{
+		{ID: ReleaseUbuntu, VersionID: "22.04"},
+		{ID: ReleaseDebian, VersionID: "12"},
+		{ID: ReleaseAlpine, VersionID: "3.18"},
+		{ID: ReleaseCentOS, VersionID: "8"},
+	} {
+		t.Run(string(r.ID), func(t *testing.T) {
+			for _, vagrant := range []bool{false, true} {
+				var opts []ConvertOption
+				if vagrant {
+					opts = append(opts, WithFormats("box"))
+				}
+				d, err := NewDockerfile(r, "img", "", NetworkManagerNone, false, false, false, opts...)
+				require.NoError(t, err)
+				var b strings.Builder
+				require.NoError(t, d.Render(&b))
+				assert.Equal(t, vagrant, strings.Contains(b.String(), `echo "`+VagrantInsecureKey+`" > /home/vagrant/.ssh/authorized_keys`))
+				assert.Equal(t, vagrant, strings.Contains(b.String(), "NOPASSWD: ALL"))
+			}
+		})
+	}
+}
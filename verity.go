@@ -0,0 +1,246 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"go.uber.org/multierr"
+
+	"go.linka.cloud/d2vm/pkg/exec"
+)
+
+// Verity is the location of the dm-verity hash tree protecting the root partition.
+type Verity string
+
+const (
+	// VerityPartition stores the hash tree on a dedicated partition.
+	VerityPartition Verity = "partition"
+	// VerityAppended stores the hash tree in the root partition, after the root filesystem.
+	VerityAppended Verity = "appended"
+)
+
+const (
+	// verityName is the device mapper name of the verified root device
+	verityName = "root"
+	// verityBlockSize is the veritysetup default data and hash block size
+	verityBlockSize = 4096
+	// verityHashesPerBlock is the number of sha256 digests stored in a hash block
+	verityHashesPerBlock = verityBlockSize / 32
+)
+
+func (v Verity) String() string {
+	return string(v)
+}
+
+func (v Verity) IsPartition() bool {
+	return v == VerityPartition
+}
+
+func (v Verity) IsAppended() bool {
+	return v == VerityAppended
+}
+
+func (v Verity) IsSupported() bool {
+	return v.IsPartition() || v.IsAppended()
+}
+
+func (v Verity) IsEnabled() bool {
+	return v != ""
+}
+
+func (v Verity) Validate() error {
+	if !v.IsSupported() {
+		return fmt.Errorf("invalid verity hash tree location: %s valid locations are: partition, appended", v)
+	}
+	return nil
+}
+
+// verityHashSize returns the size of the hash tree of data bytes, including the verity superblock.
+func verityHashSize(data uint64) uint64 {
+	blocks := roundUp(data, verityBlockSize) / verityBlockSize
+	size := uint64(verityBlockSize)
+	for {
+		blocks = roundUp(blocks, verityHashesPerBlock) / verityHashesPerBlock
+		size += blocks * verityBlockSize
+		if blocks <= 1 {
+			return size
+		}
+	}
+}
+
+func (b *builder) hasVerityPart() bool {
+	return b.verity.IsPartition()
+}
+
+// verityPartNum returns the verity hash partition number: it follows the layout partitions.
+func (b *builder) verityPartNum() int {
+	return b.rootPartNum() + len(b.layout.mounts()) + 1
+}
+
+// setupVerity allocates the verity hash partition before end, sized for the largest root partition
+// the remaining disk space allows, and returns its start.
+func (b *builder) setupVerity(end uint64) uint64 {
+	available := end - b.bootSize
+	for _, v := range b.layout.mounts() {
+		p, _ := b.layout.partition(v)
+		available -= roundUp(uint64(p.Size), mib) / mib
+	}
+	b.verityStart = end - roundUp(verityHashSize(available*mib), mib)/mib
+	b.verityEnd = end
+	return b.verityStart
+}
+
+// verityDataSize returns the size of the root filesystem when the hash tree is appended to the root partition.
+func verityDataSize(part uint64) uint64 {
+	return (part - verityHashSize(part)) / verityBlockSize * verityBlockSize
+}
+
+// prepareVerity limits the root filesystem size, so that the hash tree can be appended to the root partition.
+func (b *builder) prepareVerity(ctx context.Context) error {
+	if !b.verity.IsAppended() {
+		return nil
+	}
+	parts, err := imgPartitions(ctx, b.diskRaw)
+	if err != nil {
+		return err
+	}
+	root, ok := parts[b.rootPartNum()]
+	if !ok {
+		return fmt.Errorf("root partition %d not found", b.rootPartNum())
+	}
+	b.rootPartSize = root.size
+	return nil
+}
+
+// makeVerity computes the root partition hash tree. The root filesystem is remounted read-only,
+// as it must not change once hashed.
+func (b *builder) makeVerity(ctx context.Context) (err error) {
+	if !b.verity.IsEnabled() {
+		return nil
+	}
+	if !b.readOnly.SquashFS {
+		if err := exec.Run(ctx, "mount", "-o", "remount,ro", b.mntPoint); err != nil {
+			return err
+		}
+	}
+	logger(ctx).Infof("computing dm-verity hash tree")
+	args := append([]string{"format"}, b.verityArgs()...)
+	hash := b.verityPart
+	if b.verity.IsAppended() {
+		data := verityDataSize(b.rootPartSize)
+		if b.readOnly.SquashFS {
+			data = roundUp(b.squashFSSize, verityBlockSize)
+			if data+verityHashSize(data) > b.rootPartSize {
+				return fmt.Errorf("squashfs root image and its hash tree (%s) do not fit in the root partition (%s)", datasize.ByteSize(data+verityHashSize(data)).HR(), datasize.ByteSize(b.rootPartSize).HR())
+			}
+		}
+		b.verityHashOffset = data
+		hash = b.rootPart
+		args = append(args, fmt.Sprintf("--data-blocks=%d", data/verityBlockSize), fmt.Sprintf("--hash-offset=%d", data))
+	}
+	o, _, err := exec.RunOut(ctx, "veritysetup", append(args, b.rootPart, hash)...)
+	if err != nil {
+		return err
+	}
+	for _, v := range strings.Split(o, "\n") {
+		if h, ok := strings.CutPrefix(v, "Root hash:"); ok {
+			b.verityRootHash = strings.TrimSpace(h)
+		}
+	}
+	if b.verityRootHash == "" {
+		return fmt.Errorf("dm-verity root hash not found: %s", o)
+	}
+	if b.rootPartUUID, err = b.partUUID(ctx, b.rootPartNum()); err != nil {
+		return err
+	}
+	if !b.hasVerityPart() {
+		return nil
+	}
+	b.verityPartUUID, err = b.partUUID(ctx, b.verityPartNum())
+	return err
+}
+
+// mountVerityBootloaderConfig mounts a writable copy of the /etc/default directory over the root filesystem one once
+// it is sealed by dm-verity: grub writes its configuration there, and the root hash is only known after sealing.
+// The bootloader files are written in the boot partition, split from the verified root partition.
+// The copy is not part of the image, the returned function unmounts it.
+func (b *builder) mountVerityBootloaderConfig(ctx context.Context) (func() error, error) {
+	noop := func() error { return nil }
+	if !b.verity.IsEnabled() || b.readOnly.SquashFS {
+		return noop, nil
+	}
+	target := b.chPath("/etc/default")
+	if _, err := os.Stat(target); err != nil {
+		return noop, nil
+	}
+	dir := filepath.Join(filepath.Dir(b.mntPoint), "etc-default")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := exec.Run(ctx, "cp", "-a", target+"/.", dir); err != nil {
+		return nil, err
+	}
+	if err := exec.Run(ctx, "mount", "--bind", dir, target); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return multierr.Combine(exec.Run(ctx, "umount", target), os.RemoveAll(dir))
+	}, nil
+}
+
+// verityCmdline returns the kernel parameters used by the initramfs to open the verified root device.
+func (b *builder) verityCmdline() string {
+	args := []string{
+		"d2vm.verity=" + b.verityRootHash,
+		"d2vm.verity.data=PARTUUID=" + b.rootPartUUID,
+		"d2vm.verity.hash=PARTUUID=" + ifElse(b.hasVerityPart(), b.verityPartUUID, b.rootPartUUID),
+	}
+	if b.verity.IsAppended() {
+		args = append(args, fmt.Sprintf("d2vm.verity.hashoffset=%d", b.verityHashOffset))
+	}
+	return strings.Join(args, " ")
+}
+
+func (b *builder) validateVerity() error {
+	if !b.verity.IsEnabled() {
+		return nil
+	}
+	if err := b.verity.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case b.osRelease.ID == ReleaseAlpine:
+		return fmt.Errorf("dm-verity is not supported on %s", b.osRelease.ID)
+	case !b.readOnly.IsEnabled():
+		return fmt.Errorf("dm-verity requires a read-only root filesystem")
+	case !b.splitBoot:
+		return fmt.Errorf("dm-verity requires split boot")
+	case b.isLuksEnabled():
+		return fmt.Errorf("dm-verity is not supported with luks encryption")
+	case b.rootless:
+		return fmt.Errorf("dm-verity is not supported in rootless build")
+	case b.rootFS.IsBtrfs():
+		return fmt.Errorf("dm-verity is not supported with a btrfs root filesystem")
+	case b.verity.IsAppended() && !b.readOnly.SquashFS && !b.rootFS.IsExt():
+		return fmt.Errorf("appended dm-verity hash tree requires an ext4 or squashfs root filesystem")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Linka Cloud  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package d2vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerityHashSize(t *testing.T) {
+	tests := []struct {
+		name string
+		data uint64
+		want uint64
+	}{
+		{name: "one block", data: verityBlockSize, want: 2 * verityBlockSize},
+		{name: "one hash block", data: verityHashesPerBlock * verityBlockSize, want: 2 * verityBlockSize},
+		{name: "two levels", data: (verityHashesPerBlock + 1) * verityBlockSize, want: 4 * verityBlockSize},
+		// 262144 data blocks: 2048 + 16 + 1 hash blocks and the superblock
+		{name: "1GiB", data: gib, want: 2066 * verityBlockSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, verityHashSize(tt.data))
+		})
+	}
+}
+
+func TestVerityDataSize(t *testing.T) {
+	for _, v := range []uint64{8 * mib, 100 * mib, 10 * gib} {
+		data := verityDataSize(v)
+		assert.Zero(t, data%verityBlockSize)
+		assert.LessOrEqual(t, data+verityHashSize(data), v)
+	}
+}
+
+func TestVerityPartNum(t *testing.T) {
+	layout := Layout{Partitions: []LayoutPartition{{Mount: "/"}, {Mount: "/var"}, {Mount: "/home"}}}
+	tests := []struct {
+		name string
+		b    builder
+		want int
+	}{
+		{name: "msdos", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}}, want: 2},
+		{name: "msdos split boot", b: builder{partitionTable: PartitionTableMSDOS, bootloader: grub{}, splitBoot: true}, want: 3},
+		{name: "gpt grub", b: builder{partitionTable: PartitionTableGPT, bootloader: grub{}}, want: 3},
+		{name: "gpt grub-efi split boot", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true}, want: 3},
+		// the hash partition follows the layout partitions
+		{name: "layout", b: builder{partitionTable: PartitionTableGPT, bootloader: grubEFI{}, splitBoot: true, layout: layout}, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.b.verity = VerityPartition
+			assert.Equal(t, tt.want, tt.b.verityPartNum())
+		})
+	}
+}